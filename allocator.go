@@ -0,0 +1,180 @@
+package ipset
+
+import (
+	"errors"
+	"net/netip"
+)
+
+var (
+	ErrPoolExhausted    = errors.New("no free prefix of the requested length")
+	ErrNotInPool        = errors.New("prefix is not within the pool")
+	ErrInUse            = errors.New("prefix overlaps with the used space")
+	ErrNotAllocated     = errors.New("prefix is not allocated")
+	ErrInvalidPrefixLen = errors.New("invalid prefix length")
+)
+
+type AllocStrategy int
+
+const (
+	// FirstFit allocates the lowest free prefix.
+	FirstFit AllocStrategy = iota
+	// BestFit allocates from the smallest free block that can hold the requested prefix, which keeps the larger
+	// blocks available for larger requests.
+	BestFit
+)
+
+// Allocator allocates free prefixes within a pool, using an IPSet to keep track of the used space.
+// The free space is found by descending the tree, so the cost of an allocation depends on the size of the tree
+// rather than on the number of addresses within the pool.
+type Allocator struct {
+	Strategy AllocStrategy
+
+	pool    netip.Prefix
+	poolPfx ipPrefix
+	poolLen uint32
+	bits    uint32
+	used    *IPSet
+	base    *ipsetBase
+}
+
+// NewAllocator creates an allocator for the pool. The used set contains the space that is already in use,
+// it is updated by Allocate, AllocateSpecific and Release. If used is nil, a new empty set is created.
+func NewAllocator(pool netip.Prefix, used *IPSet) *Allocator {
+	if used == nil {
+		used = new(IPSet)
+	}
+	a := &Allocator{
+		pool: unmapPrefix(pool).Masked(),
+		used: used,
+	}
+	a.poolPfx, a.bits = ipPrefixFromAddr(a.pool.Addr())
+	a.poolLen = uint32(a.pool.Bits())
+	if a.bits == 32 {
+		a.base = &used.s4.ipsetBase
+	} else {
+		a.base = &used.s6.ipsetBase
+	}
+	return a
+}
+
+// unmapPrefix converts a prefix of an IPv4-mapped IPv6 address into an IPv4 prefix.
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if addr := prefix.Addr(); addr.Is4In6() {
+		bits := prefix.Bits() - 96
+		if bits < 0 {
+			bits = 0
+		}
+		return netip.PrefixFrom(addr.Unmap(), bits)
+	}
+	return prefix
+}
+
+// Pool returns the pool prefix.
+func (a *Allocator) Pool() netip.Prefix {
+	return a.pool
+}
+
+// Used returns the set of used space.
+func (a *Allocator) Used() *IPSet {
+	return a.used
+}
+
+type freeBlock struct {
+	prefix ipPrefix
+	depth  uint32
+	found  bool
+}
+
+// findFree looks for a free subtree at the depth not greater than prefixLen. It returns true if the search
+// should stop.
+func (a *Allocator) findFree(r nodeRef, prefix ipPrefix, depth, prefixLen uint32, best *freeBlock) bool {
+	if r.ptr == ptrAbsent {
+		if !best.found || depth > best.depth {
+			*best = freeBlock{prefix: prefix, depth: depth, found: true}
+		}
+		return a.Strategy == FirstFit || depth == prefixLen
+	}
+	if r.ptr == ptrPresent || depth == prefixLen {
+		return false
+	}
+	left, right := a.base.children(r)
+	return a.findFree(left, prefix, depth+1, prefixLen, best) ||
+		a.findFree(right, prefix.withBit(depth), depth+1, prefixLen, best)
+}
+
+// poolRef returns the node corresponding to the pool prefix.
+func (a *Allocator) poolRef() nodeRef {
+	r := a.base.rootRef()
+	for depth := uint32(0); depth < a.poolLen && !r.isLeaf(); depth++ {
+		r = a.base.child(r, a.poolPfx, depth)
+	}
+	return r
+}
+
+// Allocate finds a free prefix of the specified length within the pool according to the Strategy, marks it as
+// used and returns it.
+func (a *Allocator) Allocate(bits int) (netip.Prefix, error) {
+	if bits < int(a.poolLen) || bits > int(a.bits) {
+		return netip.Prefix{}, ErrInvalidPrefixLen
+	}
+	var best freeBlock
+	a.findFree(a.poolRef(), a.poolPfx, a.poolLen, uint32(bits), &best)
+	if !best.found {
+		return netip.Prefix{}, ErrPoolExhausted
+	}
+	a.base.add(best.prefix, uint32(bits))
+	return best.prefix.toNetip(uint32(bits), a.bits), nil
+}
+
+func (a *Allocator) checkPrefix(prefix netip.Prefix) (p ipPrefix, prefixLen uint32, err error) {
+	prefix = unmapPrefix(prefix)
+	if !prefix.IsValid() || prefix.Bits() < a.pool.Bits() || !a.pool.Contains(prefix.Addr()) {
+		return ipPrefix{}, 0, ErrNotInPool
+	}
+	p, _ = ipPrefixFromAddr(prefix.Addr())
+	return p, uint32(prefix.Bits()), nil
+}
+
+// AllocateSpecific marks the prefix as used. It returns ErrInUse if any part of the prefix is already used.
+func (a *Allocator) AllocateSpecific(prefix netip.Prefix) error {
+	p, prefixLen, err := a.checkPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	if a.base.overlaps(p, prefixLen) {
+		return ErrInUse
+	}
+	a.base.add(p, prefixLen)
+	return nil
+}
+
+// Release returns the prefix to the pool. It returns ErrNotAllocated if the prefix is not entirely used.
+func (a *Allocator) Release(prefix netip.Prefix) error {
+	p, prefixLen, err := a.checkPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	if !a.base.covers(p, prefixLen) {
+		return ErrNotAllocated
+	}
+	a.base.remove(p, prefixLen)
+	return nil
+}
+
+// Free calls the step function for each of the largest free prefixes within the pool in ascending order.
+// See IPSet.Iterate for more details.
+func (a *Allocator) Free(step IterStepFunc) bool {
+	return a.iterateFree(step, a.poolRef(), a.poolPfx, a.poolLen)
+}
+
+func (a *Allocator) iterateFree(step IterStepFunc, r nodeRef, prefix ipPrefix, depth uint32) bool {
+	if r.ptr == ptrAbsent {
+		return step(prefix.toNetip(depth, a.bits))
+	}
+	if r.ptr == ptrPresent {
+		return true
+	}
+	left, right := a.base.children(r)
+	return a.iterateFree(step, left, prefix, depth+1) &&
+		a.iterateFree(step, right, prefix.withBit(depth), depth+1)
+}
@@ -0,0 +1,169 @@
+package ipset
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func freePrefixes(a *Allocator) (list []string) {
+	a.Free(func(p netip.Prefix) bool {
+		list = append(list, p.String())
+		return true
+	})
+	return
+}
+
+func TestAllocator(t *testing.T) {
+	var used IPSet
+	used.Add(netip.MustParsePrefix("10.0.0.0/26"))
+	used.Add(netip.MustParsePrefix("10.0.0.128/27"))
+	used.Add(netip.MustParsePrefix("192.168.0.0/16"))
+
+	a := NewAllocator(netip.MustParsePrefix("10.0.0.0/24"), &used)
+
+	p, err := a.Allocate(26)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != netip.MustParsePrefix("10.0.0.64/26") {
+		t.Fatal(p)
+	}
+
+	p, err = a.Allocate(28)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != netip.MustParsePrefix("10.0.0.160/28") {
+		t.Fatal(p)
+	}
+
+	if list := freePrefixes(a); len(list) != 2 || list[0] != "10.0.0.176/28" || list[1] != "10.0.0.192/26" {
+		t.Fatal(list)
+	}
+
+	_, err = a.Allocate(25)
+	if !errors.Is(err, ErrPoolExhausted) {
+		t.Fatal(err)
+	}
+	_, err = a.Allocate(23)
+	if !errors.Is(err, ErrInvalidPrefixLen) {
+		t.Fatal(err)
+	}
+
+	err = a.AllocateSpecific(netip.MustParsePrefix("10.0.0.192/27"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.AllocateSpecific(netip.MustParsePrefix("10.0.0.192/28"))
+	if !errors.Is(err, ErrInUse) {
+		t.Fatal(err)
+	}
+	err = a.AllocateSpecific(netip.MustParsePrefix("10.0.0.0/24"))
+	if !errors.Is(err, ErrInUse) {
+		t.Fatal(err)
+	}
+	err = a.AllocateSpecific(netip.MustParsePrefix("10.0.1.0/28"))
+	if !errors.Is(err, ErrNotInPool) {
+		t.Fatal(err)
+	}
+
+	err = a.Release(netip.MustParsePrefix("10.0.0.64/26"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used.Contains(netip.MustParseAddr("10.0.0.65")) {
+		t.Fatal()
+	}
+	err = a.Release(netip.MustParsePrefix("10.0.0.64/26"))
+	if !errors.Is(err, ErrNotAllocated) {
+		t.Fatal(err)
+	}
+	err = a.Release(netip.MustParsePrefix("10.0.0.128/26"))
+	if !errors.Is(err, ErrNotAllocated) {
+		t.Fatal(err)
+	}
+
+	if list := freePrefixes(a); len(list) != 3 || list[0] != "10.0.0.64/26" || list[1] != "10.0.0.176/28" ||
+		list[2] != "10.0.0.224/27" {
+		t.Fatal(list)
+	}
+}
+
+func TestAllocatorBestFit(t *testing.T) {
+	a := NewAllocator(netip.MustParsePrefix("10.0.0.0/24"), nil)
+	a.Strategy = BestFit
+	err := a.AllocateSpecific(netip.MustParsePrefix("10.0.0.16/28"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.AllocateSpecific(netip.MustParsePrefix("10.0.0.128/25"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.AllocateSpecific(netip.MustParsePrefix("10.0.0.96/28"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Free blocks: 10.0.0.0/28, 10.0.0.32/27, 10.0.0.64/27, 10.0.0.112/28
+	p, err := a.Allocate(29)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != netip.MustParsePrefix("10.0.0.0/29") {
+		t.Fatal(p)
+	}
+	p, err = a.Allocate(28)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != netip.MustParsePrefix("10.0.0.112/28") {
+		t.Fatal(p)
+	}
+
+	a.Strategy = FirstFit
+	p, err = a.Allocate(28)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != netip.MustParsePrefix("10.0.0.32/28") {
+		t.Fatal(p)
+	}
+}
+
+func TestAllocator6(t *testing.T) {
+	a := NewAllocator(netip.MustParsePrefix("2001:db8::/32"), nil)
+	for i := 0; i < 3; i++ {
+		p, err := a.Allocate(48)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := netip.PrefixFrom(netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 0, byte(i)}), 48); p != expected {
+			t.Fatal(p, expected)
+		}
+	}
+	err := a.Release(netip.MustParsePrefix("2001:db8:1::/48"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Allocate(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != netip.MustParsePrefix("2001:db8:1::/64") {
+		t.Fatal(p)
+	}
+	if !a.Used().Contains(netip.MustParseAddr("2001:db8:2::1")) {
+		t.Fatal()
+	}
+
+	a = NewAllocator(netip.MustParsePrefix("2001:db8::/127"), nil)
+	for i := 0; i < 2; i++ {
+		if _, err := a.Allocate(128); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.Allocate(128); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatal(err)
+	}
+}
@@ -28,6 +28,44 @@ func (p *ipPrefix) shl(bits uint32) uint32 {
 type ipsetBase struct {
 	nodes    []uint32
 	freeList []uint32
+
+	// counts holds the number of addresses in the left subtree of each regular node, indexed by the index of
+	// the node divided by 2, and total holds the number of addresses in the set. They are built on demand by
+	// buildCounts, counts must be reset whenever the tree is modified.
+	counts []uint128
+	total  uint128
+
+	// root is the index of the root slot, 0 means 1. It changes when the root slot is shared with a snapshot.
+	root uint32
+	// frozen is the number of elements at the start of nodes that may be shared with snapshots. They must not
+	// be modified, the paths that are about to be modified are copied first (see unsharePath).
+	frozen uint32
+
+	// If trackRetired is set, the frozen nodes that become unreachable are collected in retired instead of being
+	// dropped, so that they could be reused once no snapshot refers to them (see RCUIPSet).
+	trackRetired bool
+	retired      []uint32
+}
+
+func (s *ipsetBase) rootSlot() uint32 {
+	if s.root == 0 {
+		return 1
+	}
+	return s.root
+}
+
+// isEmpty returns true if the set contains no addresses.
+func (s *ipsetBase) isEmpty() bool {
+	return len(s.nodes) < 2 || s.nodes[s.rootSlot()] == ptrAbsent
+}
+
+// release puts the node to the free list unless it may be shared with a snapshot.
+func (s *ipsetBase) release(idx uint32) {
+	if idx >= s.frozen {
+		s.freeList = append(s.freeList, idx)
+	} else if s.trackRetired {
+		s.retired = append(s.retired, idx)
+	}
 }
 
 func ptrToIdx(ptr uint32) uint32 {
@@ -81,6 +119,13 @@ func (s *ipsetBase) freeNode(ptr uint32) {
 		return
 	}
 	idx := ptrToIdx(ptr)
+	if idx < s.frozen {
+		// The whole subtree is shared
+		if s.trackRetired {
+			s.retireNode(ptr)
+		}
+		return
+	}
 	s.freeList = append(s.freeList, idx)
 	s.freeNode(s.nodes[idx+1])
 	if !isSkipNode(ptr) {
@@ -151,13 +196,15 @@ func (s *ipsetBase) createSplitNode(prefix uint32, prefixLen uint32, childPtr, i
 }
 
 func (s *ipsetBase) add(p ipPrefix, prefixLen uint32) {
+	s.counts = nil
 	if len(s.nodes) == 0 {
 		s.nodes = make([]uint32, 2, 8)
 	}
+	s.unsharePath(p, prefixLen)
 	prefix := p.hi32()
 	origPrefix := p
 	var lastRegIdx uint32 = 0
-	var nextIdx uint32 = 1
+	var nextIdx = s.rootSlot()
 	for prefixLen > 0 {
 		ptr := s.getPtr(nextIdx)
 		if *ptr == ptrAbsent {
@@ -287,7 +334,7 @@ func (s *ipsetBase) mergeNodes(p ipPrefix) {
 	traceLen := 0
 
 	ip := p.hi32()
-	idx := uint32(1)
+	idx := s.rootSlot()
 	for {
 		ptr := s.nodes[idx]
 		if ptr == ptrPresent {
@@ -318,14 +365,14 @@ func (s *ipsetBase) mergeNodes(p ipPrefix) {
 	for i := traceLen - 1; i >= 0; i-- {
 		idx := s.nodes[trace[i]]
 		if s.nodes[idx] == ptrPresent && s.nodes[idx+1] == ptrPresent {
-			s.freeList = append(s.freeList, idx)
+			s.release(idx)
 			s.nodes[trace[i]] = ptrPresent
 		}
 	}
 }
 
 func (s *ipsetBase) Compact() {
-	if len(s.freeList) == 0 {
+	if len(s.freeList) == 0 && s.root == 0 && s.frozen == 0 {
 		if cap(s.nodes) > len(s.nodes) {
 			n := make([]uint32, len(s.nodes))
 			copy(n, s.nodes)
@@ -333,10 +380,14 @@ func (s *ipsetBase) Compact() {
 		}
 	} else {
 		n := make([]uint32, 2, len(s.nodes)-len(s.freeList)*2)
-		n[1] = s.compactNode(&n, s.nodes[1])
+		n[1] = s.compactNode(&n, s.nodes[s.rootSlot()])
 		s.nodes = n
 	}
+	s.counts = nil
 	s.freeList = nil
+	s.root = 0
+	s.frozen = 0
+	s.retired = nil
 }
 
 func (s *ipsetBase) compactNode(n *[]uint32, ptr uint32) (newPtr uint32) {
@@ -357,3 +408,124 @@ func (s *ipsetBase) compactNode(n *[]uint32, ptr uint32) (newPtr uint32) {
 	}
 	return
 }
+
+// remove deletes the prefix from the set. If the prefix is a part of a larger prefix, the remainder of the larger
+// prefix is retained.
+func (s *ipsetBase) remove(p ipPrefix, prefixLen uint32) {
+	if len(s.nodes) < 2 {
+		return
+	}
+	s.counts = nil
+	s.unsharePath(p, prefixLen)
+	root := s.removeNode(s.nodes[s.rootSlot()], p, prefixLen)
+	s.nodes[s.rootSlot()] = root
+}
+
+func (s *ipsetBase) removeNode(ptr uint32, p ipPrefix, prefixLen uint32) uint32 {
+	if ptr == ptrAbsent {
+		return ptrAbsent
+	}
+	if prefixLen == 0 {
+		s.freeNode(ptr)
+		return ptrAbsent
+	}
+	prefix := p.hi32()
+	if ptr == ptrPresent {
+		// Replace the prefix with a regular node that keeps the other half and recurse into the half being removed.
+		// Every such node has two children, so unlike in add, there are no chains that could be packed into skip nodes.
+		bit := prefix >> 31
+		p.shl(1)
+		var v [2]uint32
+		v[bit] = s.removeNode(ptrPresent, p, prefixLen-1)
+		v[bit^1] = ptrPresent
+		return idxToPtr(s.allocateNode(v[0], v[1]))
+	}
+	idx := ptrToIdx(ptr)
+	if !isSkipNode(ptr) {
+		bit := prefix >> 31
+		p.shl(1)
+		child := s.removeNode(s.nodes[idx+bit], p, prefixLen-1)
+		s.nodes[idx+bit] = child
+		if child == ptrAbsent && s.nodes[idx+(bit^1)] == ptrAbsent {
+			s.release(idx)
+			return ptrAbsent
+		}
+		return ptr
+	}
+	curPrefix, curPrefixLen := unpackPrefixLen(s.nodes[idx])
+	commonLen := uint32(bits.LeadingZeros32(prefix ^ curPrefix))
+	if commonLen < curPrefixLen && commonLen < prefixLen {
+		// The prefixes do not overlap
+		return ptr
+	}
+	if prefixLen <= curPrefixLen {
+		// The whole subtree is within the prefix being removed
+		s.freeNode(ptr)
+		return ptrAbsent
+	}
+	p.shl(curPrefixLen)
+	child := s.removeNode(s.nodes[idx+1], p, prefixLen-curPrefixLen)
+	if child == ptrAbsent {
+		s.release(idx)
+		return ptrAbsent
+	}
+	s.nodes[idx+1] = child
+	return ptr
+}
+
+// coarsen replaces all subtrees at the specified depth with ptrPresent, so that the set does not contain prefixes
+// longer than prefixLen.
+func (s *ipsetBase) coarsen(prefixLen uint32) {
+	if len(s.nodes) < 2 {
+		return
+	}
+	if s.frozen != 0 {
+		// The whole tree may be modified, so make a private copy first
+		s.Compact()
+	}
+	s.counts = nil
+	root := s.coarsenNode(s.nodes[s.rootSlot()], prefixLen)
+	s.nodes[s.rootSlot()] = root
+}
+
+func (s *ipsetBase) coarsenNode(ptr, prefixLen uint32) uint32 {
+	if ptr <= ptrPresent {
+		return ptr
+	}
+	if prefixLen == 0 {
+		s.freeNode(ptr)
+		return ptrPresent
+	}
+	idx := ptrToIdx(ptr)
+	if !isSkipNode(ptr) {
+		left := s.coarsenNode(s.nodes[idx], prefixLen-1)
+		s.nodes[idx] = left
+		right := s.coarsenNode(s.nodes[idx+1], prefixLen-1)
+		s.nodes[idx+1] = right
+		if left == ptrPresent && right == ptrPresent {
+			s.release(idx)
+			return ptrPresent
+		}
+		return ptr
+	}
+	prefix, l := unpackPrefixLen(s.nodes[idx])
+	if l < prefixLen {
+		child := s.coarsenNode(s.nodes[idx+1], prefixLen-l)
+		s.nodes[idx+1] = child
+		return ptr
+	}
+	// The cut is within the skip node, shorten it and replace the subtree. If the new length is 1,
+	// convert the skip node into a regular one.
+	s.freeNode(s.nodes[idx+1])
+	if prefixLen > 1 {
+		s.nodes[idx] = packPrefixLen(prefix, prefixLen)
+		s.nodes[idx+1] = ptrPresent
+		return ptr
+	}
+	if prefix&0x8000_0000 == 0 {
+		s.nodes[idx], s.nodes[idx+1] = ptrPresent, ptrAbsent
+	} else {
+		s.nodes[idx], s.nodes[idx+1] = ptrAbsent, ptrPresent
+	}
+	return idxToPtr(idx)
+}
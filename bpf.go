@@ -0,0 +1,128 @@
+package ipset
+
+import (
+	"io"
+	"net/netip"
+)
+
+// LPM_TRIE keys have the layout of struct bpf_lpm_trie_key: a 32-bit prefix length in host byte order followed
+// by the address bytes in network byte order.
+const lpmPrefixLenSize = 4
+
+func appendLPMTrieKey(b []byte, prefix netip.Prefix) []byte {
+	var l [lpmPrefixLenSize]byte
+	nativeByteOrder.PutUint32(l[:], uint32(prefix.Bits()))
+	b = append(b, l[:]...)
+	return append(b, prefix.Addr().AsSlice()...)
+}
+
+func writeLPMTrie(w io.Writer, iterate func(IterStepFunc) bool, value []byte) (n int64, err error) {
+	var buf []byte
+	iterate(func(prefix netip.Prefix) bool {
+		buf = appendLPMTrieKey(buf[:0], prefix)
+		buf = append(buf, value...)
+		n1, err1 := w.Write(buf)
+		n += int64(n1)
+		if err1 != nil {
+			err = err1
+			return false
+		}
+		return true
+	})
+	return
+}
+
+func writeBpftoolBatch(w io.Writer, iterate func(IterStepFunc) bool, mapRef string, value []byte) (n int64, err error) {
+	var buf, key []byte
+	iterate(func(prefix netip.Prefix) bool {
+		buf = append(buf[:0], "map update "...)
+		buf = append(buf, mapRef...)
+		buf = append(buf, " key hex"...)
+		key = appendLPMTrieKey(key[:0], prefix)
+		buf = appendHexBytes(buf, key)
+		buf = append(buf, " value hex"...)
+		buf = appendHexBytes(buf, value)
+		buf = append(buf, '\n')
+		n1, err1 := w.Write(buf)
+		n += int64(n1)
+		if err1 != nil {
+			err = err1
+			return false
+		}
+		return true
+	})
+	return
+}
+
+func appendHexBytes(buf, b []byte) []byte {
+	const digits = "0123456789abcdef"
+	for _, c := range b {
+		buf = append(buf, ' ', digits[c>>4], digits[c&0xF])
+	}
+	return buf
+}
+
+// WriteLPMTrieTo writes the prefixes of the set as a flat sequence of BPF_MAP_TYPE_LPM_TRIE entries. Each entry
+// consists of an 8-byte key (struct { __u32 prefixlen; __u8 data[4]; }) followed by the value. The prefix length is
+// written in the host byte order, as expected by the kernel.
+// There will be one w.Write() call per prefix, so it is advisable to provide a buffered Writer.
+func (s *IPSet4) WriteLPMTrieTo(w io.Writer, value []byte) (n int64, err error) {
+	return writeLPMTrie(w, s.Iterate, value)
+}
+
+// WriteBpftoolBatchTo writes a 'bpftool batch' file with one 'map update' command per prefix. The mapRef
+// identifies the map as accepted by bpftool, e.g. "pinned /sys/fs/bpf/blocklist" or "id 42".
+// See WriteLPMTrieTo for the key layout.
+func (s *IPSet4) WriteBpftoolBatchTo(w io.Writer, mapRef string, value []byte) (n int64, err error) {
+	return writeBpftoolBatch(w, s.Iterate, mapRef, value)
+}
+
+// WriteLPMTrieTo writes the prefixes of the set as a flat sequence of BPF_MAP_TYPE_LPM_TRIE entries with 20-byte
+// keys (struct { __u32 prefixlen; __u8 data[16]; }).
+// See IPSet4.WriteLPMTrieTo for more details.
+func (s *IPSet6) WriteLPMTrieTo(w io.Writer, value []byte) (n int64, err error) {
+	return writeLPMTrie(w, s.Iterate, value)
+}
+
+// WriteBpftoolBatchTo writes a 'bpftool batch' file with one 'map update' command per prefix.
+// See IPSet4.WriteBpftoolBatchTo for more details.
+func (s *IPSet6) WriteBpftoolBatchTo(w io.Writer, mapRef string, value []byte) (n int64, err error) {
+	return writeBpftoolBatch(w, s.Iterate, mapRef, value)
+}
+
+// WriteLPMTrieTo writes BPF_MAP_TYPE_LPM_TRIE entries for the IPv4 and the IPv6 prefixes to w4 and w6
+// respectively. LPM_TRIE maps have a fixed key size, so the two families must be loaded into separate maps.
+// If either of the writers is nil, the corresponding family is skipped.
+// See IPSet4.WriteLPMTrieTo for more details.
+func (s *IPSet) WriteLPMTrieTo(w4, w6 io.Writer, value []byte) (n int64, err error) {
+	if w4 != nil {
+		n, err = s.s4.WriteLPMTrieTo(w4, value)
+		if err != nil {
+			return
+		}
+	}
+	if w6 != nil {
+		n1, err1 := s.s6.WriteLPMTrieTo(w6, value)
+		n += n1
+		err = err1
+	}
+	return
+}
+
+// WriteBpftoolBatchTo writes a 'bpftool batch' file that updates the map4 map with the IPv4 prefixes and the map6 map
+// with the IPv6 prefixes. If either of the map references is empty, the corresponding family is skipped.
+// See IPSet4.WriteBpftoolBatchTo for more details.
+func (s *IPSet) WriteBpftoolBatchTo(w io.Writer, map4, map6 string, value []byte) (n int64, err error) {
+	if map4 != "" {
+		n, err = s.s4.WriteBpftoolBatchTo(w, map4, value)
+		if err != nil {
+			return
+		}
+	}
+	if map6 != "" {
+		n1, err1 := s.s6.WriteBpftoolBatchTo(w, map6, value)
+		n += n1
+		err = err1
+	}
+	return
+}
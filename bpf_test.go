@@ -0,0 +1,81 @@
+package ipset
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestIPSet_WriteLPMTrieTo(t *testing.T) {
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	s.Add(netip.MustParsePrefix("192.168.1.1/32"))
+	s.Add(netip.MustParsePrefix("2001:db8::/32"))
+
+	var b4, b6 bytes.Buffer
+	n, err := s.WriteLPMTrieTo(&b4, &b6, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(b4.Len()+b6.Len()) {
+		t.Fatal(n)
+	}
+
+	var expected4 []byte
+	for _, e := range []struct {
+		bits uint32
+		data []byte
+	}{{8, []byte{10, 0, 0, 0}}, {32, []byte{192, 168, 1, 1}}} {
+		var l [4]byte
+		nativeByteOrder.PutUint32(l[:], e.bits)
+		expected4 = append(expected4, l[:]...)
+		expected4 = append(expected4, e.data...)
+		expected4 = append(expected4, 1)
+	}
+	if !bytes.Equal(b4.Bytes(), expected4) {
+		t.Fatalf("%x", b4.Bytes())
+	}
+
+	var l [4]byte
+	nativeByteOrder.PutUint32(l[:], 32)
+	expected6 := append(l[:], 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1)
+	if !bytes.Equal(b6.Bytes(), expected6) {
+		t.Fatalf("%x", b6.Bytes())
+	}
+
+	b4.Reset()
+	_, err = s.WriteLPMTrieTo(&b4, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b4.Len() != 16 {
+		t.Fatal(b4.Len())
+	}
+}
+
+func TestIPSet_WriteBpftoolBatchTo(t *testing.T) {
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	s.Add(netip.MustParsePrefix("2001:db8::/32"))
+
+	var b strings.Builder
+	n, err := s.WriteBpftoolBatchTo(&b, "pinned /sys/fs/bpf/block4", "pinned /sys/fs/bpf/block6", []byte{1, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(b.Len()) {
+		t.Fatal(n)
+	}
+
+	l8, l32 := "08 00 00 00", "20 00 00 00"
+	if nativeByteOrder.Uint32([]byte{0, 0, 0, 1}) == 1 {
+		l8, l32 = "00 00 00 08", "00 00 00 20"
+	}
+	expected := "map update pinned /sys/fs/bpf/block4 key hex " + l8 + " 0a 00 00 00 value hex 01 00 00 00\n" +
+		"map update pinned /sys/fs/bpf/block6 key hex " + l32 +
+		" 20 01 0d b8 00 00 00 00 00 00 00 00 00 00 00 00 value hex 01 00 00 00\n"
+	if str := b.String(); str != expected {
+		t.Fatal(str)
+	}
+}
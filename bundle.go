@@ -0,0 +1,328 @@
+package ipset
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"unsafe"
+)
+
+var (
+	ErrDuplicateName = errors.New("duplicate set name")
+	ErrSetNotFound   = errors.New("set not found")
+)
+
+var bundleMagic = [4]byte{'I', 'P', 'S', 'B'}
+
+const (
+	bundleVersion     = 1
+	bundleHeaderSize  = 8
+	bundleTrailerSize = 12
+	bundleAlign       = 8
+)
+
+type bundleEntry struct {
+	name string
+	off  int64
+	size int64
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// BundleWriter writes multiple named sets into a single file that can be read with OpenBundle.
+//
+// The file starts with the "IPSB" magic and a 32-bit little-endian version, followed by the sets serialized by
+// IPSet.Serialize, each aligned to 8 bytes. After the sets comes the index: the number of sets, then the name,
+// the offset and the size of each set, all encoded as unsigned varints (the name is preceded by its length).
+// The file ends with the offset of the index as a 64-bit little-endian integer and the magic.
+type BundleWriter struct {
+	w     countingWriter
+	index []bundleEntry
+	names map[string]struct{}
+}
+
+// NewBundleWriter returns a writer that writes a bundle to w. Close must be called to write the index.
+func NewBundleWriter(w io.Writer) *BundleWriter {
+	return &BundleWriter{
+		w:     countingWriter{w: w},
+		names: make(map[string]struct{}),
+	}
+}
+
+func (b *BundleWriter) pad() error {
+	var zero [bundleAlign]byte
+	if n := b.w.n % bundleAlign; n != 0 {
+		_, err := b.w.Write(zero[:bundleAlign-n])
+		return err
+	}
+	return nil
+}
+
+// writeHeader writes the file header unless it has been written already.
+func (b *BundleWriter) writeHeader() error {
+	if b.w.n != 0 {
+		return nil
+	}
+	var hdr [bundleHeaderSize]byte
+	copy(hdr[:], bundleMagic[:])
+	binary.LittleEndian.PutUint32(hdr[4:], bundleVersion)
+	_, err := b.w.Write(hdr[:])
+	return err
+}
+
+// Add writes the set to the bundle under the specified name. The names must be unique.
+func (b *BundleWriter) Add(name string, s *IPSet) error {
+	if _, exists := b.names[name]; exists {
+		return ErrDuplicateName
+	}
+	if err := b.writeHeader(); err != nil {
+		return err
+	}
+	if err := b.pad(); err != nil {
+		return err
+	}
+	off := b.w.n
+	if err := s.Serialize(&b.w); err != nil {
+		return err
+	}
+	b.names[name] = struct{}{}
+	b.index = append(b.index, bundleEntry{name: name, off: off, size: b.w.n - off})
+	return nil
+}
+
+// Close writes the index. It does not close the underlying writer.
+func (b *BundleWriter) Close() error {
+	if err := b.writeHeader(); err != nil {
+		return err
+	}
+	indexOff := b.w.n
+	bw := bufio.NewWriter(&b.w)
+	var buf [binary.MaxVarintLen64]byte
+	writeUvarint := func(v uint64) {
+		bw.Write(buf[:binary.PutUvarint(buf[:], v)])
+	}
+	writeUvarint(uint64(len(b.index)))
+	for _, e := range b.index {
+		writeUvarint(uint64(len(e.name)))
+		bw.WriteString(e.name)
+		writeUvarint(uint64(e.off))
+		writeUvarint(uint64(e.size))
+	}
+	var trailer [bundleTrailerSize]byte
+	binary.LittleEndian.PutUint64(trailer[:], uint64(indexOff))
+	copy(trailer[8:], bundleMagic[:])
+	bw.Write(trailer[:])
+	return bw.Flush()
+}
+
+// Bundle is a read-only collection of named sets written by BundleWriter. Only the index is read when the bundle
+// is opened, the sets are loaded individually by Get.
+type Bundle struct {
+	r     io.ReaderAt
+	f     *os.File
+	data  []byte // the memory-mapped file if available
+	index []bundleEntry
+	names map[string]int
+}
+
+// OpenBundle opens a bundle file. Where supported, the file is memory-mapped and the sets returned by Get refer to
+// the mapped memory directly instead of being copied (see Get).
+func OpenBundle(path string) (*Bundle, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	b, err := NewBundle(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	b.f = f
+	if nativeByteOrder == binary.LittleEndian && fi.Size() > 0 {
+		// Failing to map the file is not fatal, the sets are read from the file instead
+		b.data, _ = mmapFile(f, fi.Size())
+	}
+	return b, nil
+}
+
+// NewBundle reads the index of a bundle of the specified size from r.
+func NewBundle(r io.ReaderAt, size int64) (*Bundle, error) {
+	var trailer [bundleTrailerSize]byte
+	if size < bundleHeaderSize+bundleTrailerSize {
+		return nil, ErrInvalidFormat
+	}
+	if _, err := r.ReadAt(trailer[:], size-bundleTrailerSize); err != nil {
+		return nil, err
+	}
+	var hdr [bundleHeaderSize]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return nil, err
+	}
+	if string(trailer[8:]) != string(bundleMagic[:]) || string(hdr[:4]) != string(bundleMagic[:]) {
+		return nil, ErrInvalidFormat
+	}
+	if binary.LittleEndian.Uint32(hdr[4:]) != bundleVersion {
+		return nil, ErrInvalidFormat
+	}
+	indexOff := int64(binary.LittleEndian.Uint64(trailer[:]))
+	if indexOff < bundleHeaderSize || indexOff > size-bundleTrailerSize {
+		return nil, ErrInvalidFormat
+	}
+	br := bufio.NewReader(io.NewSectionReader(r, indexOff, size-bundleTrailerSize-indexOff))
+	var err error
+	readUvarint := func() uint64 {
+		v, e := binary.ReadUvarint(br)
+		if e != nil && err == nil {
+			err = ErrInvalidFormat
+		}
+		return v
+	}
+	count := readUvarint()
+	b := &Bundle{r: r, names: make(map[string]int)}
+	for i := uint64(0); i < count && err == nil; i++ {
+		l := readUvarint()
+		if err != nil || l > uint64(size-indexOff) {
+			return nil, ErrInvalidFormat
+		}
+		name := make([]byte, l)
+		if _, e := io.ReadFull(br, name); e != nil {
+			return nil, ErrInvalidFormat
+		}
+		e := bundleEntry{name: string(name), off: int64(readUvarint()), size: int64(readUvarint())}
+		if e.off < bundleHeaderSize || e.off > indexOff || e.size < 0 || e.size > indexOff-e.off || e.off%bundleAlign != 0 {
+			return nil, ErrInvalidFormat
+		}
+		b.names[e.name] = len(b.index)
+		b.index = append(b.index, e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Names returns the names of the sets in the order they were added.
+func (b *Bundle) Names() []string {
+	names := make([]string, len(b.index))
+	for i, e := range b.index {
+		names[i] = e.name
+	}
+	return names
+}
+
+func (b *Bundle) entry(name string) (bundleEntry, error) {
+	i, ok := b.names[name]
+	if !ok {
+		return bundleEntry{}, ErrSetNotFound
+	}
+	return b.index[i], nil
+}
+
+// Get loads the set with the specified name. If the bundle is memory-mapped, the set uses the mapped memory
+// without copying it, so loading is fast regardless of the size of the set. Such a set must not be used after
+// the bundle is closed. The mapped memory is never written to: the first modification copies the whole node array
+// into the heap, so if the set is going to be modified, it is better to Clone it.
+func (b *Bundle) Get(name string) (*IPSet, error) {
+	e, err := b.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	if b.data != nil {
+		return setFromMapped(b.data[e.off : e.off+e.size])
+	}
+	var s IPSet
+	r := io.NewSectionReader(b.r, e.off, e.size)
+	if err := s.Deserialize(r); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Open returns an IPSetReaderAt for the set with the specified name, so that it can be queried without loading it.
+func (b *Bundle) Open(name string) (*IPSetReaderAt, error) {
+	e, err := b.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewIPSetReaderAt(io.NewSectionReader(b.r, e.off, e.size))
+}
+
+// Close releases the resources associated with the bundle if it was opened by OpenBundle.
+func (b *Bundle) Close() error {
+	var err error
+	if b.data != nil {
+		err = munmapFile(b.data)
+		b.data = nil
+	}
+	if b.f != nil {
+		if err1 := b.f.Close(); err == nil {
+			err = err1
+		}
+		b.f = nil
+	}
+	return err
+}
+
+// mappedNodes returns the serialized tree at the beginning of the data as a node array along with the size of
+// the serialized data. The data must be 4-byte aligned.
+func mappedNodes(data []byte) ([]uint32, int, error) {
+	if len(data) < 4 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	if size == 0 {
+		return nil, 4, nil
+	}
+	if size&3 != 0 || size < 8 {
+		return nil, 0, ErrInvalidFormat
+	}
+	if size > len(data) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	return unsafe.Slice((*uint32)(unsafe.Pointer(&data[0])), size/4), size, nil
+}
+
+// setFromMapped returns a set that refers to the serialized data directly. All nodes are frozen, so that they are
+// never modified in place.
+func setFromMapped(data []byte) (*IPSet, error) {
+	var m *Metadata
+	if len(data) >= 4 && binary.LittleEndian.Uint32(data) == metadataMagic {
+		r := bytes.NewReader(data[4:])
+		var err error
+		if m, err = readMetadataBody(r); err != nil {
+			return nil, err
+		}
+		data = data[len(data)-r.Len():]
+	}
+	nodes4, size, err := mappedNodes(data)
+	if err != nil {
+		return nil, err
+	}
+	nodes6, _, err := mappedNodes(data[size:])
+	if err != nil {
+		return nil, err
+	}
+	s := IPSet{metadata: m}
+	s.s4.loadNodes(nodes4)
+	s.s4.frozen = uint32(len(nodes4))
+	s.s6.loadNodes(nodes6)
+	s.s6.frozen = uint32(len(nodes6))
+	return &s, nil
+}
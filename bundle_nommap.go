@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package ipset
+
+import "os"
+
+func mmapFile(*os.File, int64) ([]byte, error) {
+	return nil, nil
+}
+
+func munmapFile([]byte) error {
+	return nil
+}
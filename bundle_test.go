@@ -0,0 +1,149 @@
+package ipset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	rs := rand.New(rand.NewSource(42))
+	names := []string{"US", "DE", "empty", "threats"}
+	sets := make([]*IPSet, len(names))
+	path := filepath.Join(t.TempDir(), "sets.bundle")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewBundleWriter(f)
+	for i, name := range names {
+		sets[i] = &IPSet{}
+		if name != "empty" {
+			for j := 0; j < 300; j++ {
+				randomUpdate(rs, sets[i])
+			}
+		}
+		if err := w.Add(name, sets[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Add("US", sets[0]); err != ErrDuplicateName {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := OpenBundle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if runtime.GOOS == "linux" && nativeByteOrder == binary.LittleEndian && b.data == nil {
+		t.Fatal("the bundle is not memory-mapped")
+	}
+	if n := b.Names(); len(n) != len(names) || n[1] != "DE" {
+		t.Fatal(n)
+	}
+	for i, name := range names {
+		s, err := b.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameSet(t, s, sets[i])
+
+		r, err := b.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range prefixList(sets[i]) {
+			if ok, err := r.Contains(p.Addr()); !ok || err != nil {
+				t.Fatal(p, err)
+			}
+		}
+	}
+	if _, err := b.Get("FR"); err != ErrSetNotFound {
+		t.Fatal(err)
+	}
+
+	// A set using the mapped memory can be modified
+	s, err := b.Get("threats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := sets[3].Clone()
+	for i := 0; i < 300; i++ {
+		randomUpdate(rs, s, ref)
+	}
+	assertSameSet(t, s, ref)
+	s1, err := b.Get("threats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, s1, sets[3])
+	var buf bytes.Buffer
+	if err := s.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1, err := NewBundle(bytes.NewReader(d), int64(len(d)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = b1.Get("DE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, s, sets[1])
+}
+
+func TestBundleInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewBundleWriter(&buf)
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	if err := w.Add("a", &s); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d := buf.Bytes()
+	if _, err := NewBundle(bytes.NewReader(d), int64(len(d))); err != nil {
+		t.Fatal(err)
+	}
+	for _, pos := range []int{0, 4, len(d) - 12, len(d) - 1} {
+		d1 := append([]byte(nil), d...)
+		d1[pos]++
+		if _, err := NewBundle(bytes.NewReader(d1), int64(len(d1))); err != ErrInvalidFormat {
+			t.Fatal(pos, err)
+		}
+	}
+	if _, err := NewBundle(bytes.NewReader(d[:10]), 10); err != ErrInvalidFormat {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	if err := NewBundleWriter(&buf).Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBundle(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Names()) != 0 {
+		t.Fatal(b.Names())
+	}
+}
@@ -0,0 +1,130 @@
+package ipset
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// normalizeNode copies the subtree at the position in another tree so that no node has two present or two absent
+// children, i.e. the shape of the copy only depends on the addresses it contains.
+func (s *ipsetBase) normalizeNode(src *ipsetBase, r nodeRef) uint32 {
+	if r.isLeaf() {
+		return r.ptr
+	}
+	left, right := src.children(r)
+	l := s.normalizeNode(src, left)
+	return s.joinNodes(l, s.normalizeNode(src, right))
+}
+
+// canonicalNode copies the normalized subtree in pre-order, packing each chain of single-child nodes into skip
+// nodes starting from the top, the same way add does. A remaining single bit is stored in a regular node.
+func (s *ipsetBase) canonicalNode(n *[]uint32, r nodeRef) uint32 {
+	if r.isLeaf() {
+		return r.ptr
+	}
+	idx := uint32(len(*n))
+	*n = append(*n, 0, 0)
+	left, right := s.children(r)
+	if left.ptr != ptrAbsent && right.ptr != ptrAbsent {
+		l := s.canonicalNode(n, left)
+		(*n)[idx], (*n)[idx+1] = l, s.canonicalNode(n, right)
+		return idxToPtr(idx)
+	}
+	var prefix, prefixLen uint32
+	for {
+		if right.ptr != ptrAbsent {
+			prefix |= 1 << (31 - prefixLen)
+			r = right
+		} else {
+			r = left
+		}
+		prefixLen++
+		if prefixLen == maxPackablePrefixLen || r.isLeaf() {
+			break
+		}
+		left, right = s.children(r)
+		if left.ptr != ptrAbsent && right.ptr != ptrAbsent {
+			break
+		}
+	}
+	child := s.canonicalNode(n, r)
+	if prefixLen == 1 {
+		(*n)[idx+prefix>>31] = child
+		return idxToPtr(idx)
+	}
+	(*n)[idx], (*n)[idx+1] = packPrefixLen(prefix, prefixLen), child
+	return idxToPtr(idx) | skipNodeMask
+}
+
+// canonicalNodes returns a compact copy of the node array which only depends on the addresses in the set and not on
+// the history of modifications. An empty set has no nodes.
+func (s *ipsetBase) canonicalNodes() []uint32 {
+	if s.isEmpty() {
+		return nil
+	}
+	var t ipsetBase
+	t.nodes = make([]uint32, 2, len(s.nodes))
+	root := t.normalizeNode(s, s.rootRef())
+	if root == ptrAbsent {
+		return nil
+	}
+	t.nodes[1] = root
+	n := make([]uint32, 2, len(t.nodes))
+	n[1] = t.canonicalNode(&n, nodeRef{ptr: root})
+	n[0] = uint32(len(n)) * 4
+	return n
+}
+
+// canonical returns a copy of the set in the canonical form (see canonicalNodes).
+func (s *ipsetBase) canonical() *ipsetBase {
+	var t ipsetBase
+	t.loadNodes(s.canonicalNodes())
+	return &t
+}
+
+func hashNodes(h interface{ Write([]byte) (int, error) }, nodes []uint32) {
+	var buf [4096]byte
+	if len(nodes) == 0 {
+		h.Write(buf[:4])
+		return
+	}
+	for len(nodes) > 0 {
+		i := 0
+		for ; i < len(nodes) && i < len(buf)/4; i++ {
+			binary.LittleEndian.PutUint32(buf[i*4:], nodes[i])
+		}
+		h.Write(buf[:i*4])
+		nodes = nodes[i:]
+	}
+}
+
+// Fingerprint returns the SHA-256 hash of the canonical form of the set, i.e. of the trees written by Serialize,
+// not including the metadata. Sets containing the same addresses have the same fingerprint regardless of how they
+// were built.
+func (s *IPSet) Fingerprint() [32]byte {
+	h := sha256.New()
+	hashNodes(h, s.s4.canonicalNodes())
+	hashNodes(h, s.s6.canonicalNodes())
+	var res [32]byte
+	h.Sum(res[:0])
+	return res
+}
+
+func equalNodes(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal returns true if both sets contain the same addresses. The maximum prefix lengths and the sources recorded
+// by AddWithSource are not compared.
+func (s *IPSet) Equal(other *IPSet) bool {
+	return equalNodes(s.s4.canonicalNodes(), other.s4.canonicalNodes()) &&
+		equalNodes(s.s6.canonicalNodes(), other.s6.canonicalNodes())
+}
@@ -0,0 +1,144 @@
+package ipset
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+func TestCanonicalSerialize(t *testing.T) {
+	rs := rand.New(rand.NewSource(42))
+	for i := 0; i < 100; i++ {
+		var s IPSet
+		for j := rs.Intn(300); j > 0; j-- {
+			randomUpdate(rs, &s)
+		}
+		list := prefixList(&s)
+
+		// The same addresses added in a different order and split into smaller prefixes
+		var s1 IPSet
+		s1.Add(netip.MustParsePrefix("10.0.0.0/16"))
+		s1.Add(netip.MustParsePrefix("2001:db8::/32"))
+		for _, j := range rs.Perm(len(list)) {
+			p := list[j]
+			if p.Bits() < p.Addr().BitLen() && rs.Intn(2) == 0 {
+				p1 := netip.PrefixFrom(p.Addr(), p.Bits()+1)
+				s1.Add(p1)
+				s1.Add(netip.PrefixFrom(lastAddr(p), p.Bits()+1).Masked())
+			} else {
+				s1.Add(p)
+			}
+		}
+		for _, p := range []string{"10.0.0.0/16", "2001:db8::/32"} {
+			s1.Remove(netip.MustParsePrefix(p))
+		}
+		for _, p := range list {
+			s1.Add(p)
+		}
+		if len(list) > 0 {
+			// Remove a prefix and add it back
+			p := list[rs.Intn(len(list))]
+			s1.Remove(p)
+			s1.Add(p)
+		}
+
+		if !s.Equal(&s1) || s.Fingerprint() != s1.Fingerprint() {
+			t.Fatal(i)
+		}
+		var b, b1 bytes.Buffer
+		if err := s.Serialize(&b); err != nil {
+			t.Fatal(err)
+		}
+		if err := s1.Serialize(&b1); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), b1.Bytes()) {
+			t.Fatal(i)
+		}
+		if s.Fingerprint() != sha256.Sum256(b.Bytes()) {
+			t.Fatal(i)
+		}
+
+		s1.Add(randomPrefix(rs))
+		if s1.Equal(&s) != (s1.Fingerprint() == s.Fingerprint()) {
+			t.Fatal(i)
+		}
+	}
+}
+
+func TestCanonicalSerializeMerged(t *testing.T) {
+	// Two halves and a whole prefix, including the prefixes longer than a skip node
+	var s, s1 IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/31"))
+	s.Add(netip.MustParsePrefix("2001:db8::1:0/112"))
+	s1.Add(netip.MustParsePrefix("10.0.0.1/32"))
+	s1.Add(netip.MustParsePrefix("10.0.0.0/32"))
+	s1.Add(netip.MustParsePrefix("2001:db8::1:8000/113"))
+	s1.Add(netip.MustParsePrefix("2001:db8::1:0/113"))
+	if !s.Equal(&s1) || s.Fingerprint() != s1.Fingerprint() {
+		t.Fatal()
+	}
+
+	var empty, removed IPSet
+	removed.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	removed.Remove(netip.MustParsePrefix("10.0.0.0/8"))
+	if !empty.Equal(&removed) || empty.Fingerprint() != removed.Fingerprint() {
+		t.Fatal()
+	}
+	var b bytes.Buffer
+	if err := removed.Serialize(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), make([]byte, 8)) {
+		t.Fatal(b.Bytes())
+	}
+	if empty.Equal(&s) {
+		t.Fatal()
+	}
+}
+
+func TestSerializeDoesNotModify(t *testing.T) {
+	rs := rand.New(rand.NewSource(7))
+	var s IPSet
+	for i := 0; i < 300; i++ {
+		randomUpdate(rs, &s)
+	}
+	nodes := append([]uint32(nil), s.s4.nodes...)
+	freeList := len(s.s4.freeList)
+	var b bytes.Buffer
+	if err := s.Serialize(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SerializeCompressed(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !equalNodes(nodes, s.s4.nodes) || len(s.s4.freeList) != freeList {
+		t.Fatal("the set is modified")
+	}
+}
+
+func TestSerializeConcurrentRead(t *testing.T) {
+	var s RCUIPSet
+	rs := rand.New(rand.NewSource(8))
+	for i := 0; i < 100; i++ {
+		s.Add(randomPrefix(rs))
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.Contains(netip.MustParseAddr("10.0.0.1"))
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		s.Read(func(set *IPSet) {
+			var b bytes.Buffer
+			if err := set.Serialize(&b); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	<-done
+}
@@ -0,0 +1,147 @@
+package ipset
+
+import (
+	"math/bits"
+)
+
+// unsharePath copies the nodes along the path to the prefix that may be shared with snapshots, so that add
+// and remove could modify them in place. If the path ends within a skip node, the skip node's child is copied
+// as well because splitting the skip node may modify it.
+func (s *ipsetBase) unsharePath(p ipPrefix, prefixLen uint32) {
+	if s.frozen == 0 {
+		return
+	}
+	slot := s.rootSlot()
+	if slot < s.frozen {
+		idx := s.allocateNode(s.nodes[slot], ptrAbsent)
+		if slot != 1 {
+			// The root slot is the first element of a node allocated by a previous call
+			s.release(slot)
+		}
+		s.root = idx
+		slot = idx
+	}
+	for {
+		ptr := s.unshareNode(slot)
+		if ptr <= ptrPresent {
+			return
+		}
+		idx := ptrToIdx(ptr)
+		if !isSkipNode(ptr) {
+			if prefixLen == 0 {
+				return
+			}
+			slot = idx + p.hi32()>>31
+			p.shl(1)
+			prefixLen--
+			continue
+		}
+		prefix, l := unpackPrefixLen(s.nodes[idx])
+		if l > prefixLen || bits.LeadingZeros32(p.hi32()^prefix) < int(l) {
+			s.unshareNode(idx + 1)
+			return
+		}
+		p.shl(l)
+		prefixLen -= l
+		slot = idx + 1
+	}
+}
+
+// unshareNode copies the node referenced from the slot if it may be shared and returns the new pointer.
+func (s *ipsetBase) unshareNode(slot uint32) uint32 {
+	ptr := s.nodes[slot]
+	if ptr <= ptrPresent || ptrToIdx(ptr) >= s.frozen {
+		return ptr
+	}
+	idx := ptrToIdx(ptr)
+	newPtr := idxToPtr(s.allocateNode(s.nodes[idx], s.nodes[idx+1])) | ptr&skipNodeMask
+	s.nodes[slot] = newPtr
+	s.release(idx)
+	return newPtr
+}
+
+func (s *ipsetBase) clone() (c ipsetBase) {
+	if len(s.nodes) < 2 {
+		return
+	}
+	n := make([]uint32, 2, len(s.nodes)-len(s.freeList)*2)
+	n[1] = s.compactNode(&n, s.nodes[s.rootSlot()])
+	c.nodes = n
+	return
+}
+
+// snapshot returns a copy that shares the node storage. The capacity of the copy's slice is limited, so that
+// appending to it does not affect the original, and all existing nodes become frozen in both copies. The free list
+// stays with the original, its nodes are unreachable from either tree.
+func (s *ipsetBase) snapshot() (c ipsetBase) {
+	if len(s.nodes) == 0 {
+		return
+	}
+	l := len(s.nodes)
+	s.frozen = uint32(l)
+	c.nodes = s.nodes[:l:l]
+	c.root = s.root
+	c.frozen = uint32(l)
+	return
+}
+
+// Clone returns a deep copy of the set. Unlike with Snapshot, the copy does not share anything with the original.
+func (s *IPSet4) Clone() *IPSet4 {
+	return &IPSet4{
+		ipsetBase:    s.clone(),
+		maxPrefixLen: s.maxPrefixLen,
+	}
+}
+
+// Snapshot returns a copy of the set that shares the node storage with it, which takes constant time.
+// Subsequent modifications of either set copy the modified paths of the tree rather than the whole tree. The
+// nodes replaced this way are not reused until the set is compacted (see Compact).
+// Neither set may be modified concurrently with the other one being accessed, however multiple snapshots of
+// a set that is not being modified can be safely used concurrently.
+func (s *IPSet4) Snapshot() *IPSet4 {
+	return &IPSet4{
+		ipsetBase:    s.snapshot(),
+		maxPrefixLen: s.maxPrefixLen,
+	}
+}
+
+// Clone returns a deep copy of the set.
+// See IPSet4.Clone for more details.
+func (s *IPSet6) Clone() *IPSet6 {
+	return &IPSet6{
+		ipsetBase:    s.clone(),
+		maxPrefixLen: s.maxPrefixLen,
+	}
+}
+
+// Snapshot returns a copy of the set that shares the node storage with it.
+// See IPSet4.Snapshot for more details.
+func (s *IPSet6) Snapshot() *IPSet6 {
+	return &IPSet6{
+		ipsetBase:    s.snapshot(),
+		maxPrefixLen: s.maxPrefixLen,
+	}
+}
+
+// Clone returns a deep copy of the set. Note that copying the IPSet struct does not work because the copies
+// share the underlying storage and modifying one of them corrupts the other.
+func (s *IPSet) Clone() *IPSet {
+	return &IPSet{
+		s4:       *s.s4.Clone(),
+		s6:       *s.s6.Clone(),
+		sources:  s.sources.share(),
+		metadata: s.metadata,
+	}
+}
+
+// Snapshot returns a copy of the set that shares the node storage with it, so that taking a snapshot is cheap
+// regardless of the size of the set. The sources recorded by AddWithSource are shared copy-on-write.
+// See IPSet4.Snapshot for more details.
+func (s *IPSet) Snapshot() *IPSet {
+	return &IPSet{
+		s4:       *s.s4.Snapshot(),
+		s6:       *s.s6.Snapshot(),
+		sources:  s.sources.share(),
+		metadata: s.metadata,
+	}
+}
@@ -0,0 +1,136 @@
+package ipset
+
+import (
+	"bytes"
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+func prefixList(s *IPSet) (list []netip.Prefix) {
+	s.Iterate(func(p netip.Prefix) bool {
+		list = append(list, p)
+		return true
+	})
+	return
+}
+
+func assertSameSet(t *testing.T, a, b *IPSet) {
+	t.Helper()
+	la, lb := prefixList(a), prefixList(b)
+	if len(la) != len(lb) {
+		t.Fatal(len(la), len(lb))
+	}
+	for i := range la {
+		if la[i] != lb[i] {
+			t.Fatal(i, la[i], lb[i])
+		}
+	}
+}
+
+func randomPrefix(rs *rand.Rand) netip.Prefix {
+	if rs.Intn(2) == 0 {
+		return netip.PrefixFrom(addrFrom4(0x0A00_0000|rs.Uint32()&0xFFFF), 16+rs.Intn(17)).Masked()
+	}
+	var a [16]byte
+	a[0], a[1], a[2], a[3] = 0x20, 0x01, 0x0d, 0xb8
+	rs.Read(a[4:6])
+	return netip.PrefixFrom(netip.AddrFrom16(a), 32+rs.Intn(97)).Masked()
+}
+
+func randomUpdate(rs *rand.Rand, sets ...*IPSet) {
+	p := randomPrefix(rs)
+	remove := rs.Intn(3) == 0
+	for _, s := range sets {
+		if remove {
+			s.Remove(p)
+		} else {
+			s.Add(p)
+		}
+	}
+}
+
+func TestIPSet_Clone(t *testing.T) {
+	rs := rand.New(rand.NewSource(12345678901234567))
+	var s IPSet
+	for i := 0; i < 500; i++ {
+		randomUpdate(rs, &s)
+	}
+	c := s.Clone()
+	assertSameSet(t, &s, c)
+	ref := s.Clone()
+	for i := 0; i < 500; i++ {
+		randomUpdate(rs, c)
+	}
+	assertSameSet(t, &s, ref)
+
+	var empty IPSet
+	c = empty.Clone()
+	c.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	if !isEmpty(&empty) {
+		t.Fatal()
+	}
+}
+
+func TestIPSet_Snapshot(t *testing.T) {
+	rs := rand.New(rand.NewSource(12345678901234567))
+	var s IPSet
+	for i := 0; i < 500; i++ {
+		randomUpdate(rs, &s)
+	}
+
+	type pair struct {
+		set, ref *IPSet
+	}
+	sets := []pair{{&s, s.Clone()}}
+	for gen := 0; gen < 20; gen++ {
+		// Take a snapshot of a random set and keep modifying all of them
+		src := sets[rs.Intn(len(sets))]
+		sets = append(sets, pair{src.set.Snapshot(), src.ref.Clone()})
+		for i := 0; i < 50; i++ {
+			p := sets[rs.Intn(len(sets))]
+			randomUpdate(rs, p.set, p.ref)
+		}
+		for _, p := range sets {
+			assertSameSet(t, p.set, p.ref)
+		}
+	}
+
+	for _, p := range sets {
+		var buf bytes.Buffer
+		if err := p.set.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var s1 IPSet
+		if err := s1.Deserialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		assertSameSet(t, &s1, p.ref)
+	}
+}
+
+func TestIPSet_SnapshotCopiesPath(t *testing.T) {
+	var s IPSet
+	for i := uint32(0); i < 1000; i++ {
+		s.Add(netip.PrefixFrom(addrFrom4(0x0A00_0000+i*4), 31))
+	}
+	before := len(s.s4.nodes)
+	snap := s.Snapshot()
+	s.Add(netip.MustParsePrefix("10.0.0.2/32"))
+	if !s.Contains(netip.MustParseAddr("10.0.0.2")) || snap.Contains(netip.MustParseAddr("10.0.0.2")) {
+		t.Fatal()
+	}
+	// Only the path has been copied
+	if grown := len(s.s4.nodes) - before; grown > 2*40 {
+		t.Fatal(grown)
+	}
+	snap.Remove(netip.MustParsePrefix("10.0.0.0/24"))
+	if !s.Contains(netip.MustParseAddr("10.0.0.1")) || snap.Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal()
+	}
+
+	s.Coarsen(16, 64)
+	if !s.Contains(netip.MustParseAddr("10.0.200.0")) || snap.Contains(netip.MustParseAddr("10.0.200.0")) {
+		t.Fatal()
+	}
+}
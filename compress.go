@@ -0,0 +1,237 @@
+package ipset
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	tagAbsent = iota
+	tagPresent
+	tagRegular
+	tagSkip
+)
+
+type bitWriter struct {
+	buf []byte
+	acc uint64
+	n   uint
+}
+
+func (w *bitWriter) write(v uint32, n uint) {
+	w.acc = w.acc<<n | uint64(v)&(1<<n-1)
+	w.n += n
+	for w.n >= 8 {
+		w.n -= 8
+		w.buf = append(w.buf, byte(w.acc>>w.n))
+	}
+}
+
+func (w *bitWriter) flush() {
+	if w.n > 0 {
+		w.buf = append(w.buf, byte(w.acc<<(8-w.n)))
+		w.n = 0
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos int
+	acc uint64
+	n   uint
+}
+
+func (r *bitReader) read(n uint) (uint32, bool) {
+	for r.n < n {
+		if r.pos >= len(r.buf) {
+			return 0, false
+		}
+		r.acc = r.acc<<8 | uint64(r.buf[r.pos])
+		r.pos++
+		r.n += 8
+	}
+	r.n -= n
+	return uint32(r.acc>>r.n) & (1<<n - 1), true
+}
+
+// encodeNode writes the subtree in pre-order: a 2-bit tag for each node, followed by the length (5 bits) and the
+// prefix of a skip node. It returns the number of nodes written.
+func (s *ipsetBase) encodeNode(w *bitWriter, ptr uint32) uint64 {
+	switch ptr {
+	case ptrAbsent:
+		w.write(tagAbsent, 2)
+		return 0
+	case ptrPresent:
+		w.write(tagPresent, 2)
+		return 0
+	}
+	idx := ptrToIdx(ptr)
+	if !isSkipNode(ptr) {
+		w.write(tagRegular, 2)
+		n := s.encodeNode(w, s.nodes[idx])
+		return n + s.encodeNode(w, s.nodes[idx+1]) + 1
+	}
+	prefix, prefixLen := unpackPrefixLen(s.nodes[idx])
+	w.write(tagSkip, 2)
+	w.write(prefixLen, 5)
+	w.write(prefix>>(32-prefixLen), uint(prefixLen))
+	return s.encodeNode(w, s.nodes[idx+1]) + 1
+}
+
+// writeCompressed writes the number of nodes and the length of the encoded tree as unsigned varints, followed by
+// the tree encoded by encodeNode.
+func (s *ipsetBase) writeCompressed(w *bufio.Writer) error {
+	var bw bitWriter
+	var count uint64
+	root := s.rootRef().ptr
+	if root != ptrAbsent {
+		count = s.encodeNode(&bw, root)
+		bw.flush()
+	}
+	var buf [binary.MaxVarintLen64]byte
+	if _, err := w.Write(buf[:binary.PutUvarint(buf[:], count)]); err != nil {
+		return err
+	}
+	if _, err := w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(bw.buf)))]); err != nil {
+		return err
+	}
+	_, err := w.Write(bw.buf)
+	return err
+}
+
+type treeDecoder struct {
+	r     bitReader
+	nodes []uint32
+	bits  uint32
+	err   error
+}
+
+// decodeNode decodes a subtree into the node array in the same order as compactNode would place it.
+func (d *treeDecoder) decodeNode(depth uint32) uint32 {
+	tag, ok := d.r.read(2)
+	if !ok {
+		d.err = io.ErrUnexpectedEOF
+		return ptrAbsent
+	}
+	switch tag {
+	case tagAbsent:
+		return ptrAbsent
+	case tagPresent:
+		return ptrPresent
+	}
+	if len(d.nodes) == cap(d.nodes) {
+		d.err = ErrInvalidFormat
+		return ptrAbsent
+	}
+	idx := uint32(len(d.nodes))
+	d.nodes = append(d.nodes, 0, 0)
+	if tag == tagRegular {
+		if depth >= d.bits {
+			d.err = ErrInvalidFormat
+			return ptrAbsent
+		}
+		left := d.decodeNode(depth + 1)
+		right := d.decodeNode(depth + 1)
+		d.nodes[idx], d.nodes[idx+1] = left, right
+		return idxToPtr(idx)
+	}
+	prefixLen, ok := d.r.read(5)
+	prefix, ok1 := d.r.read(uint(prefixLen))
+	if !ok || !ok1 {
+		d.err = io.ErrUnexpectedEOF
+		return ptrAbsent
+	}
+	if prefixLen == 0 || depth+prefixLen > d.bits {
+		d.err = ErrInvalidFormat
+		return ptrAbsent
+	}
+	d.nodes[idx] = packPrefixLen(prefix<<(32-prefixLen), prefixLen)
+	d.nodes[idx+1] = d.decodeNode(depth + prefixLen)
+	return idxToPtr(idx) | skipNodeMask
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readCompressed(r byteReader, bits uint32) ([]uint32, error) {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// Each node takes at least 2 bits, this prevents huge allocations caused by a malformed header.
+	if count > size*4 || count >= 1<<30 {
+		return nil, ErrInvalidFormat
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	b, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(b)) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	d := treeDecoder{
+		r:     bitReader{buf: b},
+		nodes: make([]uint32, 2, count*2+2),
+		bits:  bits,
+	}
+	root := d.decodeNode(0)
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.nodes) != cap(d.nodes) || d.r.pos != len(b) || d.r.n >= 8 {
+		return nil, ErrInvalidFormat
+	}
+	d.nodes[0] = uint32(len(d.nodes)) * 4
+	d.nodes[1] = root
+	return d.nodes, nil
+}
+
+// SerializeCompressed writes the set in a compact format suitable for distribution, which is typically several
+// times smaller than the one written by Serialize. Each of the IPv4 and IPv6 trees is written as the number of its
+// nodes and the length of the encoding (both as unsigned varints), followed by a bitstream with the nodes in
+// pre-order: a 2-bit node type for each node, with the length (5 bits) and the bits of the prefix following
+// the type of a skip node. Like Serialize, it writes the canonical form of the set.
+func (s *IPSet) SerializeCompressed(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if err := s.s4.canonical().writeCompressed(bw); err != nil {
+		return err
+	}
+	if err := s.s6.canonical().writeCompressed(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// DeserializeCompressed reads a set written by SerializeCompressed, replacing the contents of the set. The trees
+// are decoded directly into the node arrays. If an error is returned, the set is left unchanged.
+//
+// If r does not implement io.ByteReader, it is buffered, so more data than the set may be consumed from it.
+func (s *IPSet) DeserializeCompressed(r io.Reader) error {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	nodes4, err := readCompressed(br, 32)
+	if err != nil {
+		return err
+	}
+	nodes6, err := readCompressed(br, 128)
+	if err != nil {
+		return err
+	}
+	s.sources = sourceTrie{}
+	s.metadata = nil
+	s.s4.loadNodes(nodes4)
+	s.s6.loadNodes(nodes6)
+	return nil
+}
@@ -0,0 +1,184 @@
+package ipset
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/netip"
+	"os"
+	"testing"
+)
+
+func TestSerializeCompressed(t *testing.T) {
+	rs := rand.New(rand.NewSource(42))
+	for i := 0; i < 100; i++ {
+		var s IPSet
+		for j := rs.Intn(200); j > 0; j-- {
+			randomUpdate(rs, &s)
+		}
+		if i == 1 {
+			s.Add(netip.MustParsePrefix("0.0.0.0/0"))
+		}
+		var buf bytes.Buffer
+		if err := s.SerializeCompressed(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var s1 IPSet
+		s1.Add(netip.MustParsePrefix("1.2.3.0/24"))
+		if err := s1.DeserializeCompressed(&buf); err != nil {
+			t.Fatal(err)
+		}
+		assertSameSet(t, &s, &s1)
+
+		// The decoded nodes are in the canonical form
+		for _, pair := range [][2]*ipsetBase{{&s.s4.ipsetBase, &s1.s4.ipsetBase}, {&s.s6.ipsetBase, &s1.s6.ipsetBase}} {
+			if n, n1 := pair[0].canonicalNodes(), pair[1].nodes; !equalNodes(n, n1) {
+				t.Fatal(i, len(n), len(n1))
+			}
+		}
+	}
+}
+
+func TestSerializeCompressedFile(t *testing.T) {
+	d, err := os.ReadFile("testdata/ipset.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s IPSet
+	if err := s.Deserialize(bytes.NewReader(d)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.SerializeCompressed(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= len(d) {
+		t.Fatal(buf.Len(), len(d))
+	}
+	var s1 IPSet
+	if err := s1.DeserializeCompressed(&buf); err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, &s, &s1)
+}
+
+func TestDeserializeCompressedInvalid(t *testing.T) {
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	s.Add(netip.MustParsePrefix("192.168.0.0/16"))
+	s.Add(netip.MustParsePrefix("2001:db8::/32"))
+	var buf bytes.Buffer
+	if err := s.SerializeCompressed(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	var s1 IPSet
+	s1.Add(netip.MustParsePrefix("1.2.3.0/24"))
+	for l := 0; l < len(b); l++ {
+		if err := s1.DeserializeCompressed(bytes.NewReader(b[:l])); err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Fatal(l, err)
+		}
+	}
+	b1 := append([]byte(nil), b...)
+	b1[0]++ // node count
+	if err := s1.DeserializeCompressed(bytes.NewReader(b1)); err != ErrInvalidFormat {
+		t.Fatal(err)
+	}
+	b1 = append([]byte(nil), b...)
+	b1[2] = 0xFF // a chain of regular nodes
+	if err := s1.DeserializeCompressed(bytes.NewReader(b1)); err != ErrInvalidFormat {
+		t.Fatal(err)
+	}
+	if prefixes := prefixList(&s1); len(prefixes) != 1 {
+		t.Fatal(prefixes)
+	}
+}
+
+func TestDeserializeCompressedConsecutive(t *testing.T) {
+	rs := rand.New(rand.NewSource(5))
+	var s, s1 IPSet
+	for i := 0; i < 100; i++ {
+		randomUpdate(rs, &s, &s1)
+	}
+	s1.Add(netip.MustParsePrefix("192.0.2.0/24"))
+	var buf bytes.Buffer
+	if err := s.SerializeCompressed(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.SerializeCompressed(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(buf.Bytes())
+	var d IPSet
+	d.SetMetadata(&Metadata{Name: "stale"})
+	if err := d.DeserializeCompressed(r); err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, &s, &d)
+	if d.Metadata() != nil {
+		t.Fatal(d.Metadata())
+	}
+	if err := d.DeserializeCompressed(r); err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, &s1, &d)
+	if r.Len() != 0 {
+		t.Fatal(r.Len())
+	}
+}
+
+func BenchmarkSerializeCompressed(b *testing.B) {
+	rs := rand.New(rand.NewSource(1))
+	var s IPSet
+	for i := 0; i < 100000; i++ {
+		s.Add(netip.PrefixFrom(addrFrom4(rs.Uint32()), 8+rs.Intn(25)).Masked())
+	}
+	for i := 0; i < 10000; i++ {
+		var a [16]byte
+		rs.Read(a[:])
+		a[0] = 0x20
+		s.Add(netip.PrefixFrom(netip.AddrFrom16(a), 16+rs.Intn(49)).Masked())
+	}
+	d, err := os.ReadFile("testdata/ipset.bin")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var file IPSet
+	if err := file.Deserialize(bytes.NewReader(d)); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name string
+		set  *IPSet
+	}{{"ipset.bin", &file}, {"random", &s}} {
+		var raw bytes.Buffer
+		if err := bc.set.Serialize(&raw); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(bc.name, func(b *testing.B) {
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := bc.set.SerializeCompressed(&buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(raw.Len()), "raw-bytes")
+			b.ReportMetric(float64(buf.Len()), "compressed-bytes")
+		})
+		b.Run(bc.name+"/decode", func(b *testing.B) {
+			var buf bytes.Buffer
+			if err := bc.set.SerializeCompressed(&buf); err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < b.N; i++ {
+				var s1 IPSet
+				if err := s1.DeserializeCompressed(bytes.NewReader(buf.Bytes())); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
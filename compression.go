@@ -0,0 +1,180 @@
+package ipset
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+// Compression selects the compression method used by SerializeTo and WriteCompressedTextTo.
+type Compression int
+
+const (
+	NoCompression Compression = iota
+	Gzip
+	Zlib
+)
+
+// zlibProbeSize is the number of bytes that are decompressed to confirm that the data is zlib-compressed, as
+// unlike the gzip magic, a valid zlib header may also appear at the beginning of uncompressed data.
+const zlibProbeSize = 512
+
+func isZlibHeader(b []byte) bool {
+	return b[0]&0x0F == 8 && b[0]>>4 <= 7 && b[1]&0x20 == 0 && (uint(b[0])<<8|uint(b[1]))%31 == 0
+}
+
+// isZlib returns true if b is the beginning of a zlib stream or, if complete is true, the whole stream.
+func isZlib(b []byte, complete bool) bool {
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return false
+	}
+	_, err = io.Copy(io.Discard, zr)
+	return err == nil || !complete && err == io.ErrUnexpectedEOF
+}
+
+type peeker interface {
+	Peek(n int) ([]byte, error)
+}
+
+// decompress returns a reader that decompresses the data if it is gzip or zlib compressed. Otherwise the returned
+// reader reads the data as is, and no more than the data read from it is consumed from r.
+// Confirming zlib compression requires reading ahead, so it is only detected if r can be peeked (like
+// *bufio.Reader) or implements io.Seeker, in which case r is moved back after the check.
+func decompress(r io.Reader) (io.Reader, error) {
+	if p, ok := r.(peeker); ok {
+		b, _ := p.Peek(zlibProbeSize)
+		switch {
+		case len(b) < 2:
+		case b[0] == 0x1f && b[1] == 0x8b:
+			return gzip.NewReader(r)
+		case isZlibHeader(b) && isZlib(b, len(b) < zlibProbeSize):
+			return zlib.NewReader(r)
+		}
+		return r, nil
+	}
+	var hdr [2]byte
+	n, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return io.MultiReader(bytes.NewReader(hdr[:n]), r), nil
+	}
+	mr := io.MultiReader(bytes.NewReader(hdr[:]), r)
+	switch {
+	case hdr[0] == 0x1f && hdr[1] == 0x8b:
+		return gzip.NewReader(mr)
+	case isZlibHeader(hdr[:]):
+		seeker, ok := r.(io.Seeker)
+		if !ok {
+			break
+		}
+		b := make([]byte, zlibProbeSize)
+		copy(b, hdr[:])
+		n, _ := io.ReadFull(r, b[2:])
+		b = b[:2+n]
+		if _, err := seeker.Seek(int64(-n), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		if isZlib(b, len(b) < zlibProbeSize) {
+			return zlib.NewReader(mr)
+		}
+	}
+	return mr, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func compressWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case NoCompression:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zlib:
+		return zlib.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("unknown compression method %d", c)
+}
+
+// SerializeTo writes the set like Serialize does, compressing it with the specified method. The result can be read
+// by Deserialize, which detects the compression automatically.
+func (s *IPSet) SerializeTo(w io.Writer, c Compression) error {
+	cw, err := compressWriter(w, c)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(cw)
+	if err := s.Serialize(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// WriteCompressedTextTo writes the set like WriteTextTo does, compressing it with the specified method. The output
+// is buffered. It returns the number of bytes before compression.
+func (s *IPSet) WriteCompressedTextTo(w io.Writer, c Compression) (n int64, err error) {
+	cw, err := compressWriter(w, c)
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriter(cw)
+	if n, err = s.WriteTextTo(bw); err != nil {
+		return
+	}
+	if err = bw.Flush(); err != nil {
+		return
+	}
+	err = cw.Close()
+	return
+}
+
+// ReadTextFrom adds the prefixes from the text in the format written by WriteTextTo: one prefix or address per
+// line. Empty lines and comments starting with '#' are ignored. If the data is gzip or zlib compressed, it is
+// decompressed (see Deserialize regarding zlib). It returns the number of bytes of the text read.
+func (s *IPSet) ReadTextFrom(r io.Reader) (n int64, err error) {
+	r, err = decompress(r)
+	if err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		n += int64(len(line)) + 1
+		text := string(line)
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		var prefix netip.Prefix
+		if strings.IndexByte(text, '/') >= 0 {
+			prefix, err = netip.ParsePrefix(text)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(text)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return n, fmt.Errorf("line %d: %w", lineNo, ErrInvalidFormat)
+		}
+		s.Add(prefix)
+	}
+	return n, scanner.Err()
+}
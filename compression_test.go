@@ -0,0 +1,244 @@
+package ipset
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"math/rand"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func randomSet(rs *rand.Rand, n int) *IPSet {
+	var s IPSet
+	for i := 0; i < n; i++ {
+		s.Add(randomPrefix(rs))
+	}
+	return &s
+}
+
+func TestSerializeTo(t *testing.T) {
+	rs := rand.New(rand.NewSource(1))
+	s := randomSet(rs, 1000)
+	s.SetMetadata(&Metadata{Name: "test"})
+	for _, c := range []Compression{NoCompression, Gzip, Zlib} {
+		var buf bytes.Buffer
+		if err := s.SerializeTo(&buf, c); err != nil {
+			t.Fatal(err)
+		}
+		b := buf.Bytes()
+		switch c {
+		case Gzip:
+			if b[0] != 0x1f || b[1] != 0x8b {
+				t.Fatal(b[:2])
+			}
+		case Zlib:
+			if !isZlibHeader(b) {
+				t.Fatal(b[:2])
+			}
+		}
+		var s1 IPSet
+		if err := s1.Deserialize(bytes.NewReader(b)); err != nil {
+			t.Fatal(c, err)
+		}
+		assertSameSet(t, s, &s1)
+		if s1.Metadata() == nil || s1.Metadata().Name != "test" {
+			t.Fatal(s1.Metadata())
+		}
+		if m, err := ReadMetadata(bytes.NewReader(b)); err != nil || m == nil || m.Name != "test" {
+			t.Fatal(c, m, err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := s.SerializeTo(&buf, Compression(100)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestDeserializePlainConsumesExactly(t *testing.T) {
+	rs := rand.New(rand.NewSource(2))
+	s1, s2 := randomSet(rs, 100), randomSet(rs, 100)
+	var buf bytes.Buffer
+	if err := s1.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(buf.Bytes())
+	var d1, d2 IPSet
+	if err := d1.Deserialize(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := d2.Deserialize(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 0 {
+		t.Fatal(r.Len())
+	}
+	assertSameSet(t, s1, &d1)
+	assertSameSet(t, s2, &d2)
+
+	// A set whose size header starts with a valid zlib header, read from a reader that cannot be peeked or seeked
+	var s3 *IPSet
+	for s3 == nil {
+		s := &IPSet{}
+		for size := 0; size < 0x178; {
+			s.Add(netip.PrefixFrom(addrFrom4(rs.Uint32()), 32))
+			size = len(s.s4.canonicalNodes()) * 4
+			if size == 0x178 {
+				s3 = s
+			}
+		}
+	}
+	buf.Reset()
+	if err := s3.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if b := buf.Bytes(); !isZlibHeader(b) {
+		t.Fatal(b[:2])
+	}
+	if err := s2.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []io.Reader{streamReader{bytes.NewReader(buf.Bytes())}, bytes.NewReader(buf.Bytes())} {
+		var d3, d4 IPSet
+		if err := d3.Deserialize(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := d4.Deserialize(r); err != nil {
+			t.Fatal(err)
+		}
+		assertSameSet(t, s3, &d3)
+		assertSameSet(t, s2, &d4)
+	}
+}
+
+func TestDecompressZlibLookalike(t *testing.T) {
+	// A valid zlib header followed by data that does not decompress.
+	rs := rand.New(rand.NewSource(3))
+	b := make([]byte, 1000)
+	rs.Read(b)
+	b[0], b[1], b[2], b[3] = 0x78, 0x01, 0, 0
+	r, err := decompress(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, b) {
+		t.Fatal("data mismatch")
+	}
+
+	// "80" is a valid zlib header apart from the preset dictionary flag.
+	var s IPSet
+	if _, err := s.ReadTextFrom(strings.NewReader("80.0.0.0/8\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Contains(netip.MustParseAddr("80.1.2.3")) {
+		t.Fatal("not found")
+	}
+
+	for _, short := range [][]byte{nil, {0x1f}, {0x78, 0x01}} {
+		r, err := decompress(bytes.NewReader(short))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _ := io.ReadAll(r)
+		if !bytes.Equal(res, short) {
+			t.Fatal(res)
+		}
+	}
+}
+
+func TestWriteCompressedTextTo(t *testing.T) {
+	rs := rand.New(rand.NewSource(4))
+	var s IPSet
+	for i := 0; i < 1000; i++ {
+		s.Add(netip.PrefixFrom(addrFrom4(rs.Uint32()), 32))
+	}
+	var plain bytes.Buffer
+	if _, err := s.WriteTextTo(&plain); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Compression{NoCompression, Gzip, Zlib} {
+		var buf bytes.Buffer
+		n, err := s.WriteCompressedTextTo(&buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(plain.Len()) {
+			t.Fatal(n, plain.Len())
+		}
+		if c != NoCompression && buf.Len() >= plain.Len() {
+			t.Fatal(buf.Len(), plain.Len())
+		}
+		var s1 IPSet
+		n, err = s1.ReadTextFrom(&buf)
+		if err != nil {
+			t.Fatal(c, err)
+		}
+		if n != int64(plain.Len()) {
+			t.Fatal(n, plain.Len())
+		}
+		assertSameSet(t, &s, &s1)
+	}
+}
+
+func TestReadTextFrom(t *testing.T) {
+	var s IPSet
+	_, err := s.ReadTextFrom(strings.NewReader("# comment\n\n10.0.0.0/8\n  192.168.1.1 # host\n2001:db8::/32\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []string{"10.1.2.3", "192.168.1.1", "2001:db8::1"} {
+		if !s.Contains(netip.MustParseAddr(a)) {
+			t.Fatal(a)
+		}
+	}
+	if s.Contains(netip.MustParseAddr("192.168.1.2")) {
+		t.Fatal("unexpected address")
+	}
+
+	_, err = s.ReadTextFrom(strings.NewReader("10.0.0.0/8\nfoo\n"))
+	if !errors.Is(err, ErrInvalidFormat) || !strings.Contains(err.Error(), "line 2") {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0x1f, 0x8b, 0})
+	if _, err := s.ReadTextFrom(&buf); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReadIPSetSaveCompressed(t *testing.T) {
+	var gz, zl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(ipsetSaveOutput))
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write([]byte(ipsetSaveOutput))
+	zw.Close()
+	expected, err := ReadIPSetSave(strings.NewReader(ipsetSaveOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []io.Reader{&gz, &zl} {
+		sets, err := ReadIPSetSave(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sets) != len(expected) {
+			t.Fatal(len(sets))
+		}
+		for name, s := range expected {
+			assertSameSet(t, s, sets[name])
+		}
+	}
+}
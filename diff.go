@@ -0,0 +1,144 @@
+package ipset
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// Diff returns the prefixes that need to be added to and removed from the old set in order to get the new one.
+// It is computed by walking both trees simultaneously, so the cost is proportional to the size of the sets rather
+// than to the number of addresses within them.
+func Diff(old, new *IPSet) (added, removed *IPSet) {
+	added, removed = &IPSet{}, &IPSet{}
+	old.s4.diffNode(&new.s4.ipsetBase, old.s4.rootRef(), new.s4.rootRef(), ipPrefix{}, 0,
+		&added.s4.ipsetBase, &removed.s4.ipsetBase)
+	old.s6.diffNode(&new.s6.ipsetBase, old.s6.rootRef(), new.s6.rootRef(), ipPrefix{}, 0,
+		&added.s6.ipsetBase, &removed.s6.ipsetBase)
+	return
+}
+
+func (s *ipsetBase) diffNode(other *ipsetBase, a, b nodeRef, prefix ipPrefix, depth uint32, added, removed *ipsetBase) {
+	if a.isLeaf() && b.isLeaf() {
+		if a.ptr == ptrPresent && b.ptr == ptrAbsent {
+			removed.add(prefix, depth)
+		} else if a.ptr == ptrAbsent && b.ptr == ptrPresent {
+			added.add(prefix, depth)
+		}
+		return
+	}
+	la, ra := s.children(a)
+	lb, rb := other.children(b)
+	s.diffNode(other, la, lb, prefix, depth+1, added, removed)
+	s.diffNode(other, ra, rb, prefix.withBit(depth), depth+1, added, removed)
+}
+
+// WritePatch writes a patch that contains the specified added and removed prefixes (as returned by Diff) in a
+// compact binary form. The patch consists of four sections: removed IPv4, added IPv4, removed IPv6 and
+// added IPv6 prefixes. Each section starts with the number of prefixes encoded as an unsigned varint, followed by
+// the prefixes, each encoded as a length byte and the significant bytes of the address.
+func WritePatch(w io.Writer, added, removed *IPSet) error {
+	bw := bufio.NewWriter(w)
+	for _, iterate := range []func(IterStepFunc) bool{
+		removed.s4.Iterate, added.s4.Iterate, removed.s6.Iterate, added.s6.Iterate,
+	} {
+		if err := writePatchSection(bw, iterate); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func writePatchSection(w *bufio.Writer, iterate func(IterStepFunc) bool) error {
+	var count uint64
+	iterate(func(netip.Prefix) bool {
+		count++
+		return true
+	})
+	var buf [binary.MaxVarintLen64]byte
+	if _, err := w.Write(buf[:binary.PutUvarint(buf[:], count)]); err != nil {
+		return err
+	}
+	var err error
+	iterate(func(prefix netip.Prefix) bool {
+		bits := prefix.Bits()
+		if err = w.WriteByte(byte(bits)); err != nil {
+			return false
+		}
+		_, err = w.Write(prefix.Addr().AsSlice()[:(bits+7)/8])
+		return err == nil
+	})
+	return err
+}
+
+// ReadPatch reads a patch written by WritePatch. If r does not implement io.ByteReader, it is buffered, so more data
+// than the patch may be consumed from it.
+func ReadPatch(r io.Reader) (added, removed *IPSet, err error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	added, removed = new(IPSet), new(IPSet)
+	for i, set := range []*IPSet{removed, added, removed, added} {
+		addrLen := 4
+		if i >= 2 {
+			addrLen = 16
+		}
+		if err = readPatchSection(br, set, addrLen); err != nil {
+			return nil, nil, err
+		}
+	}
+	return
+}
+
+func readPatchSection(r io.ByteReader, s *IPSet, addrLen int) error {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	for ; count > 0; count-- {
+		bits, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if int(bits) > addrLen*8 {
+			return fmt.Errorf("invalid prefix length %d: %w", bits, ErrInvalidFormat)
+		}
+		var a [16]byte
+		for i := 0; i < (int(bits)+7)/8; i++ {
+			if a[i], err = r.ReadByte(); err != nil {
+				return err
+			}
+		}
+		var addr netip.Addr
+		if addrLen == 4 {
+			addr = netip.AddrFrom4([4]byte{a[0], a[1], a[2], a[3]})
+		} else {
+			addr = netip.AddrFrom16(a)
+		}
+		s.Add(netip.PrefixFrom(addr, int(bits)))
+	}
+	return nil
+}
+
+// ApplyPatch reads a patch written by WritePatch and applies it to the set: first the removed prefixes are removed,
+// then the added ones are added. The patch is read completely before the set is modified, so if an error is
+// returned, the set is left unchanged. Like with ReadPatch, r should implement io.ByteReader if it contains other data
+// after the patch.
+func (s *IPSet) ApplyPatch(r io.Reader) error {
+	added, removed, err := ReadPatch(r)
+	if err != nil {
+		return err
+	}
+	removed.Iterate(func(prefix netip.Prefix) bool {
+		s.Remove(prefix)
+		return true
+	})
+	added.Iterate(func(prefix netip.Prefix) bool {
+		s.Add(prefix)
+		return true
+	})
+	return nil
+}
@@ -0,0 +1,155 @@
+package ipset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+func randomPrefix4(rs *rand.Rand) netip.Prefix {
+	var a [4]byte
+	binary.BigEndian.PutUint32(a[:], rs.Uint32())
+	return netip.PrefixFrom(netip.AddrFrom4(a), 8+rs.Intn(25)).Masked()
+}
+
+func isEmpty(s *IPSet) bool {
+	return s.Iterate(func(netip.Prefix) bool {
+		return false
+	})
+}
+
+func TestDiff(t *testing.T) {
+	rs := rand.New(rand.NewSource(12345678901234567))
+	var old, cur IPSet
+	for i := 0; i < 2000; i++ {
+		p := randomPrefix4(rs)
+		switch rs.Intn(3) {
+		case 0:
+			old.Add(p)
+		case 1:
+			cur.Add(p)
+		default:
+			old.Add(p)
+			cur.Add(p)
+		}
+	}
+	old.Add(netip.MustParsePrefix("2001:db8::/32"))
+	cur.Add(netip.MustParsePrefix("2001:db8::/33"))
+	cur.Add(netip.MustParsePrefix("2001:db9::1/128"))
+
+	added, removed := Diff(&old, &cur)
+
+	for i := 0; i < 100_000; i++ {
+		var a [4]byte
+		binary.BigEndian.PutUint32(a[:], rs.Uint32())
+		addr := netip.AddrFrom4(a)
+		inOld, inCur := old.Contains(addr), cur.Contains(addr)
+		if added.Contains(addr) != (inCur && !inOld) {
+			t.Fatal("added", addr)
+		}
+		if removed.Contains(addr) != (inOld && !inCur) {
+			t.Fatal("removed", addr)
+		}
+	}
+	if !removed.Contains(netip.MustParseAddr("2001:db8:8000::1")) || removed.Contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Fatal()
+	}
+	if !added.Contains(netip.MustParseAddr("2001:db9::1")) {
+		t.Fatal()
+	}
+
+	var patch bytes.Buffer
+	err := WritePatch(&patch, added, removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = old.ApplyPatch(&patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, removed = Diff(&old, &cur)
+	if !isEmpty(added) || !isEmpty(removed) {
+		t.Fatal("sets are different after applying the patch")
+	}
+}
+
+func TestPatchSize(t *testing.T) {
+	rs := rand.New(rand.NewSource(12345678901234567))
+	var old IPSet
+	for i := 0; i < 50_000; i++ {
+		old.Add(randomPrefix4(rs))
+	}
+
+	var b bytes.Buffer
+	err := old.Serialize(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cur IPSet
+	err = cur.Deserialize(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur.Remove(netip.MustParsePrefix("10.0.0.0/8"))
+	cur.Add(netip.MustParsePrefix("192.0.2.1/32"))
+
+	added, removed := Diff(&old, &cur)
+	var patch bytes.Buffer
+	err = WritePatch(&patch, added, removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patch.Len() > 100 {
+		t.Fatal(patch.Len())
+	}
+}
+
+func TestApplyPatchInvalid(t *testing.T) {
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"))
+
+	// One removed IPv4 prefix with an invalid length
+	err := s.ApplyPatch(bytes.NewReader([]byte{1, 33, 10, 0, 0, 0, 0, 0, 0}))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	// Truncated
+	err = s.ApplyPatch(bytes.NewReader([]byte{1, 8}))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !s.Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("the set was modified")
+	}
+}
+
+func TestReadPatchConsecutive(t *testing.T) {
+	var a1, a2, r2 IPSet
+	a1.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	a2.Add(netip.MustParsePrefix("2001:db8::/32"))
+	r2.Add(netip.MustParsePrefix("10.1.0.0/16"))
+	var b bytes.Buffer
+	if err := WritePatch(&b, &a1, &IPSet{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritePatch(&b, &a2, &r2); err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(b.Bytes())
+	added, _, err := ReadPatch(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, &a1, added)
+	added, removed, err := ReadPatch(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, &a2, added)
+	assertSameSet(t, &r2, removed)
+	if r.Len() != 0 {
+		t.Fatal(r.Len())
+	}
+}
@@ -0,0 +1,307 @@
+package ipset
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+var ErrUnsupportedSetType = errors.New("unsupported set type")
+
+// ReadIPSetSave parses the output of 'ipset save' and returns the sets keyed by name.
+// If names are provided, only the sets with these names are returned, otherwise all sets with supported types
+// (hash:ip, hash:net, hash:net,iface and bitmap:ip) are returned, and the sets of other types are skipped.
+// Requesting a set of an unsupported type by name results in ErrUnsupportedSetType, and requesting a set that is not
+// in the input results in ErrSetNotFound.
+//
+// Only the first dimension of an element is used, i.e. for hash:net,iface the interface name is ignored.
+// Entries marked as 'nomatch' are excluded from the less specific entries that contain them.
+// Gzip or zlib compressed input is decompressed.
+func ReadIPSetSave(r io.Reader, names ...string) (map[string]*IPSet, error) {
+	r, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	type entry struct {
+		prefix  netip.Prefix
+		nomatch bool
+	}
+
+	selected := selectedNames(names)
+	entries := make(map[string][]entry)
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		fields := splitFields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			if fields[0] == "create" || fields[0] == "add" {
+				return nil, fmt.Errorf("line %d: %w", lineNo, ErrInvalidFormat)
+			}
+			continue
+		}
+		name := fields[1]
+		if selected != nil && !selected[name] {
+			continue
+		}
+		switch fields[0] {
+		case "create":
+			switch fields[2] {
+			case "hash:ip", "hash:net", "hash:net,iface", "bitmap:ip":
+				entries[name] = nil
+			default:
+				if selected != nil {
+					return nil, fmt.Errorf("line %d: set %q: %w %q", lineNo, name, ErrUnsupportedSetType, fields[2])
+				}
+			}
+		case "add":
+			list, exists := entries[name]
+			if !exists {
+				// Either the set is not defined, or its type is not supported
+				continue
+			}
+			elem := fields[2]
+			if i := strings.IndexByte(elem, ','); i >= 0 {
+				elem = elem[:i]
+			}
+			prefixes, err := parseElement(elem)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			nomatch := false
+			for _, f := range fields[3:] {
+				if f == "nomatch" {
+					nomatch = true
+				}
+			}
+			for _, p := range prefixes {
+				list = append(list, entry{prefix: p, nomatch: nomatch})
+			}
+			entries[name] = list
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if _, exists := entries[name]; !exists {
+			return nil, fmt.Errorf("set %q: %w", name, ErrSetNotFound)
+		}
+	}
+
+	sets := make(map[string]*IPSet, len(entries))
+	for name, list := range entries {
+		// The most specific entry wins, so applying them in the order of increasing prefix length
+		// ensures that nomatch entries punch holes in the less specific ones but not vice versa.
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].prefix.Bits() < list[j].prefix.Bits()
+		})
+		s := new(IPSet)
+		for _, e := range list {
+			if e.nomatch {
+				s.Remove(e.prefix)
+			} else {
+				s.Add(e.prefix)
+			}
+		}
+		sets[name] = s
+	}
+
+	return sets, nil
+}
+
+// ReadNftJSON parses the output of 'nft -j list set' (or 'nft -j list ruleset') and returns the sets of type
+// ipv4_addr and ipv6_addr keyed by name. If names are provided, only the sets with these names are returned,
+// requesting a set of a different type results in ErrUnsupportedSetType, and requesting a set that is not in the
+// input results in ErrSetNotFound. Elements may be plain addresses, prefix, range or elem objects. Gzip or zlib
+// compressed input is decompressed.
+//
+// Sets with the same name in different tables or families cannot be told apart by the name, so they result in
+// ErrDuplicateName unless they are excluded by names. To read such a set, list only its table.
+func ReadNftJSON(r io.Reader, names ...string) (map[string]*IPSet, error) {
+	r, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Nftables []struct {
+			Set *struct {
+				Family string          `json:"family"`
+				Table  string          `json:"table"`
+				Name   string          `json:"name"`
+				Type   json.RawMessage `json:"type"`
+				Elem   []any           `json:"elem"`
+			} `json:"set"`
+		} `json:"nftables"`
+	}
+
+	if err = json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	selected := selectedNames(names)
+	sets := make(map[string]*IPSet)
+	tables := make(map[string]string)
+	for _, obj := range doc.Nftables {
+		set := obj.Set
+		if set == nil || selected != nil && !selected[set.Name] {
+			continue
+		}
+		var typ string
+		if json.Unmarshal(set.Type, &typ) != nil || typ != "ipv4_addr" && typ != "ipv6_addr" {
+			if selected != nil {
+				return nil, fmt.Errorf("set %q: %w %s", set.Name, ErrUnsupportedSetType, set.Type)
+			}
+			continue
+		}
+		table := set.Family + " " + set.Table
+		if t, exists := tables[set.Name]; exists && t != table {
+			return nil, fmt.Errorf("set %q in tables %q and %q: %w", set.Name, t, table, ErrDuplicateName)
+		}
+		tables[set.Name] = table
+		s := sets[set.Name]
+		if s == nil {
+			s = new(IPSet)
+			sets[set.Name] = s
+		}
+		for _, elem := range set.Elem {
+			if err := s.addNftElem(elem); err != nil {
+				return nil, fmt.Errorf("set %q: %w", set.Name, err)
+			}
+		}
+	}
+	for _, name := range names {
+		if sets[name] == nil {
+			return nil, fmt.Errorf("set %q: %w", name, ErrSetNotFound)
+		}
+	}
+
+	return sets, nil
+}
+
+func (s *IPSet) addNftElem(elem any) error {
+	switch e := elem.(type) {
+	case string:
+		prefixes, err := parseElement(e)
+		if err != nil {
+			return err
+		}
+		for _, p := range prefixes {
+			s.Add(p)
+		}
+		return nil
+	case map[string]any:
+		if v, exists := e["elem"]; exists {
+			if m, ok := v.(map[string]any); ok {
+				return s.addNftElem(m["val"])
+			}
+		} else if v, exists := e["prefix"]; exists {
+			if m, ok := v.(map[string]any); ok {
+				addrStr, _ := m["addr"].(string)
+				bits, _ := m["len"].(float64)
+				addr, err := netip.ParseAddr(addrStr)
+				if err != nil {
+					return err
+				}
+				p, err := addr.Prefix(int(bits))
+				if err != nil {
+					return err
+				}
+				s.Add(p)
+				return nil
+			}
+		} else if v, exists := e["range"]; exists {
+			if r, ok := v.([]any); ok && len(r) == 2 {
+				fromStr, _ := r[0].(string)
+				toStr, _ := r[1].(string)
+				from, err := netip.ParseAddr(fromStr)
+				if err != nil {
+					return err
+				}
+				to, err := netip.ParseAddr(toStr)
+				if err != nil {
+					return err
+				}
+				s.AddRange(from, to)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("unexpected element %v: %w", elem, ErrInvalidFormat)
+}
+
+// parseElement parses an address, a prefix or a range in the 'from-to' form.
+func parseElement(elem string) ([]netip.Prefix, error) {
+	if i := strings.IndexByte(elem, '-'); i >= 0 {
+		from, err := netip.ParseAddr(elem[:i])
+		if err != nil {
+			return nil, err
+		}
+		to, err := netip.ParseAddr(elem[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		return rangePrefixes(from, to), nil
+	}
+	if strings.IndexByte(elem, '/') >= 0 {
+		p, err := netip.ParsePrefix(elem)
+		if err != nil {
+			return nil, err
+		}
+		return []netip.Prefix{p}, nil
+	}
+	addr, err := netip.ParseAddr(elem)
+	if err != nil {
+		return nil, err
+	}
+	return []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())}, nil
+}
+
+// splitFields splits the line into whitespace-separated fields. Double-quoted strings (such as comments) are kept
+// as single fields.
+func splitFields(line string) (fields []string) {
+	start := -1
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+			if start < 0 {
+				start = i
+			}
+		case !quoted && (c == ' ' || c == '\t'):
+			if start >= 0 {
+				fields = append(fields, line[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, line[start:])
+	}
+	return
+}
+
+func selectedNames(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	m := make(map[string]bool, len(names))
+	for _, name := range names {
+		m[name] = true
+	}
+	return m
+}
@@ -0,0 +1,169 @@
+package ipset
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+const ipsetSaveOutput = `create blocklist hash:net family inet hashsize 1024 maxelem 65536 comment
+add blocklist 10.0.0.0/8 comment "nomatch in a comment"
+add blocklist 10.1.0.0/16 nomatch
+add blocklist 10.1.2.0/24
+add blocklist 192.168.1.1
+create hosts hash:ip family inet hashsize 1024 maxelem 65536 timeout 300
+add hosts 1.2.3.4 timeout 120
+add hosts 1.2.3.5 timeout 120
+create hosts6 hash:ip family inet6 hashsize 1024 maxelem 65536
+add hosts6 2001:db8::1
+create lan hash:net,iface family inet hashsize 1024 maxelem 65536
+add lan 192.168.0.0/24,eth0
+add lan 192.168.2.0/24,wlan0
+create ports bitmap:port range 0-1024
+add ports 22
+`
+
+func TestReadIPSetSave(t *testing.T) {
+	sets, err := ReadIPSetSave(strings.NewReader(ipsetSaveOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 4 {
+		t.Fatal(len(sets))
+	}
+
+	bl := sets["blocklist"]
+	if !bl.Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal()
+	}
+	if bl.Contains(netip.MustParseAddr("10.1.0.1")) {
+		t.Fatal("nomatch entry is ignored")
+	}
+	if !bl.Contains(netip.MustParseAddr("10.1.2.1")) {
+		t.Fatal("more specific entry inside a nomatch entry is missing")
+	}
+	if !bl.Contains(netip.MustParseAddr("192.168.1.1")) {
+		t.Fatal()
+	}
+
+	hosts := sets["hosts"]
+	if !hosts.Contains(netip.MustParseAddr("1.2.3.4")) || !hosts.Contains(netip.MustParseAddr("1.2.3.5")) {
+		t.Fatal()
+	}
+	if hosts.Contains(netip.MustParseAddr("1.2.3.6")) {
+		t.Fatal()
+	}
+
+	if !sets["hosts6"].Contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Fatal()
+	}
+
+	lan := sets["lan"]
+	if !lan.Contains(netip.MustParseAddr("192.168.0.10")) || !lan.Contains(netip.MustParseAddr("192.168.2.10")) {
+		t.Fatal()
+	}
+	if lan.Contains(netip.MustParseAddr("192.168.1.10")) {
+		t.Fatal()
+	}
+}
+
+func TestReadIPSetSaveSelected(t *testing.T) {
+	sets, err := ReadIPSetSave(strings.NewReader(ipsetSaveOutput), "hosts", "lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 2 || sets["hosts"] == nil || sets["lan"] == nil {
+		t.Fatal(sets)
+	}
+
+	_, err = ReadIPSetSave(strings.NewReader(ipsetSaveOutput), "ports")
+	if !errors.Is(err, ErrUnsupportedSetType) {
+		t.Fatal(err)
+	}
+
+	_, err = ReadIPSetSave(strings.NewReader(ipsetSaveOutput), "hosts", "missing")
+	if !errors.Is(err, ErrSetNotFound) {
+		t.Fatal(err)
+	}
+
+	_, err = ReadIPSetSave(strings.NewReader("create s hash:ip\nadd s 1.2.3\n"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+const nftOutput = `{"nftables": [
+{"metainfo": {"version": "1.0.2", "release_name": "Lester Gooch", "json_schema_version": 1}},
+{"set": {"family": "inet", "name": "blocklist", "table": "filter", "type": "ipv4_addr", "handle": 3,
+"flags": ["interval"],
+"elem": ["1.2.3.4", {"prefix": {"addr": "10.0.0.0", "len": 8}}, {"range": ["192.168.0.1", "192.168.0.6"]},
+{"elem": {"val": {"prefix": {"addr": "172.16.0.0", "len": 12}}, "comment": "private"}},
+{"elem": {"val": "8.8.8.8", "timeout": 60, "expires": 30}}]}},
+{"set": {"family": "inet", "name": "blocklist6", "table": "filter", "type": "ipv6_addr", "handle": 4,
+"flags": ["interval"],
+"elem": [{"prefix": {"addr": "2001:db8::", "len": 32}}, "2001:db9::1"]}},
+{"set": {"family": "inet", "name": "services", "table": "filter", "type": ["ipv4_addr", "inet_service"], "handle": 5,
+"elem": [{"concat": ["1.2.3.4", 80]}]}}
+]}`
+
+func TestReadNftJSON(t *testing.T) {
+	sets, err := ReadNftJSON(strings.NewReader(nftOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 2 {
+		t.Fatal(len(sets))
+	}
+
+	bl := sets["blocklist"]
+	for _, a := range []string{"1.2.3.4", "10.1.2.3", "192.168.0.1", "192.168.0.6", "172.31.0.1", "8.8.8.8"} {
+		if !bl.Contains(netip.MustParseAddr(a)) {
+			t.Fatal(a)
+		}
+	}
+	for _, a := range []string{"1.2.3.5", "192.168.0.7", "192.168.0.0", "172.32.0.1"} {
+		if bl.Contains(netip.MustParseAddr(a)) {
+			t.Fatal(a)
+		}
+	}
+
+	bl6 := sets["blocklist6"]
+	if !bl6.Contains(netip.MustParseAddr("2001:db8::5")) || !bl6.Contains(netip.MustParseAddr("2001:db9::1")) {
+		t.Fatal()
+	}
+	if bl6.Contains(netip.MustParseAddr("2001:db9::2")) {
+		t.Fatal()
+	}
+
+	_, err = ReadNftJSON(strings.NewReader(nftOutput), "services")
+	if !errors.Is(err, ErrUnsupportedSetType) {
+		t.Fatal(err)
+	}
+
+	_, err = ReadNftJSON(strings.NewReader(nftOutput), "blocklist", "missing")
+	if !errors.Is(err, ErrSetNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func TestReadNftJSONDuplicate(t *testing.T) {
+	const input = `{"nftables": [
+{"set": {"family": "ip", "name": "bl", "table": "filter", "type": "ipv4_addr", "elem": ["1.2.3.4"]}},
+{"set": {"family": "ip", "name": "other", "table": "filter", "type": "ipv4_addr", "elem": ["1.2.3.5"]}},
+{"set": {"family": "ip", "name": "bl", "table": "nat", "type": "ipv4_addr", "elem": ["1.2.3.6"]}}
+]}`
+	if _, err := ReadNftJSON(strings.NewReader(input)); !errors.Is(err, ErrDuplicateName) {
+		t.Fatal(err)
+	}
+	if _, err := ReadNftJSON(strings.NewReader(input), "bl"); !errors.Is(err, ErrDuplicateName) {
+		t.Fatal(err)
+	}
+	sets, err := ReadNftJSON(strings.NewReader(input), "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 1 || !sets["other"].Contains(netip.MustParseAddr("1.2.3.5")) {
+		t.Fatal(sets)
+	}
+}
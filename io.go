@@ -9,14 +9,15 @@ import (
 
 var ErrInvalidFormat = errors.New("invalid format")
 
+// Serialize writes the canonical form of the set, which only depends on the addresses in the set, so sets with
+// the same contents are serialized identically. The set is not modified.
 func (s *ipsetBase) Serialize(w io.Writer) error {
-	if len(s.nodes) == 0 {
+	c := s.canonical()
+	if len(c.nodes) == 0 {
 		_, err := w.Write([]byte{0, 0, 0, 0})
 		return err
 	}
-	s.Compact()
-	s.nodes[0] = uint32(len(s.nodes)) * 4
-	return s.writeBytes(w)
+	return c.writeBytes(w)
 }
 
 func (s *ipsetBase) Deserialize(r io.Reader) error {
@@ -27,7 +28,11 @@ func (s *ipsetBase) Deserialize(r io.Reader) error {
 		return err
 	}
 
-	size := binary.LittleEndian.Uint32(buf[:])
+	return s.deserializeBody(binary.LittleEndian.Uint32(buf[:]), r)
+}
+
+// deserializeBody reads the rest of the tree after the size header.
+func (s *ipsetBase) deserializeBody(size uint32, r io.Reader) error {
 	if size&3 != 0 {
 		return ErrInvalidFormat
 	}
@@ -35,7 +40,7 @@ func (s *ipsetBase) Deserialize(r io.Reader) error {
 	var b []byte
 	if size != 0 {
 		b = make([]byte, size)
-		_, err = io.ReadFull(r, b[4:])
+		_, err := io.ReadFull(r, b[4:])
 		if err != nil {
 			return err
 		}
@@ -102,6 +107,15 @@ func (s *ipsetBase) loadBytesNative(b []byte) {
 	if len(b) != 0 {
 		nodes = (*(*[]uint32)(unsafe.Pointer(&b)))[: len(b)/4 : len(b)/4]
 	}
+	s.loadNodes(nodes)
+}
+
+// loadNodes replaces the node array, which must be compact.
+func (s *ipsetBase) loadNodes(nodes []uint32) {
 	s.nodes = nodes
 	s.freeList = nil
+	s.counts = nil
+	s.root = 0
+	s.frozen = 0
+	s.retired = nil
 }
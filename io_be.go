@@ -2,7 +2,12 @@
 
 package ipset
 
-import "io"
+import (
+	"encoding/binary"
+	"io"
+)
+
+var nativeByteOrder binary.ByteOrder = binary.BigEndian
 
 func (s *ipsetBase) writeBytes(w io.Writer) error {
 	return s.writeBytesGeneric(w)
@@ -3,9 +3,12 @@
 package ipset
 
 import (
+	"encoding/binary"
 	"io"
 )
 
+var nativeByteOrder binary.ByteOrder = binary.LittleEndian
+
 func (s *ipsetBase) writeBytes(w io.Writer) error {
 	return s.writeBytesNative(w)
 }
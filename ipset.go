@@ -13,6 +13,11 @@ type IterStepFunc func(prefix netip.Prefix) (continueIteration bool)
 type IPSet struct {
 	s4 IPSet4
 	s6 IPSet6
+
+	// sources holds the sources of the prefixes added with AddWithSource. It is empty unless AddWithSource is used.
+	sources sourceTrie
+
+	metadata *Metadata
 }
 
 func (s *IPSet) Add(prefix netip.Prefix) {
@@ -31,6 +36,35 @@ func (s *IPSet) Add(prefix netip.Prefix) {
 	}
 }
 
+// Remove removes the prefix from the set. Addresses outside the prefix are retained even if they were added as a
+// part of a larger prefix. Unlike in Add, the prefix is not widened to the maximum prefix length.
+func (s *IPSet) Remove(prefix netip.Prefix) {
+	if !s.sources.isEmpty() {
+		s.removeSources(prefix)
+	}
+	addr, bits := prefix.Addr(), uint32(prefix.Bits())
+	if addr.Is4() || addr.Is4In6() {
+		if bits > 32 {
+			bits = 32
+		}
+		a := addr.As4()
+		s.s4.Remove(binary.BigEndian.Uint32(a[:]), bits)
+	} else if addr.Is6() {
+		if bits > 128 {
+			bits = 128
+		}
+		s.s6.Remove(addr.As16(), bits)
+	}
+}
+
+// AddRange adds all addresses from the range between from and to (inclusive) by splitting the range into prefixes.
+// Nothing is added if the addresses belong to different families or if from is greater than to.
+func (s *IPSet) AddRange(from, to netip.Addr) {
+	for _, p := range rangePrefixes(from, to) {
+		s.Add(p)
+	}
+}
+
 func (s *IPSet) Contains(addr netip.Addr) bool {
 	if addr.Is4() || addr.Is4In6() {
 		a := addr.As4()
@@ -41,17 +75,47 @@ func (s *IPSet) Contains(addr netip.Addr) bool {
 	return false
 }
 
+// Deserialize reads a set written by Serialize, replacing the contents of the set. The metadata, if present, is
+// available via Metadata. If the data is gzip or zlib compressed, it is decompressed. Zlib compression is only
+// detected if r implements io.Seeker or can be peeked like *bufio.Reader, as it requires reading ahead.
 func (s *IPSet) Deserialize(r io.Reader) error {
-	if err := s.s4.Deserialize(r); err != nil {
+	r, err := decompress(r)
+	if err != nil {
 		return err
 	}
-	if err := s.s6.Deserialize(r); err != nil {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
 		return err
 	}
-	return nil
+	var m *Metadata
+	size := binary.LittleEndian.Uint32(buf[:])
+	if size == metadataMagic {
+		if m, err = readMetadataBody(r); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		size = binary.LittleEndian.Uint32(buf[:])
+	}
+	s.sources = sourceTrie{}
+	s.metadata = m
+	if err := s.s4.deserializeBody(size, r); err != nil {
+		return err
+	}
+	return s.s6.Deserialize(r)
 }
 
+// Serialize writes the set, preceded by the metadata section if the metadata is set (see SetMetadata).
 func (s *IPSet) Serialize(w io.Writer) error {
+	if s.metadata != nil {
+		if err := writeMetadata(w, s.metadata); err != nil {
+			return err
+		}
+	}
 	if err := s.s4.Serialize(w); err != nil {
 		return err
 	}
@@ -61,6 +125,20 @@ func (s *IPSet) Serialize(w io.Writer) error {
 	return nil
 }
 
+// SetMaxPrefixLen sets the maximum length of the IPv4 and IPv6 prefixes added to the set. Longer prefixes are
+// widened to this length by Add. A value of 0 removes the limit for the corresponding family.
+// See IPSet4.SetMaxPrefixLen for more details.
+func (s *IPSet) SetMaxPrefixLen(bits4, bits6 int) {
+	s.s4.SetMaxPrefixLen(bits4)
+	s.s6.SetMaxPrefixLen(bits6)
+}
+
+// Coarsen widens all IPv4 prefixes longer than bits4 and all IPv6 prefixes longer than bits6 to these lengths.
+func (s *IPSet) Coarsen(bits4, bits6 int) {
+	s.s4.Coarsen(bits4)
+	s.s6.Coarsen(bits6)
+}
+
 func (s *IPSet) Compact() {
 	s.s4.Compact()
 	s.s6.Compact()
@@ -87,3 +165,47 @@ func (s *IPSet) WriteTextTo(w io.Writer) (n int64, err error) {
 	n += n1
 	return
 }
+
+// lastAddr returns the last address within the prefix.
+func lastAddr(p netip.Prefix) netip.Addr {
+	addr := p.Addr()
+	bits := p.Bits()
+	if addr.Is4() {
+		bits += 96
+	}
+	a := addr.As16()
+	for i := bits; i < 128; i++ {
+		a[i/8] |= 0x80 >> (i % 8)
+	}
+	last := netip.AddrFrom16(a)
+	if addr.Is4() {
+		last = last.Unmap()
+	}
+	return last
+}
+
+// rangePrefixes returns the minimal list of prefixes that covers the range between from and to (inclusive).
+// IPv4-mapped IPv6 addresses are treated as IPv4.
+func rangePrefixes(from, to netip.Addr) []netip.Prefix {
+	return rangePrefixesNoUnmap(from.Unmap(), to.Unmap())
+}
+
+// rangePrefixesNoUnmap is like rangePrefixes, but it keeps IPv4-mapped IPv6 addresses as they are.
+func rangePrefixesNoUnmap(from, to netip.Addr) (prefixes []netip.Prefix) {
+	if !from.IsValid() || from.BitLen() != to.BitLen() {
+		return nil
+	}
+	for from.IsValid() && from.Compare(to) <= 0 {
+		var p netip.Prefix
+		// Find the largest prefix that starts at from and does not extend past to
+		for l := 0; l <= from.BitLen(); l++ {
+			p = netip.PrefixFrom(from, l)
+			if p.Masked().Addr() == from && lastAddr(p).Compare(to) <= 0 {
+				break
+			}
+		}
+		prefixes = append(prefixes, p)
+		from = lastAddr(p).Next()
+	}
+	return
+}
@@ -2,6 +2,7 @@ package ipset
 
 import (
 	"net/netip"
+	"strings"
 	"testing"
 )
 
@@ -27,3 +28,58 @@ func TestIPSet_Add(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestIPSet_AddRange(t *testing.T) {
+	var s IPSet
+	s.AddRange(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.6"))
+	s.AddRange(netip.MustParseAddr("2001:db8::"), netip.MustParseAddr("2001:db8::1:ffff"))
+	// Different families
+	s.AddRange(netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("::1"))
+	// Reversed
+	s.AddRange(netip.MustParseAddr("1.1.1.2"), netip.MustParseAddr("1.1.1.1"))
+
+	var b strings.Builder
+	_, err := s.WriteTextTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str := b.String(); str != "10.0.0.1/32\n10.0.0.2/31\n10.0.0.4/31\n10.0.0.6/32\n2001:db8::/111\n" {
+		t.Fatal(str)
+	}
+}
+
+func TestIPSet_Remove(t *testing.T) {
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	s.Add(netip.MustParsePrefix("2001:db8::/32"))
+	s.Remove(netip.MustParsePrefix("10.1.0.0/16"))
+	s.Remove(netip.MustParsePrefix("2001:db8::1/128"))
+
+	if s.Contains(netip.MustParseAddr("10.1.0.1")) {
+		t.Fatal()
+	}
+	if !s.Contains(netip.MustParseAddr("10.2.0.1")) {
+		t.Fatal()
+	}
+	if s.Contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Fatal()
+	}
+	if !s.Contains(netip.MustParseAddr("2001:db8::2")) {
+		t.Fatal()
+	}
+}
+
+func TestIPSet_Coarsen(t *testing.T) {
+	var s IPSet
+	s.SetMaxPrefixLen(24, 64)
+	s.Add(netip.MustParsePrefix("192.0.2.1/32"))
+	s.Add(netip.MustParsePrefix("2001:db8::1/128"))
+	if !s.Contains(netip.MustParseAddr("192.0.2.200")) || !s.Contains(netip.MustParseAddr("2001:db8::ffff")) {
+		t.Fatal()
+	}
+
+	s.Coarsen(16, 32)
+	if !s.Contains(netip.MustParseAddr("192.0.3.1")) || !s.Contains(netip.MustParseAddr("2001:db8:ffff::1")) {
+		t.Fatal()
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 type IPSet4 struct {
 	ipsetBase
+	maxPrefixLen uint32
 }
 
 func (s *IPSet4) Contains(ip uint32) bool {
@@ -15,7 +16,7 @@ func (s *IPSet4) Contains(ip uint32) bool {
 		return false
 	}
 
-	ptr := s.nodes[1]
+	ptr := s.nodes[s.rootSlot()]
 	for {
 		if ptr == ptrPresent {
 			return true
@@ -48,9 +49,48 @@ func ipPrefixFromIP4Addr(addr uint32) ipPrefix {
 }
 
 func (s *IPSet4) Add(prefix, length uint32) {
+	if s.maxPrefixLen != 0 && length > s.maxPrefixLen {
+		length = s.maxPrefixLen
+	}
 	s.add(ipPrefixFromIP4Addr(prefix), length)
 }
 
+// Remove removes the prefix from the set. Addresses outside the prefix are retained even if they were added as a
+// part of a larger prefix. Unlike in Add, the prefix is not widened to the maximum prefix length.
+func (s *IPSet4) Remove(prefix, length uint32) {
+	s.remove(ipPrefixFromIP4Addr(prefix), length)
+}
+
+// SetMaxPrefixLen sets the maximum length of the prefixes added to the set. Longer prefixes are widened to
+// this length by Add, e.g. with the maximum length of 24 adding 192.0.2.1/32 adds 192.0.2.0/24.
+// The prefixes that are already in the set are not affected, use Coarsen for that. A value of 0 or greater than 31
+// removes the limit.
+func (s *IPSet4) SetMaxPrefixLen(bits int) {
+	if bits <= 0 || bits >= 32 {
+		s.maxPrefixLen = 0
+	} else {
+		s.maxPrefixLen = uint32(bits)
+	}
+}
+
+// MaxPrefixLen returns the maximum prefix length set by SetMaxPrefixLen or 32 if there is no limit.
+func (s *IPSet4) MaxPrefixLen() int {
+	if s.maxPrefixLen == 0 {
+		return 32
+	}
+	return int(s.maxPrefixLen)
+}
+
+// Coarsen widens all prefixes in the set that are longer than bits to that length, collapsing their subtrees.
+func (s *IPSet4) Coarsen(bits int) {
+	if bits < 0 {
+		bits = 0
+	}
+	if bits < 32 {
+		s.coarsen(uint32(bits))
+	}
+}
+
 func (s *IPSet4) iterateNode(step IterStepFunc, prefix, prefixLen, ptr uint32) bool {
 	if ptr == ptrAbsent {
 		return true
@@ -99,5 +139,5 @@ func (s *IPSet4) Iterate(step IterStepFunc) bool {
 	if len(s.nodes) < 2 {
 		return true
 	}
-	return s.iterateNode(step, 0, 0, s.nodes[1])
+	return s.iterateNode(step, 0, 0, s.nodes[s.rootSlot()])
 }
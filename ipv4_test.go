@@ -314,3 +314,169 @@ func BenchmarkAddLarge(b *testing.B) {
 		}
 	}
 }
+
+func TestIPSet4_Remove(t *testing.T) {
+	var s IPSet4
+	s.Add(0x0A00_0000, 8)
+	s.Add(0xC0A8_0000, 16)
+	s.Add(0x0102_0304, 32)
+
+	s.Remove(0x0A01_0000, 16)
+	if s.Contains(0x0A01_0203) {
+		t.Fatal("removed prefix is still present")
+	}
+	if !s.Contains(0x0A00_0001) || !s.Contains(0x0A02_0001) || !s.Contains(0x0AFF_FFFF) {
+		t.Fatal("remainder of the prefix is missing")
+	}
+
+	s.Remove(0xC0A8_0100, 24)
+	s.Remove(0xC0A8_0000, 16)
+	if s.Contains(0xC0A8_0001) || s.Contains(0xC0A8_FF01) {
+		t.Fatal()
+	}
+
+	s.Remove(0x0102_0000, 16)
+	if s.Contains(0x0102_0304) {
+		t.Fatal()
+	}
+
+	// Removing a prefix that is not present
+	s.Remove(0x0B00_0000, 8)
+	s.Remove(0x0A01_0000, 16)
+
+	var b strings.Builder
+	_, err := s.WriteTextTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str := b.String(); str != "10.0.0.0/16\n10.2.0.0/15\n10.4.0.0/14\n10.8.0.0/13\n"+
+		"10.16.0.0/12\n10.32.0.0/11\n10.64.0.0/10\n10.128.0.0/9\n" {
+		t.Fatal(str)
+	}
+
+	s.Remove(0, 0)
+	if s.Contains(0x0A00_0001) {
+		t.Fatal()
+	}
+	s.Compact()
+	if len(s.nodes) != 2 {
+		t.Fatal(s.nodes)
+	}
+}
+
+func TestIPSet4_RemoveRandom(t *testing.T) {
+	var s IPSet4
+	rs := rand.New(rand.NewSource(12345678901234567))
+	var added, removed []uint32
+	for i := 0; i < 1000; i++ {
+		ip := rs.Uint32()
+		s.Add(ip, 32)
+		added = append(added, ip)
+	}
+	for i := 0; i < len(added); i += 2 {
+		s.Remove(added[i], 32)
+		removed = append(removed, added[i])
+	}
+	for _, ip := range removed {
+		if s.Contains(ip) {
+			t.Fatal(ip)
+		}
+	}
+	for i := 1; i < len(added); i += 2 {
+		if !s.Contains(added[i]) {
+			t.Fatal(i, added[i])
+		}
+	}
+	for _, ip := range added {
+		s.Remove(ip, 32)
+	}
+	s.Compact()
+	if len(s.nodes) != 2 {
+		t.Fatal(len(s.nodes))
+	}
+}
+
+func TestIPSet4_RemoveFromPrefixShape(t *testing.T) {
+	var s IPSet4
+	s.Add(0x0A00_0000, 8)
+	s.Remove(0x0A01_0203, 32)
+	s.Add(0xC000_0000, 4)
+	s.Remove(0xC800_0000, 6)
+	// Removing an address from a prefix leaves one regular node per bit, each with the other half present, which is
+	// the same layout add builds for the remainder.
+	var expected IPSet4
+	for bit := uint32(8); bit < 32; bit++ {
+		expected.Add(0x0A01_0203^1<<(31-bit), bit+1)
+	}
+	expected.Add(0xC000_0000, 5)
+	expected.Add(0xCC00_0000, 6)
+	if len(s.nodes) != len(expected.nodes) {
+		t.Fatal(len(s.nodes), len(expected.nodes))
+	}
+	if s.Contains(0x0A01_0203) || !s.Contains(0x0A01_0202) || s.Contains(0xC900_0000) || !s.Contains(0xCC00_0000) {
+		t.Fatal()
+	}
+}
+
+func TestIPSet4_SetMaxPrefixLen(t *testing.T) {
+	var s IPSet4
+	s.SetMaxPrefixLen(24)
+	s.Add(0xC000_0201, 32)
+	s.Add(0x0A00_0000, 8)
+	if !s.Contains(0xC000_02FF) {
+		t.Fatal()
+	}
+	if s.Contains(0xC000_0301) {
+		t.Fatal()
+	}
+	// Remove is exact
+	s.Remove(0x0A01_0203, 32)
+	if s.Contains(0x0A01_0203) {
+		t.Fatal()
+	}
+	if !s.Contains(0x0A01_02FF) || !s.Contains(0x0A01_0301) {
+		t.Fatal()
+	}
+	if s.MaxPrefixLen() != 24 {
+		t.Fatal(s.MaxPrefixLen())
+	}
+	s.SetMaxPrefixLen(0)
+	if s.MaxPrefixLen() != 32 {
+		t.Fatal(s.MaxPrefixLen())
+	}
+}
+
+func TestIPSet4_Coarsen(t *testing.T) {
+	var s IPSet4
+	s.Add(0xC000_0201, 32)
+	s.Add(0xC000_0205, 32)
+	s.Add(0xC000_0300, 25)
+	s.Add(0xC000_0380, 26)
+	s.Add(0x0A00_0000, 8)
+	s.Add(0x0B01_0000, 16)
+	s.Add(0x8000_0000, 2)
+
+	s.Coarsen(24)
+	var b strings.Builder
+	_, err := s.WriteTextTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str := b.String(); str != "10.0.0.0/8\n11.1.0.0/16\n128.0.0.0/2\n192.0.2.0/23\n" {
+		t.Fatal(str)
+	}
+
+	s.Coarsen(1)
+	b.Reset()
+	_, err = s.WriteTextTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str := b.String(); str != "0.0.0.0/0\n" {
+		t.Fatal(str)
+	}
+	s.Compact()
+	if len(s.nodes) != 2 {
+		t.Fatal(s.nodes)
+	}
+}
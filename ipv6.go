@@ -15,6 +15,7 @@ func ipPrefixFromIP6Addr(addr [16]byte) ipPrefix {
 
 type IPSet6 struct {
 	ipsetBase
+	maxPrefixLen uint32
 }
 
 func (s *IPSet6) matchNode(addr ipPrefix, ptr uint32) bool {
@@ -44,15 +45,53 @@ func (s *IPSet6) matchNode(addr ipPrefix, ptr uint32) bool {
 }
 
 func (s *IPSet6) Add(prefix [16]byte, length uint32) {
+	if s.maxPrefixLen != 0 && length > s.maxPrefixLen {
+		length = s.maxPrefixLen
+	}
 	s.add(ipPrefixFromIP6Addr(prefix), length)
 }
 
+// Remove removes the prefix from the set.
+// See IPSet4.Remove for more details.
+func (s *IPSet6) Remove(prefix [16]byte, length uint32) {
+	s.remove(ipPrefixFromIP6Addr(prefix), length)
+}
+
+// SetMaxPrefixLen sets the maximum length of the prefixes added to the set, e.g. with the maximum length of 64
+// every added address is widened to its /64. A value of 0 or greater than 127 removes the limit.
+// See IPSet4.SetMaxPrefixLen for more details.
+func (s *IPSet6) SetMaxPrefixLen(bits int) {
+	if bits <= 0 || bits >= 128 {
+		s.maxPrefixLen = 0
+	} else {
+		s.maxPrefixLen = uint32(bits)
+	}
+}
+
+// MaxPrefixLen returns the maximum prefix length set by SetMaxPrefixLen or 128 if there is no limit.
+func (s *IPSet6) MaxPrefixLen() int {
+	if s.maxPrefixLen == 0 {
+		return 128
+	}
+	return int(s.maxPrefixLen)
+}
+
+// Coarsen widens all prefixes in the set that are longer than bits to that length, collapsing their subtrees.
+func (s *IPSet6) Coarsen(bits int) {
+	if bits < 0 {
+		bits = 0
+	}
+	if bits < 128 {
+		s.coarsen(uint32(bits))
+	}
+}
+
 func (s *IPSet6) Contains(addr [16]byte) bool {
 	if len(s.nodes) < 2 {
 		return false
 	}
 
-	return s.matchNode(ipPrefixFromIP6Addr(addr), s.nodes[1])
+	return s.matchNode(ipPrefixFromIP6Addr(addr), s.nodes[s.rootSlot()])
 }
 
 // WriteTextTo writes a textual representation of the IP set to the provided Writer.
@@ -116,5 +155,5 @@ func (s *IPSet6) Iterate(step IterStepFunc) bool {
 	if len(s.nodes) < 2 {
 		return true
 	}
-	return s.iterateNode(step, ipPrefix{}, 0, s.nodes[1])
+	return s.iterateNode(step, ipPrefix{}, 0, s.nodes[s.rootSlot()])
 }
@@ -116,3 +116,59 @@ func TestIPSet6_WriteTextTo(t *testing.T) {
 		t.Fatal(str)
 	}
 }
+
+func TestIPSet6_Remove(t *testing.T) {
+	var s IPSet6
+	s.Add(netip.MustParseAddr("2001:db8::").As16(), 32)
+	s.Remove(netip.MustParseAddr("2001:db8:0:1::").As16(), 64)
+
+	if s.Contains(netip.MustParseAddr("2001:db8:0:1::1").As16()) {
+		t.Fatal()
+	}
+	if !s.Contains(netip.MustParseAddr("2001:db8::1").As16()) {
+		t.Fatal()
+	}
+	if !s.Contains(netip.MustParseAddr("2001:db8:0:2::1").As16()) {
+		t.Fatal()
+	}
+
+	s.Add(netip.MustParseAddr("2001:db8:0:1::1").As16(), 128)
+	s.Remove(netip.MustParseAddr("2001:db8::").As16(), 32)
+	if s.Contains(netip.MustParseAddr("2001:db8:0:1::1").As16()) {
+		t.Fatal()
+	}
+	s.Compact()
+	if len(s.nodes) != 2 {
+		t.Fatal(s.nodes)
+	}
+}
+
+func TestIPSet6_Coarsen(t *testing.T) {
+	var s IPSet6
+	s.SetMaxPrefixLen(64)
+	s.Add(netip.MustParseAddr("2001:db8::1").As16(), 128)
+	if !s.Contains(netip.MustParseAddr("2001:db8::ffff").As16()) {
+		t.Fatal()
+	}
+	// Remove is exact
+	s.Remove(netip.MustParseAddr("2001:db8::ffff").As16(), 128)
+	if s.Contains(netip.MustParseAddr("2001:db8::ffff").As16()) ||
+		!s.Contains(netip.MustParseAddr("2001:db8::1").As16()) {
+		t.Fatal()
+	}
+	s.Add(netip.MustParseAddr("2001:db8::ffff").As16(), 128)
+
+	s.SetMaxPrefixLen(0)
+	s.Add(netip.MustParseAddr("2001:db8:0:1::1").As16(), 128)
+	s.Add(netip.MustParseAddr("2001:db8:1::1").As16(), 128)
+	s.Coarsen(63)
+
+	var b strings.Builder
+	_, err := s.WriteTextTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str := b.String(); str != "2001:db8::/63\n2001:db8:1::/63\n" {
+		t.Fatal(str)
+	}
+}
@@ -0,0 +1,192 @@
+package ipset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+	"time"
+)
+
+// metadataMagic starts the optional metadata section. Its lowest bits are not zero, so it cannot be confused with
+// the size of the IPv4 tree, which the data starts with if there is no metadata.
+const metadataMagic = 0x4D53_5049 // "IPSM"
+
+const metadataHeaderSize = 8
+
+// Metadata describes a serialized set. It is written by IPSet.Serialize if set with IPSet.SetMetadata.
+type Metadata struct {
+	Name        string
+	Description string
+	Sources     []string // e.g. the URLs of the feeds the set was built from
+	Created     time.Time
+	Generator   string // the name and the version of the program that built the set
+	Labels      map[string]string
+}
+
+// encode encodes the metadata as a sequence of strings, each preceded by its length as an unsigned varint.
+// The lists (the sources and the labels sorted by key) are preceded by the number of elements. The creation time is
+// encoded as a varint number of nanoseconds since the Unix epoch, 0 meaning that it is not set.
+func (m *Metadata) encode() []byte {
+	var b []byte
+	var buf [binary.MaxVarintLen64]byte
+	putString := func(s string) {
+		b = append(b, buf[:binary.PutUvarint(buf[:], uint64(len(s)))]...)
+		b = append(b, s...)
+	}
+	putString(m.Name)
+	putString(m.Description)
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(len(m.Sources)))]...)
+	for _, src := range m.Sources {
+		putString(src)
+	}
+	var created int64
+	if !m.Created.IsZero() {
+		created = m.Created.UnixNano()
+	}
+	b = append(b, buf[:binary.PutVarint(buf[:], created)]...)
+	putString(m.Generator)
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(len(keys)))]...)
+	for _, k := range keys {
+		putString(k)
+		putString(m.Labels[k])
+	}
+	return b
+}
+
+func decodeMetadata(b []byte) (*Metadata, error) {
+	r := bytes.NewReader(b)
+	var err error
+	getUint := func() uint64 {
+		v, e := binary.ReadUvarint(r)
+		if e != nil {
+			err = ErrInvalidFormat
+		}
+		return v
+	}
+	getString := func() string {
+		l := getUint()
+		if err != nil || l > uint64(r.Len()) {
+			err = ErrInvalidFormat
+			return ""
+		}
+		s := make([]byte, l)
+		r.Read(s)
+		return string(s)
+	}
+	m := &Metadata{}
+	m.Name = getString()
+	m.Description = getString()
+	for n := getUint(); n > 0 && err == nil; n-- {
+		m.Sources = append(m.Sources, getString())
+	}
+	created, e := binary.ReadVarint(r)
+	if e != nil {
+		return nil, ErrInvalidFormat
+	}
+	if created != 0 {
+		m.Created = time.Unix(0, created)
+	}
+	m.Generator = getString()
+	for n := getUint(); n > 0 && err == nil; n-- {
+		if m.Labels == nil {
+			m.Labels = make(map[string]string)
+		}
+		k := getString()
+		m.Labels[k] = getString()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeMetadata writes the metadata section: the magic and the length of the encoded metadata as 32-bit
+// little-endian integers, followed by the encoded metadata padded with zeros to a multiple of 4 bytes, so that
+// the trees that follow stay aligned.
+func writeMetadata(w io.Writer, m *Metadata) error {
+	body := m.encode()
+	b := make([]byte, metadataHeaderSize, metadataHeaderSize+len(body)+3)
+	binary.LittleEndian.PutUint32(b, metadataMagic)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(body)))
+	b = append(b, body...)
+	for len(b)&3 != 0 {
+		b = append(b, 0)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func metadataPadding(l uint32) uint32 {
+	return (4 - l&3) & 3
+}
+
+// readMetadataBody reads the rest of the metadata section after the magic.
+func readMetadataBody(r io.Reader) (*Metadata, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	l := binary.LittleEndian.Uint32(buf[:])
+	b, err := io.ReadAll(io.LimitReader(r, int64(l)+int64(metadataPadding(l))))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != int(l+metadataPadding(l)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return decodeMetadata(b[:l])
+}
+
+// ReadMetadata reads the metadata of a set serialized by IPSet.Serialize without reading the rest of the set.
+// It returns nil if the set was serialized without metadata. Like IPSet.Deserialize, it detects compression.
+func ReadMetadata(r io.Reader) (*Metadata, error) {
+	r, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(buf[:]) != metadataMagic {
+		return nil, nil
+	}
+	return readMetadataBody(r)
+}
+
+// metadataSize returns the size of the metadata section at the offset, which is 0 if there is none.
+func metadataSize(r io.ReaderAt, off int64) (int64, error) {
+	var buf [metadataHeaderSize]byte
+	n, err := r.ReadAt(buf[:], off)
+	if n >= 4 && binary.LittleEndian.Uint32(buf[:]) != metadataMagic {
+		return 0, nil
+	}
+	if n < len(buf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	l := binary.LittleEndian.Uint32(buf[4:])
+	return metadataHeaderSize + int64(l) + int64(metadataPadding(l)), nil
+}
+
+// Metadata returns the metadata set with SetMetadata or read by Deserialize. It returns nil if there is none.
+func (s *IPSet) Metadata() *Metadata {
+	return s.metadata
+}
+
+// SetMetadata sets the metadata that Serialize writes along with the set. The metadata must not be modified
+// afterwards. It is not taken into account by Equal and Fingerprint.
+func (s *IPSet) SetMetadata(m *Metadata) {
+	s.metadata = m
+}
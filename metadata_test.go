@@ -0,0 +1,157 @@
+package ipset
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	s.Add(netip.MustParsePrefix("2001:db8::/32"))
+	var plain bytes.Buffer
+	if err := s.Serialize(&plain); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Metadata{
+		Name:        "test",
+		Description: "Test set",
+		Sources:     []string{"https://example.com/a.txt", "https://example.com/b.txt"},
+		Created:     time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+		Generator:   "ipset-test 1.0",
+		Labels:      map[string]string{"tier": "1", "owner": "netops"},
+	}
+	s.SetMetadata(m)
+	if s.Clone().Metadata() != m {
+		t.Fatal()
+	}
+	var buf bytes.Buffer
+	if err := s.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b := append([]byte(nil), buf.Bytes()...)
+	if len(b)&3 != 0 || !bytes.HasSuffix(b, plain.Bytes()) {
+		t.Fatal(b)
+	}
+
+	r := bytes.NewReader(b)
+	m1, err := ReadMetadata(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m1.Created.Equal(m.Created) {
+		t.Fatal(m1.Created)
+	}
+	m1.Created = m.Created
+	if !reflect.DeepEqual(m, m1) {
+		t.Fatal(m1)
+	}
+	if r.Len() != plain.Len() {
+		t.Fatal("the nodes are read", r.Len())
+	}
+
+	var s1 IPSet
+	if err := s1.Deserialize(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, &s, &s1)
+	if s1.Metadata() == nil || s1.Metadata().Name != "test" {
+		t.Fatal(s1.Metadata())
+	}
+	if err := s1.Deserialize(bytes.NewReader(plain.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if s1.Metadata() != nil {
+		t.Fatal()
+	}
+	if m, err := ReadMetadata(bytes.NewReader(plain.Bytes())); m != nil || err != nil {
+		t.Fatal(m, err)
+	}
+	if s.Fingerprint() != s1.Fingerprint() {
+		t.Fatal()
+	}
+
+	// Empty metadata
+	s1.SetMetadata(&Metadata{})
+	buf.Reset()
+	if err := s1.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var s2 IPSet
+	if err := s2.Deserialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s2.Metadata(), &Metadata{}) {
+		t.Fatal(s2.Metadata())
+	}
+
+	for l := 4; l < len(b)-len(plain.Bytes()); l++ {
+		if err := s2.Deserialize(bytes.NewReader(b[:l])); err != io.ErrUnexpectedEOF && err != ErrInvalidFormat {
+			t.Fatal(l, err)
+		}
+	}
+}
+
+func TestMetadataReaders(t *testing.T) {
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	s.Add(netip.MustParsePrefix("2001:db8::/32"))
+	s.SetMetadata(&Metadata{Name: "odd length"})
+	var buf bytes.Buffer
+	if err := s.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	r, err := NewIPSetReaderAt(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.Contains(netip.MustParseAddr("2001:db8::1")); !ok || err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := UnionSerialized(&out, bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	var s1 IPSet
+	if err := s1.Deserialize(&out); err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, &s, &s1)
+
+	path := filepath.Join(t.TempDir(), "sets.bundle")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewBundleWriter(f)
+	if err := w.Add("a", &s); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	bundle, err := OpenBundle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bundle.Close()
+	s2, err := bundle.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, &s, s2)
+	if s2.Metadata() == nil || s2.Metadata().Name != "odd length" {
+		t.Fatal(s2.Metadata())
+	}
+}
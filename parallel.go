@@ -0,0 +1,209 @@
+package ipset
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+)
+
+// union returns a compact tree containing the union of the two sets. The trees are merged directly, without
+// enumerating the prefixes, and the subtrees that exist only in one of the sets are copied as is.
+func union(a, b *ipsetBase) (u ipsetBase) {
+	ra, rb := a.rootRef(), b.rootRef()
+	if ra.ptr == ptrAbsent && rb.ptr == ptrAbsent {
+		return
+	}
+	u.nodes = make([]uint32, 2, len(a.nodes)+len(b.nodes))
+	root := u.unionNode(a, ra, b, rb)
+	u.nodes[1] = root
+	return
+}
+
+func (s *ipsetBase) unionNode(a *ipsetBase, ra nodeRef, b *ipsetBase, rb nodeRef) uint32 {
+	if ra.ptr == ptrPresent || rb.ptr == ptrPresent {
+		return ptrPresent
+	}
+	if ra.ptr == ptrAbsent {
+		return s.copyRef(b, rb)
+	}
+	if rb.ptr == ptrAbsent {
+		return s.copyRef(a, ra)
+	}
+	la, ra1 := a.children(ra)
+	lb, rb1 := b.children(rb)
+	left := s.unionNode(a, la, b, lb)
+	right := s.unionNode(a, ra1, b, rb1)
+	return s.joinNodes(left, right)
+}
+
+// copyRef copies the subtree at the position in another tree.
+func (s *ipsetBase) copyRef(src *ipsetBase, r nodeRef) uint32 {
+	if r.isLeaf() {
+		return r.ptr
+	}
+	if r.off == 0 {
+		return src.compactNode(&s.nodes, r.ptr)
+	}
+	// The position is within a skip node, only the remaining part of the prefix is copied. It is prepended one bit
+	// at a time, so that it is merged with the child if that is a skip node.
+	idx := ptrToIdx(r.ptr)
+	prefix, prefixLen := unpackPrefixLen(src.nodes[idx])
+	ptr := src.compactNode(&s.nodes, src.nodes[idx+1])
+	for i := prefixLen; i > r.off; i-- {
+		ptr = s.prependBit(prefix>>(32-i)&1, ptr)
+	}
+	return ptr
+}
+
+// joinNodes returns a node with the specified children, which must have been created by the same union.
+func (s *ipsetBase) joinNodes(left, right uint32) uint32 {
+	switch {
+	case left == ptrPresent && right == ptrPresent:
+		return ptrPresent
+	case left == ptrAbsent && right == ptrAbsent:
+		return ptrAbsent
+	case right == ptrAbsent:
+		return s.prependBit(0, left)
+	case left == ptrAbsent:
+		return s.prependBit(1, right)
+	}
+	return idxToPtr(s.allocateNode(left, right))
+}
+
+// prependBit returns a node with a single child on the side selected by the bit. To keep the tree compact, the
+// child is extended in place if it is a skip node or a node with a single child.
+func (s *ipsetBase) prependBit(bit, child uint32) uint32 {
+	if child > ptrPresent {
+		idx := ptrToIdx(child)
+		if isSkipNode(child) {
+			prefix, prefixLen := unpackPrefixLen(s.nodes[idx])
+			if prefixLen < maxPackablePrefixLen {
+				s.nodes[idx] = packPrefixLen(bit<<31|prefix>>1, prefixLen+1)
+				return child
+			}
+		} else if s.nodes[idx] == ptrAbsent || s.nodes[idx+1] == ptrAbsent {
+			childBit, grandChild := uint32(0), s.nodes[idx]
+			if grandChild == ptrAbsent {
+				childBit, grandChild = 1, s.nodes[idx+1]
+			}
+			s.nodes[idx] = packPrefixLen(bit<<31|childBit<<30, 2)
+			s.nodes[idx+1] = grandChild
+			return child | skipNodeMask
+		}
+	}
+	if bit == 0 {
+		return idxToPtr(s.allocateNode(child, ptrAbsent))
+	}
+	return idxToPtr(s.allocateNode(ptrAbsent, child))
+}
+
+func unionSets(a, b *IPSet) *IPSet {
+	return &IPSet{
+		s4: IPSet4{ipsetBase: union(&a.s4.ipsetBase, &b.s4.ipsetBase)},
+		s6: IPSet6{ipsetBase: union(&a.s6.ipsetBase, &b.s6.ipsetBase)},
+	}
+}
+
+// BuilderWorker is a private set of a single goroutine participating in a ParallelBuilder.
+type BuilderWorker struct {
+	set IPSet
+}
+
+// Add adds the prefix to the worker's set. It must not be called concurrently on the same worker.
+func (w *BuilderWorker) Add(prefix netip.Prefix) {
+	w.set.Add(prefix)
+}
+
+// AddRange adds the range of addresses to the worker's set (see IPSet.AddRange).
+func (w *BuilderWorker) AddRange(from, to netip.Addr) {
+	w.set.AddRange(from, to)
+}
+
+// ParallelBuilder builds a set from multiple goroutines without locking. Each goroutine adds the prefixes to
+// a private set obtained from Worker, and Build merges them into one.
+//
+// The zero value is ready to use.
+type ParallelBuilder struct {
+	mu      sync.Mutex
+	workers []*BuilderWorker
+}
+
+// Worker returns a new worker. It is safe to call concurrently.
+func (b *ParallelBuilder) Worker() *BuilderWorker {
+	w := &BuilderWorker{}
+	b.mu.Lock()
+	b.workers = append(b.workers, w)
+	b.mu.Unlock()
+	return w
+}
+
+// Run calls fn from n goroutines, each with its own worker, and waits for them to finish. If fn returns an error,
+// the context passed to the other calls is cancelled and the first error is returned.
+func (b *ParallelBuilder) Run(ctx context.Context, n int, fn func(ctx context.Context, w *BuilderWorker) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var res error
+	for i := 0; i < n; i++ {
+		w := b.Worker()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(ctx, w); err != nil {
+				once.Do(func() {
+					res = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if res == nil {
+		res = ctx.Err()
+	}
+	return res
+}
+
+// Build merges the sets of all workers into one compact set. It must not be called while the workers are being
+// used. The merge is done pairwise in parallel, and the context is checked between the rounds. After Build
+// returns, the builder is empty.
+func (b *ParallelBuilder) Build(ctx context.Context) (*IPSet, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sets := make([]*IPSet, len(b.workers))
+	for i, w := range b.workers {
+		sets[i] = &w.set
+	}
+	b.workers = nil
+	if len(sets) == 0 {
+		return &IPSet{}, ctx.Err()
+	}
+	if len(sets) == 1 {
+		// No merge is needed, but the result is still compacted
+		sets[0] = unionSets(sets[0], &IPSet{})
+	}
+	for len(sets) > 1 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		next := make([]*IPSet, (len(sets)+1)/2)
+		var wg sync.WaitGroup
+		for i := 0; i+1 < len(sets); i += 2 {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				next[i/2] = unionSets(sets[i], sets[i+1])
+			}(i)
+		}
+		if len(sets)%2 != 0 {
+			next[len(next)-1] = sets[len(sets)-1]
+		}
+		wg.Wait()
+		sets = next
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return sets[0], nil
+}
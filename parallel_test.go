@@ -0,0 +1,147 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUnion(t *testing.T) {
+	rs := rand.New(rand.NewSource(42))
+	for i := 0; i < 200; i++ {
+		var a, b, ref IPSet
+		for j := rs.Intn(50); j > 0; j-- {
+			randomUpdate(rs, &a)
+		}
+		for j := rs.Intn(50); j > 0; j-- {
+			randomUpdate(rs, &b)
+		}
+		for _, p := range append(prefixList(&a), prefixList(&b)...) {
+			ref.Add(p)
+		}
+		u := unionSets(&a, &b)
+		assertSameSet(t, u, &ref)
+		// All nodes are reachable
+		c := u.Clone()
+		if len(u.s4.nodes) != len(c.s4.nodes) || len(u.s6.nodes) != len(c.s6.nodes) {
+			t.Fatal(i)
+		}
+	}
+}
+
+func TestParallelBuilder(t *testing.T) {
+	const workers = 8
+	prefixes := make([][]netip.Prefix, workers)
+	var ref IPSet
+	for i := range prefixes {
+		rs := rand.New(rand.NewSource(int64(i)))
+		for j := 0; j < 1000; j++ {
+			p := randomPrefix(rs)
+			prefixes[i] = append(prefixes[i], p)
+			ref.Add(p)
+		}
+	}
+
+	var b ParallelBuilder
+	next := make(chan []netip.Prefix, workers)
+	for _, list := range prefixes {
+		next <- list
+	}
+	close(next)
+	err := b.Run(context.Background(), workers, func(ctx context.Context, w *BuilderWorker) error {
+		for _, p := range <-next {
+			w.Add(p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := b.Build(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, s, &ref)
+	if len(s.s4.freeList) != 0 || len(s.s6.freeList) != 0 {
+		t.Fatal()
+	}
+
+	s, err = b.Build(context.Background())
+	if err != nil || !isEmpty(s) {
+		t.Fatal(err)
+	}
+
+	w := b.Worker()
+	w.AddRange(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"))
+	s, err = b.Build(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := prefixList(s); len(l) != 2 {
+		t.Fatal(l)
+	}
+}
+
+func TestParallelBuilderCancel(t *testing.T) {
+	var b ParallelBuilder
+	errTest := errors.New("test")
+	var started atomic.Int32
+	err := b.Run(context.Background(), 4, func(ctx context.Context, w *BuilderWorker) error {
+		w.Add(netip.MustParsePrefix("10.0.0.0/8"))
+		if started.Add(1) == 1 {
+			return errTest
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != errTest {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.Build(ctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkParallelBuilder(b *testing.B) {
+	rs := rand.New(rand.NewSource(1))
+	prefixes := make([]netip.Prefix, 200000)
+	for i := range prefixes {
+		prefixes[i] = netip.PrefixFrom(addrFrom4(rs.Uint32()), 16+rs.Intn(17)).Masked()
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var pb ParallelBuilder
+				next := make(chan []netip.Prefix, workers)
+				chunk := (len(prefixes) + workers - 1) / workers
+				for j := 0; j < len(prefixes); j += chunk {
+					end := j + chunk
+					if end > len(prefixes) {
+						end = len(prefixes)
+					}
+					next <- prefixes[j:end]
+				}
+				close(next)
+				err := pb.Run(context.Background(), workers, func(ctx context.Context, w *BuilderWorker) error {
+					for _, p := range <-next {
+						w.Add(p)
+					}
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := pb.Build(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package ipset
+
+import (
+	"net/netip"
+	"sync/atomic"
+)
+
+// Source identifies where a prefix came from, e.g. a feed name and a line number, or an arbitrary ID supplied
+// by the caller.
+type Source struct {
+	Feed string
+	Line int
+	ID   string
+}
+
+// SourceEntry is a prefix added with AddWithSource along with its source.
+type SourceEntry struct {
+	Prefix netip.Prefix
+	Source Source
+}
+
+// storedPrefix returns the prefix the way Add (or Remove if widen is false) applies it to the set, i.e. with
+// IPv4-mapped IPv6 addresses converted to IPv4, widened to the maximum prefix length and masked.
+func (s *IPSet) storedPrefix(prefix netip.Prefix, widen bool) (netip.Prefix, bool) {
+	addr, bits := prefix.Addr(), prefix.Bits()
+	if !prefix.IsValid() {
+		return netip.Prefix{}, false
+	}
+	maxBits := s.s6.MaxPrefixLen()
+	if addr.Is4() || addr.Is4In6() {
+		addr = addr.Unmap()
+		maxBits = s.s4.MaxPrefixLen()
+	}
+	if !widen {
+		maxBits = addr.BitLen()
+	}
+	if bits > maxBits {
+		bits = maxBits
+	}
+	return netip.PrefixFrom(addr, bits).Masked(), true
+}
+
+// sourceNode is a node of the trie that holds the sources. The node at depth n contains the sources of the prefix
+// of length n formed by the path to it.
+type sourceNode struct {
+	child   [2]*sourceNode
+	sources []Source
+	gen     uint64
+}
+
+// sourceGen provides the generations for sourceTrie.share.
+var sourceGen atomic.Uint64
+
+// sourceTrie holds the sources recorded by AddWithSource, indexed by prefix, so that the sources of a prefix and
+// of all prefixes within it can be found by walking a single path.
+//
+// The sources are kept separately from the nodes of the set rather than in them and carried along by mergeNodes:
+// a node is just two 32-bit words and merging discards the nodes of the merged prefixes, so the sources would have
+// to be moved to the parent on every merge and split again on every Remove. Keeping them by the added prefix gives
+// the same result for Explain, which collects the sources of all prefixes covering the address.
+//
+// The nodes are shared between the copies of the set made by Snapshot, Clone and Begin. A node can only be modified
+// in place by the trie with the same generation, the other ones copy it first.
+type sourceTrie struct {
+	roots [2]*sourceNode // IPv4 and IPv6
+	gen   uint64
+}
+
+func (t *sourceTrie) isEmpty() bool {
+	return t.roots[0] == nil && t.roots[1] == nil
+}
+
+// share returns a copy of the trie. Both the copy and the original get new generations, so that the nodes they
+// share are copied on write.
+func (t *sourceTrie) share() sourceTrie {
+	if t.isEmpty() {
+		return sourceTrie{}
+	}
+	t.gen = sourceGen.Add(1)
+	return sourceTrie{roots: t.roots, gen: sourceGen.Add(1)}
+}
+
+// own returns the node if it belongs to the trie, otherwise a copy of it that does.
+func (t *sourceTrie) own(n *sourceNode) *sourceNode {
+	if n == nil {
+		return &sourceNode{gen: t.gen}
+	}
+	if n.gen == t.gen {
+		return n
+	}
+	return &sourceNode{child: n.child, sources: n.sources[:len(n.sources):len(n.sources)], gen: t.gen}
+}
+
+func prefixBit(a *[16]byte, i int) int {
+	return int(a[i/8]>>(7-i%8)) & 1
+}
+
+func sourceKey(prefix netip.Prefix) (family int, a [16]byte) {
+	if prefix.Addr().Is4() {
+		a4 := prefix.Addr().As4()
+		copy(a[:], a4[:])
+		return 0, a
+	}
+	return 1, prefix.Addr().As16()
+}
+
+func (t *sourceTrie) add(prefix netip.Prefix, src Source) {
+	family, a := sourceKey(prefix)
+	p := &t.roots[family]
+	for i := 0; ; i++ {
+		n := t.own(*p)
+		*p = n
+		if i == prefix.Bits() {
+			for _, existing := range n.sources {
+				if existing == src {
+					return
+				}
+			}
+			n.sources = append(n.sources, src)
+			return
+		}
+		p = &n.child[prefixBit(&a, i)]
+	}
+}
+
+// remove drops the sources of all prefixes within the prefix and returns the new subtree, removing the nodes that
+// are left empty.
+func (t *sourceTrie) remove(n *sourceNode, a *[16]byte, depth, bits int) *sourceNode {
+	if n == nil || depth == bits {
+		return nil
+	}
+	b := prefixBit(a, depth)
+	c := t.remove(n.child[b], a, depth+1, bits)
+	if c == n.child[b] {
+		return n
+	}
+	if c == nil && n.child[1-b] == nil && len(n.sources) == 0 {
+		return nil
+	}
+	n = t.own(n)
+	n.child[b] = c
+	return n
+}
+
+// AddWithSource adds the prefix to the set like Add does and records its source, so that it can be later
+// retrieved by Explain. The sources are kept separately from the tree (see sourceTrie), so they are not affected
+// by merging of the prefixes. They are not serialized.
+func (s *IPSet) AddWithSource(prefix netip.Prefix, src Source) {
+	s.Add(prefix)
+	key, ok := s.storedPrefix(prefix, true)
+	if !ok {
+		return
+	}
+	s.sources.add(key, src)
+}
+
+// removeSources drops the sources of all prefixes that are within the prefix. Like Remove, it does not widen
+// the prefix.
+func (s *IPSet) removeSources(prefix netip.Prefix) {
+	key, ok := s.storedPrefix(prefix, false)
+	if !ok {
+		return
+	}
+	family, a := sourceKey(key)
+	s.sources.roots[family] = s.sources.remove(s.sources.roots[family], &a, 0, key.Bits())
+}
+
+// Explain returns the sources of all prefixes added with AddWithSource that cover the address, from the shortest
+// prefix to the longest one. Nothing is returned if the address is not in the set, even if it was added by
+// AddWithSource and then partially removed.
+func (s *IPSet) Explain(addr netip.Addr) (entries []SourceEntry) {
+	if s.sources.isEmpty() || !s.Contains(addr) {
+		return nil
+	}
+	addr = addr.Unmap()
+	family, a := sourceKey(netip.PrefixFrom(addr, 0))
+	n := s.sources.roots[family]
+	for l := 0; n != nil; l++ {
+		if len(n.sources) > 0 {
+			p, _ := addr.Prefix(l)
+			for _, src := range n.sources {
+				entries = append(entries, SourceEntry{Prefix: p, Source: src})
+			}
+		}
+		if l == addr.BitLen() {
+			break
+		}
+		n = n.child[prefixBit(&a, l)]
+	}
+	return
+}
@@ -0,0 +1,132 @@
+package ipset
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestIPSet_Explain(t *testing.T) {
+	var s IPSet
+	s.AddWithSource(netip.MustParsePrefix("10.0.0.0/25"), Source{Feed: "feed1", Line: 1})
+	s.AddWithSource(netip.MustParsePrefix("10.0.0.128/25"), Source{Feed: "feed1", Line: 2})
+	s.AddWithSource(netip.MustParsePrefix("10.0.0.0/24"), Source{ID: "manual"})
+	s.AddWithSource(netip.MustParsePrefix("10.0.0.0/24"), Source{ID: "manual"})
+	s.AddWithSource(netip.MustParsePrefix("::ffff:10.0.0.1/128"), Source{Feed: "feed2", Line: 7})
+	s.Add(netip.MustParsePrefix("192.168.0.0/16"))
+
+	// The /25 prefixes are merged into a /24 in the tree
+	var list []string
+	s.Iterate(func(p netip.Prefix) bool {
+		list = append(list, p.String())
+		return true
+	})
+	if len(list) != 2 || list[0] != "10.0.0.0/24" {
+		t.Fatal(list)
+	}
+
+	entries := s.Explain(netip.MustParseAddr("10.0.0.1"))
+	expected := []SourceEntry{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Source: Source{ID: "manual"}},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/25"), Source: Source{Feed: "feed1", Line: 1}},
+		{Prefix: netip.MustParsePrefix("10.0.0.1/32"), Source: Source{Feed: "feed2", Line: 7}},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatal(entries)
+	}
+	entries = s.Explain(netip.MustParseAddr("10.0.0.200"))
+	if len(entries) != 2 || entries[1].Source.Line != 2 {
+		t.Fatal(entries)
+	}
+	if entries := s.Explain(netip.MustParseAddr("192.168.0.1")); entries != nil {
+		t.Fatal(entries)
+	}
+
+	s.Remove(netip.MustParsePrefix("10.0.0.0/25"))
+	if entries := s.Explain(netip.MustParseAddr("10.0.0.1")); entries != nil {
+		t.Fatal(entries)
+	}
+	s.Add(netip.MustParsePrefix("10.0.0.0/25"))
+	if entries := s.Explain(netip.MustParseAddr("10.0.0.1")); len(entries) != 1 || entries[0].Source.ID != "manual" {
+		t.Fatal(entries)
+	}
+
+	var buf bytes.Buffer
+	if err := s.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deserialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if entries := s.Explain(netip.MustParseAddr("10.0.0.200")); entries != nil {
+		t.Fatal(entries)
+	}
+}
+
+func TestIPSet_ExplainMaxPrefixLen(t *testing.T) {
+	var s IPSet
+	s.SetMaxPrefixLen(24, 64)
+	s.AddWithSource(netip.MustParsePrefix("10.0.0.1/32"), Source{ID: "a"})
+	s.AddWithSource(netip.MustParsePrefix("2001:db8::1/128"), Source{ID: "b"})
+	if entries := s.Explain(netip.MustParseAddr("10.0.0.200")); len(entries) != 1 ||
+		entries[0].Prefix != netip.MustParsePrefix("10.0.0.0/24") {
+		t.Fatal(entries)
+	}
+	if entries := s.Explain(netip.MustParseAddr("2001:db8::2")); len(entries) != 1 ||
+		entries[0].Prefix != netip.MustParsePrefix("2001:db8::/64") {
+		t.Fatal(entries)
+	}
+	// Remove is not widened, so the rest of the /24 keeps its source.
+	s.Remove(netip.MustParsePrefix("10.0.0.1/32"))
+	if entries := s.Explain(netip.MustParseAddr("10.0.0.1")); entries != nil {
+		t.Fatal(entries)
+	}
+	if entries := s.Explain(netip.MustParseAddr("10.0.0.200")); len(entries) != 1 {
+		t.Fatal(entries)
+	}
+}
+
+func TestIPSet_ExplainShared(t *testing.T) {
+	var s IPSet
+	s.AddWithSource(netip.MustParsePrefix("10.0.0.0/24"), Source{ID: "a"})
+	s.AddWithSource(netip.MustParsePrefix("2001:db8::/32"), Source{ID: "b"})
+	snap := s.Snapshot()
+	clone := s.Clone()
+	txn := s.Begin()
+	txn.Remove(netip.MustParsePrefix("10.0.0.0/8"))
+	txn.Rollback()
+	s.AddWithSource(netip.MustParsePrefix("10.0.0.0/24"), Source{ID: "c"})
+	snap.AddWithSource(netip.MustParsePrefix("10.0.0.0/24"), Source{ID: "d"})
+	clone.Remove(netip.MustParsePrefix("2001:db8::/32"))
+
+	explain := func(s *IPSet, addr string) (ids string) {
+		for _, e := range s.Explain(netip.MustParseAddr(addr)) {
+			ids += e.Source.ID
+		}
+		return
+	}
+	if ids := explain(&s, "10.0.0.1"); ids != "ac" {
+		t.Fatal(ids)
+	}
+	if ids := explain(snap, "10.0.0.1"); ids != "ad" {
+		t.Fatal(ids)
+	}
+	if ids := explain(clone, "10.0.0.1"); ids != "a" {
+		t.Fatal(ids)
+	}
+	if ids := explain(&s, "2001:db8::1"); ids != "b" {
+		t.Fatal(ids)
+	}
+	if ids := explain(clone, "2001:db8::1"); ids != "" {
+		t.Fatal(ids)
+	}
+	s.Remove(netip.MustParsePrefix("0.0.0.0/0"))
+	s.Remove(netip.MustParsePrefix("::/0"))
+	if !s.sources.isEmpty() {
+		t.Fatal("sources left after removing everything")
+	}
+	if ids := explain(snap, "2001:db8::1"); ids != "b" {
+		t.Fatal(ids)
+	}
+}
@@ -0,0 +1,247 @@
+package ipset
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+	"math/rand"
+)
+
+// buildCounts fills the counts cache if it's not up-to-date. The address length is defined by bits (32 or 128).
+// The count for a set that covers the whole IPv6 address space wraps around to 0.
+func (s *ipsetBase) buildCounts(bits uint32) {
+	if s.counts != nil || len(s.nodes) < 2 {
+		return
+	}
+	s.counts = make([]uint128, (len(s.nodes)+1)/2)
+	s.total = s.countSlot(s.rootSlot(), 0, bits, true)
+}
+
+// countSlot returns the number of addresses in the subtree referenced from the slot. If store is true, the counts
+// of the left subtrees of the regular nodes are stored in the cache.
+func (s *ipsetBase) countSlot(slot, depth, bits uint32, store bool) (c uint128) {
+	ptr := s.nodes[slot]
+	switch {
+	case ptr == ptrAbsent:
+	case ptr == ptrPresent:
+		c = pow2(bits - depth)
+	case isSkipNode(ptr):
+		idx := ptrToIdx(ptr)
+		_, l := unpackPrefixLen(s.nodes[idx])
+		c = s.countSlot(idx+1, depth+l, bits, store)
+	default:
+		left := s.countSlot(ptr, depth+1, bits, store)
+		if store {
+			s.counts[ptr>>1] = left
+		}
+		c = left.add(s.countSlot(ptr+1, depth+1, bits, store))
+	}
+	return
+}
+
+// count returns the number of addresses in the set. The second return value is false if the set is empty.
+// Unlike nthAddr and rank, it does not build the cache.
+func (s *ipsetBase) count(bits uint32) (uint128, bool) {
+	if s.isEmpty() {
+		return uint128{}, false
+	}
+	if s.counts != nil {
+		return s.total, true
+	}
+	return s.countSlot(s.rootSlot(), 0, bits, false), true
+}
+
+// nthAddr returns the k-th (starting from 0) address of the set in ascending order.
+func (s *ipsetBase) nthAddr(k uint128, bits uint32) (addr ipPrefix, ok bool) {
+	s.buildCounts(bits)
+	total, nonEmpty := s.count(bits)
+	if !nonEmpty || !total.isZero() && k.cmp(total) >= 0 {
+		return
+	}
+	slot, depth := s.rootSlot(), uint32(0)
+	for {
+		ptr := s.nodes[slot]
+		switch {
+		case ptr == ptrAbsent:
+			return
+		case ptr == ptrPresent:
+			return addr.withSuffix(k, bits), true
+		case isSkipNode(ptr):
+			idx := ptrToIdx(ptr)
+			p, l := unpackPrefixLen(s.nodes[idx])
+			addr = addr.withChunk(p, depth)
+			depth += l
+			slot = idx + 1
+		default:
+			if left := s.counts[ptr>>1]; k.cmp(left) < 0 {
+				slot = ptr
+			} else {
+				k = k.sub(left)
+				addr = addr.withBit(depth)
+				slot = ptr + 1
+			}
+			depth++
+		}
+	}
+}
+
+// rank returns the index of the address within the set in ascending order. The second return value is false
+// if the address is not in the set.
+func (s *ipsetBase) rank(addr ipPrefix, bits uint32) (rank uint128, ok bool) {
+	s.buildCounts(bits)
+	if _, nonEmpty := s.count(bits); !nonEmpty {
+		return
+	}
+	slot, depth := s.rootSlot(), uint32(0)
+	for {
+		ptr := s.nodes[slot]
+		switch {
+		case ptr == ptrAbsent:
+			return uint128{}, false
+		case ptr == ptrPresent:
+			return rank.add(addr.suffix(depth, bits)), true
+		case isSkipNode(ptr):
+			idx := ptrToIdx(ptr)
+			p, l := unpackPrefixLen(s.nodes[idx])
+			mask := ^uint32(0) << (32 - l)
+			if p != addr.chunk(depth)&mask {
+				return uint128{}, false
+			}
+			depth += l
+			slot = idx + 1
+		default:
+			if addr.bit(depth) == 0 {
+				slot = ptr
+			} else {
+				rank = rank.add(s.counts[ptr>>1])
+				slot = ptr + 1
+			}
+			depth++
+		}
+	}
+}
+
+func randUint64(src rand.Source) uint64 {
+	if s64, ok := src.(rand.Source64); ok {
+		return s64.Uint64()
+	}
+	return uint64(src.Int63())<<1 ^ uint64(src.Int63())
+}
+
+// randUint128 returns a uniformly distributed random number in [0, n). If n is 0, the range is [0, 2^128).
+func randUint128(src rand.Source, n uint128) uint128 {
+	if n.isZero() {
+		return uint128{hi: randUint64(src), lo: randUint64(src)}
+	}
+	max := n.sub(uint128{lo: 1})
+	var mask uint128
+	if max.hi != 0 {
+		mask = uint128{hi: ^uint64(0) >> bits.LeadingZeros64(max.hi), lo: ^uint64(0)}
+	} else {
+		mask = uint128{lo: ^uint64(0) >> bits.LeadingZeros64(max.lo)}
+	}
+	for {
+		v := uint128{hi: randUint64(src) & mask.hi, lo: randUint64(src) & mask.lo}
+		if v.cmp(n) < 0 {
+			return v
+		}
+	}
+}
+
+// Count returns the number of addresses in the set. It takes time proportional to the size of the tree unless
+// the counts have been cached by NthAddr, Rank, RandomAddr or SplitPrefixes. It does not modify the set, so it may
+// be called concurrently with other methods that do not modify the set, except for the ones that cache the counts.
+func (s *IPSet4) Count() uint64 {
+	c, _ := s.count(32)
+	return c.lo
+}
+
+// NthAddr returns the k-th (starting from 0) address of the set in ascending order. The second return value is
+// false if k is not less than the number of addresses in the set.
+// The first call after the set is modified counts the addresses in each subtree, which takes time proportional
+// to the size of the tree, the subsequent calls take time proportional to the tree depth. The counts are cached
+// in the set until it is modified, which takes 16 bytes per node (twice the size of the tree). Because of this,
+// the method must not be called concurrently with the methods that modify the set or use the counts (Count,
+// NthAddr, Rank, RandomAddr, Split and SplitPrefixes). The other read-only methods, such as Contains and Iterate,
+// do not use the counts and may be called concurrently with it.
+func (s *IPSet4) NthAddr(k uint64) (uint32, bool) {
+	addr, ok := s.nthAddr(uint128{lo: k}, 32)
+	return addr.hi32(), ok
+}
+
+// Rank returns the index of the address within the set in ascending order, i.e. the number of addresses in the
+// set that are lower than ip. The second return value is false if the address is not in the set.
+// Like NthAddr, it caches the counts in the set, see NthAddr regarding the concurrency.
+func (s *IPSet4) Rank(ip uint32) (uint64, bool) {
+	r, ok := s.rank(ipPrefixFromIP4Addr(ip), 32)
+	return r.lo, ok
+}
+
+// RandomAddr returns a random address from the set, every address having the same probability.
+// The second return value is false if the set is empty.
+// Like NthAddr, it caches the counts in the set, see NthAddr regarding the concurrency.
+func (s *IPSet4) RandomAddr(src rand.Source) (uint32, bool) {
+	s.buildCounts(32)
+	total, nonEmpty := s.count(32)
+	if !nonEmpty {
+		return 0, false
+	}
+	return s.NthAddr(randUint128(src, total).lo)
+}
+
+// Count returns the number of addresses in the set.
+// See IPSet4.Count regarding the performance and concurrency.
+func (s *IPSet6) Count() *big.Int {
+	c, nonEmpty := s.count(128)
+	if nonEmpty && c.isZero() {
+		// The whole address space
+		return new(big.Int).Lsh(big.NewInt(1), 128)
+	}
+	return c.big()
+}
+
+// NthAddr returns the k-th (starting from 0) address of the set in ascending order. It caches the counts in
+// the set, see IPSet4.NthAddr regarding the concurrency and for more details.
+func (s *IPSet6) NthAddr(k *big.Int) (addr [16]byte, ok bool) {
+	k1, ok := uint128FromBig(k)
+	if !ok {
+		return
+	}
+	p, ok := s.nthAddr(k1, 128)
+	if ok {
+		addr = ip6AddrFromIPPrefix(p)
+	}
+	return
+}
+
+// Rank returns the index of the address within the set in ascending order. It caches the counts in the set, see
+// IPSet4.NthAddr regarding the concurrency. See IPSet4.Rank for more details.
+func (s *IPSet6) Rank(addr [16]byte) (*big.Int, bool) {
+	r, ok := s.rank(ipPrefixFromIP6Addr(addr), 128)
+	if !ok {
+		return nil, false
+	}
+	return r.big(), true
+}
+
+// RandomAddr returns a random address from the set, every address having the same probability. It caches
+// the counts in the set, see IPSet4.NthAddr regarding the concurrency.
+// See IPSet4.RandomAddr for more details.
+func (s *IPSet6) RandomAddr(src rand.Source) (addr [16]byte, ok bool) {
+	s.buildCounts(128)
+	total, nonEmpty := s.count(128)
+	if !nonEmpty {
+		return
+	}
+	p, ok := s.nthAddr(randUint128(src, total), 128)
+	if ok {
+		addr = ip6AddrFromIPPrefix(p)
+	}
+	return
+}
+
+func ip6AddrFromIPPrefix(p ipPrefix) (addr [16]byte) {
+	binary.BigEndian.PutUint64(addr[:8], p.hi)
+	binary.BigEndian.PutUint64(addr[8:], p.lo)
+	return
+}
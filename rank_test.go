@@ -0,0 +1,195 @@
+package ipset
+
+import (
+	"math/big"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"testing"
+)
+
+func TestIPSet4_NthAddr(t *testing.T) {
+	var s IPSet4
+	s.Add(0x0A00_0000, 30)
+	s.Add(0x0A00_0100, 31)
+	s.Add(0xC0A8_0001, 32)
+
+	if c := s.Count(); c != 7 {
+		t.Fatal(c)
+	}
+	for k, expected := range []uint32{
+		0x0A00_0000, 0x0A00_0001, 0x0A00_0002, 0x0A00_0003, 0x0A00_0100, 0x0A00_0101, 0xC0A8_0001,
+	} {
+		addr, ok := s.NthAddr(uint64(k))
+		if !ok || addr != expected {
+			t.Fatal(k, addr, ok)
+		}
+		r, ok := s.Rank(expected)
+		if !ok || r != uint64(k) {
+			t.Fatal(k, r, ok)
+		}
+	}
+	if _, ok := s.NthAddr(7); ok {
+		t.Fatal()
+	}
+	if _, ok := s.Rank(0x0A00_0005); ok {
+		t.Fatal()
+	}
+
+	// The counts must be updated after modification
+	s.Add(0x0900_0000, 32)
+	if addr, ok := s.NthAddr(0); !ok || addr != 0x0900_0000 {
+		t.Fatal(addr, ok)
+	}
+	if r, ok := s.Rank(0xC0A8_0001); !ok || r != 7 {
+		t.Fatal(r, ok)
+	}
+
+	var empty IPSet4
+	if _, ok := empty.NthAddr(0); ok {
+		t.Fatal()
+	}
+	if _, ok := empty.RandomAddr(rand.NewSource(1)); ok {
+		t.Fatal()
+	}
+
+	var all IPSet4
+	all.Add(0, 0)
+	if c := all.Count(); c != 1<<32 {
+		t.Fatal(c)
+	}
+	if addr, ok := all.NthAddr(1<<32 - 1); !ok || addr != 0xFFFF_FFFF {
+		t.Fatal(addr, ok)
+	}
+}
+
+func TestIPSet4_NthAddrRandom(t *testing.T) {
+	rs := rand.New(rand.NewSource(12345678901234567))
+	var s IPSet4
+	for i := 0; i < 200; i++ {
+		s.Add(rs.Uint32(), uint32(26+rs.Intn(7)))
+	}
+	var addrs []uint32
+	s.Iterate(func(p netip.Prefix) bool {
+		a := ipToUint(p.Addr().As4())
+		for i := uint32(0); i < 1<<(32-p.Bits()); i++ {
+			addrs = append(addrs, a+i)
+		}
+		return true
+	})
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i] < addrs[j]
+	})
+	if c := s.Count(); c != uint64(len(addrs)) {
+		t.Fatal(c, len(addrs))
+	}
+	for k, expected := range addrs {
+		addr, ok := s.NthAddr(uint64(k))
+		if !ok || addr != expected {
+			t.Fatal(k, addr, expected)
+		}
+		r, ok := s.Rank(expected)
+		if !ok || r != uint64(k) {
+			t.Fatal(k, r)
+		}
+	}
+}
+
+func TestIPSet4_RandomAddr(t *testing.T) {
+	var s IPSet4
+	s.Add(0x0A00_0000, 24)
+	s.Add(0xC0A8_0000, 30)
+
+	src := rand.NewSource(12345678901234567)
+	hits := 0
+	const n = 26_000
+	for i := 0; i < n; i++ {
+		addr, ok := s.RandomAddr(src)
+		if !ok || !s.Contains(addr) {
+			t.Fatal(addr)
+		}
+		if addr>>8 == 0xC0A800 {
+			hits++
+		}
+	}
+	// The expected number of hits is n*4/260 = 400
+	if hits < 320 || hits > 480 {
+		t.Fatal(hits)
+	}
+}
+
+func TestIPSet6_NthAddr(t *testing.T) {
+	var s IPSet6
+	s.Add(netip.MustParseAddr("2001:db8::").As16(), 64)
+	s.Add(netip.MustParseAddr("2001:db9::1").As16(), 128)
+
+	count := new(big.Int).Lsh(big.NewInt(1), 64)
+	count.Add(count, big.NewInt(1))
+	if c := s.Count(); c.Cmp(count) != 0 {
+		t.Fatal(c)
+	}
+
+	k := new(big.Int).Lsh(big.NewInt(1), 64)
+	addr, ok := s.NthAddr(k)
+	if !ok || netip.AddrFrom16(addr) != netip.MustParseAddr("2001:db9::1") {
+		t.Fatal(netip.AddrFrom16(addr), ok)
+	}
+	r, ok := s.Rank(netip.MustParseAddr("2001:db8::ffff:ffff:ffff:ffff").As16())
+	if !ok || r.Cmp(k.Sub(k, big.NewInt(1))) != 0 {
+		t.Fatal(r, ok)
+	}
+	if _, ok := s.NthAddr(count); ok {
+		t.Fatal()
+	}
+
+	src := rand.NewSource(1)
+	for i := 0; i < 100; i++ {
+		addr, ok := s.RandomAddr(src)
+		if !ok || !s.Contains(addr) {
+			t.Fatal(netip.AddrFrom16(addr))
+		}
+	}
+
+	var all IPSet6
+	all.Add([16]byte{}, 0)
+	if c := all.Count(); c.BitLen() != 129 {
+		t.Fatal(c)
+	}
+	last := new(big.Int).Lsh(big.NewInt(1), 128)
+	last.Sub(last, big.NewInt(1))
+	addr, ok = all.NthAddr(last)
+	if !ok || netip.AddrFrom16(addr) != netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff") {
+		t.Fatal(netip.AddrFrom16(addr), ok)
+	}
+	if r, ok := all.Rank(addr); !ok || r.Cmp(last) != 0 {
+		t.Fatal(r, ok)
+	}
+	if _, ok := all.RandomAddr(src); !ok {
+		t.Fatal()
+	}
+}
+
+func TestCountDoesNotCache(t *testing.T) {
+	rs := rand.New(rand.NewSource(3))
+	var s IPSet4
+	for i := 0; i < 1000; i++ {
+		s.Add(rs.Uint32(), uint32(8+rs.Intn(25)))
+	}
+	c := s.Count()
+	if s.counts != nil {
+		t.Fatal("Count built the cache")
+	}
+	if _, ok := s.NthAddr(0); !ok {
+		t.Fatal()
+	}
+	if len(s.counts) > (len(s.nodes)+1)/2 {
+		t.Fatal(len(s.counts), len(s.nodes))
+	}
+	if s.Count() != c {
+		t.Fatal(s.Count(), c)
+	}
+	s.Compact()
+	if s.counts != nil {
+		t.Fatal("Compact did not release the cache")
+	}
+}
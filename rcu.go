@@ -0,0 +1,123 @@
+package ipset
+
+import (
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// rcuReclaimThreshold is the number of retired nodes after which an update waits for the readers to finish
+// and reuses the nodes.
+const rcuReclaimThreshold = 4096
+
+// retireNode puts the subtree to the retired list.
+func (s *ipsetBase) retireNode(ptr uint32) {
+	if ptr <= ptrPresent {
+		return
+	}
+	idx := ptrToIdx(ptr)
+	s.retired = append(s.retired, idx)
+	s.retireNode(s.nodes[idx+1])
+	if !isSkipNode(ptr) {
+		s.retireNode(s.nodes[idx])
+	}
+}
+
+// reclaim moves the retired nodes to the free list. It must only be called when no snapshot that could refer to
+// them is in use.
+func (s *ipsetBase) reclaim() {
+	s.freeList = append(s.freeList, s.retired...)
+	s.retired = s.retired[:0]
+}
+
+// RCUIPSet is an IP set with a single writer and multiple readers that never wait for the writer.
+//
+// The writer modifies a private copy of the set (copying the paths that are shared with the readers, see
+// IPSet.Snapshot) and publishes a new snapshot with an atomic store after each update. The nodes that become
+// unreachable are retired and only reused after all readers that could have seen them have finished, which is
+// tracked using two reader counters and an epoch (the parity of which selects the counter).
+//
+// The zero value is an empty set ready to use.
+type RCUIPSet struct {
+	mu     sync.Mutex
+	writer IPSet
+	cur    atomic.Pointer[IPSet]
+
+	epoch   atomic.Uint32
+	readers [2]atomic.Int64
+}
+
+// Read calls fn with the current version of the set. The set must not be modified or retained after fn returns,
+// and the methods that update internal caches (such as NthAddr) must not be called. Until fn returns, the nodes
+// it can see are not reused, so it should not take long.
+func (s *RCUIPSet) Read(fn func(set *IPSet)) {
+	counter := &s.readers[s.epoch.Load()&1]
+	counter.Add(1)
+	defer counter.Add(-1)
+	set := s.cur.Load()
+	if set == nil {
+		set = &IPSet{}
+	}
+	fn(set)
+}
+
+// Contains returns true if the address is in the set. It never waits for the writer.
+func (s *RCUIPSet) Contains(addr netip.Addr) bool {
+	counter := &s.readers[s.epoch.Load()&1]
+	counter.Add(1)
+	set := s.cur.Load()
+	res := set != nil && set.Contains(addr)
+	counter.Add(-1)
+	return res
+}
+
+// Update calls fn with the writer's copy of the set and publishes the result, so that a batch of changes becomes
+// visible to the readers at once. The set must not be retained after fn returns. Updates are serialised.
+func (s *RCUIPSet) Update(fn func(set *IPSet)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writer.s4.trackRetired = true
+	s.writer.s6.trackRetired = true
+	fn(&s.writer)
+	s.cur.Store(s.writer.Snapshot())
+	if len(s.writer.s4.retired)+len(s.writer.s6.retired) >= rcuReclaimThreshold {
+		s.synchronize()
+	}
+}
+
+// Add adds the prefix to the set and publishes the new version.
+func (s *RCUIPSet) Add(prefix netip.Prefix) {
+	s.Update(func(set *IPSet) {
+		set.Add(prefix)
+	})
+}
+
+// Remove removes the prefix from the set and publishes the new version.
+func (s *RCUIPSet) Remove(prefix netip.Prefix) {
+	s.Update(func(set *IPSet) {
+		set.Remove(prefix)
+	})
+}
+
+// Synchronize waits until all readers that could see the retired nodes have finished and makes the nodes
+// available for reuse. It is called automatically when the number of retired nodes becomes large.
+func (s *RCUIPSet) Synchronize() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.synchronize()
+}
+
+func (s *RCUIPSet) synchronize() {
+	// A reader may have loaded the epoch before it was flipped and incremented the counter after, so both counters
+	// are drained: each of them after a flip, so that the new readers use the other one.
+	for i := 0; i < 2; i++ {
+		e := s.epoch.Add(1)
+		counter := &s.readers[(e-1)&1]
+		for counter.Load() != 0 {
+			runtime.Gosched()
+		}
+	}
+	s.writer.s4.reclaim()
+	s.writer.s6.reclaim()
+}
@@ -0,0 +1,103 @@
+package ipset
+
+import (
+	"math/rand"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRCUIPSet(t *testing.T) {
+	var s RCUIPSet
+	if s.Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal()
+	}
+	s.Add(netip.MustParsePrefix("10.0.0.0/24"))
+	s.Update(func(set *IPSet) {
+		set.Add(netip.MustParsePrefix("2001:db8::/32"))
+		set.Remove(netip.MustParsePrefix("10.0.0.0/25"))
+	})
+	if s.Contains(netip.MustParseAddr("10.0.0.1")) || !s.Contains(netip.MustParseAddr("10.0.0.129")) ||
+		!s.Contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Fatal()
+	}
+	var list []netip.Prefix
+	s.Read(func(set *IPSet) {
+		list = prefixList(set)
+	})
+	if len(list) != 2 {
+		t.Fatal(list)
+	}
+}
+
+func TestRCUIPSetConcurrent(t *testing.T) {
+	var s RCUIPSet
+	permanent := netip.MustParsePrefix("192.168.0.0/24")
+	s.Add(permanent)
+
+	stop := make(chan struct{})
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rs := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if !s.Contains(addrFrom4(0xC0A8_0000 | rs.Uint32()&0xFF)) {
+					failed.Store(true)
+				}
+				if s.Contains(addrFrom4(0xAC10_0000 | rs.Uint32()&0xFFFFF)) {
+					failed.Store(true)
+				}
+				s.Contains(addrFrom4(0x0A00_0000 | rs.Uint32()&0xFFFF))
+			}
+		}(int64(i))
+	}
+
+	rs := rand.New(rand.NewSource(12345678901234567))
+	var ref IPSet
+	ref.Add(permanent)
+	maxLen := 0
+	for i := 0; i < 20000; i++ {
+		p := netip.PrefixFrom(addrFrom4(0x0A00_0000|rs.Uint32()&0xFFFF), 16+rs.Intn(17)).Masked()
+		if rs.Intn(2) == 0 {
+			s.Remove(p)
+			ref.Remove(p)
+		} else {
+			s.Add(p)
+			ref.Add(p)
+		}
+		if i >= 10000 && len(s.writer.s4.nodes) > maxLen {
+			maxLen = len(s.writer.s4.nodes)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if failed.Load() {
+		t.Fatal("readers observed an inconsistent state")
+	}
+
+	var res IPSet
+	s.Read(func(set *IPSet) {
+		for _, p := range prefixList(set) {
+			res.Add(p)
+		}
+	})
+	assertSameSet(t, &res, &ref)
+
+	// The retired nodes are reused, so the storage does not grow indefinitely
+	s.Synchronize()
+	if l := len(s.writer.s4.nodes); l > maxLen+2*rcuReclaimThreshold {
+		t.Fatal(l, maxLen)
+	}
+	if len(s.writer.s4.freeList) == 0 {
+		t.Fatal()
+	}
+}
@@ -0,0 +1,108 @@
+package ipset
+
+import (
+	"io"
+	"net/netip"
+)
+
+// lookup returns the length of the prefix in the tree containing the address. On error, it returns false and
+// r.err is set.
+func (r *nodeReader) lookup(addr ipPrefix, bits uint32) (prefixLen uint32, found bool) {
+	ptr := r.rootRef().ptr
+	for r.err == nil {
+		if ptr == ptrPresent {
+			return prefixLen, true
+		}
+		if ptr == ptrAbsent {
+			return 0, false
+		}
+		v1, v2 := r.node(ptrToIdx(ptr))
+		if r.err != nil {
+			break
+		}
+		if !isSkipNode(ptr) {
+			if prefixLen >= bits {
+				r.err = ErrInvalidFormat
+				break
+			}
+			ptr = v1
+			if addr.hi32()>>31 != 0 {
+				ptr = v2
+			}
+			addr.shl(1)
+			prefixLen++
+			continue
+		}
+		prefix, l := r.skipPrefix(v1)
+		if l == 0 {
+			break
+		}
+		if prefixLen+l > bits {
+			r.err = ErrInvalidFormat
+			break
+		}
+		if prefix != addr.hi32()&(^uint32(0)<<(32-l)) {
+			return 0, false
+		}
+		addr.shl(l)
+		prefixLen += l
+		ptr = v2
+	}
+	return 0, false
+}
+
+// IPSetReaderAt answers queries about a set serialized by IPSet.Serialize without loading it into memory. The nodes
+// are read on demand from the underlying io.ReaderAt and a small number of recently used pages is cached.
+// The results are the same as with a deserialized set on hosts of any byte order.
+//
+// It is safe for concurrent use. The queries only wait for each other when they need the same slot of the page
+// cache.
+type IPSetReaderAt struct {
+	s4, s6 *nodeFile
+}
+
+// NewIPSetReaderAt opens a serialized set. Only the headers and the root pointers are read, so a malformed set may
+// only be detected by subsequent queries.
+func NewIPSetReaderAt(r io.ReaderAt) (*IPSetReaderAt, error) {
+	off, err := metadataSize(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	s4, off, err := openNodeFile(r, off)
+	if err != nil {
+		return nil, err
+	}
+	s6, _, err := openNodeFile(r, off)
+	if err != nil {
+		return nil, err
+	}
+	return &IPSetReaderAt{s4: s4, s6: s6}, nil
+}
+
+// Lookup returns the prefix of the set that contains the address, i.e. the one that IPSet.Iterate would return.
+// IPv4-mapped IPv6 addresses are treated as IPv4.
+func (s *IPSetReaderAt) Lookup(addr netip.Addr) (prefix netip.Prefix, found bool, err error) {
+	if !addr.IsValid() {
+		return
+	}
+	p, bits := ipPrefixFromAddr(addr)
+	f := s.s6
+	if bits == 32 {
+		f = s.s4
+	}
+	r := nodeReader{f: f}
+	prefixLen, found := r.lookup(p, bits)
+	if r.err != nil {
+		return netip.Prefix{}, false, r.err
+	}
+	if found {
+		prefix = p.toNetip(prefixLen, bits).Masked()
+	}
+	return
+}
+
+// Contains returns true if the address is in the set.
+func (s *IPSetReaderAt) Contains(addr netip.Addr) (bool, error) {
+	_, found, err := s.Lookup(addr)
+	return found, err
+}
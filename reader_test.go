@@ -0,0 +1,182 @@
+package ipset
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+func TestIPSetReaderAt(t *testing.T) {
+	var s IPSet
+	rs := rand.New(rand.NewSource(42))
+	for i := 0; i < 20000; i++ {
+		s.Add(netip.PrefixFrom(addrFrom4(rs.Uint32()), 8+rs.Intn(25)).Masked())
+	}
+	for i := 0; i < 1000; i++ {
+		var a [16]byte
+		rs.Read(a[:])
+		a[0] = 0x20
+		s.Add(netip.PrefixFrom(netip.AddrFrom16(a), 8+rs.Intn(121)).Masked())
+	}
+	var buf bytes.Buffer
+	if err := s.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	cr := &countingReaderAt{r: bytes.NewReader(buf.Bytes())}
+	r, err := NewIPSetReaderAt(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list []netip.Prefix
+	stored := make(map[netip.Prefix]bool)
+	s.Iterate(func(p netip.Prefix) bool {
+		list = append(list, p)
+		stored[p] = true
+		return true
+	})
+	check := func(addr netip.Addr) {
+		prefix, found, err := r.Lookup(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != s.Contains(addr) {
+			t.Fatal(addr)
+		}
+		if found && (!prefix.Contains(addr.Unmap()) || !stored[prefix]) {
+			t.Fatal(addr, prefix)
+		}
+	}
+	for i := 0; i < 10000; i++ {
+		var a [16]byte
+		rs.Read(a[:])
+		check(netip.AddrFrom16(a))
+		check(netip.AddrFrom4([4]byte{a[0], a[1], a[2], a[3]}))
+		check(netip.AddrFrom16([16]byte{10: 0xff, 11: 0xff, 12: a[0], 13: a[1], 14: a[2], 15: a[3]}))
+		p := list[rs.Intn(len(list))]
+		check(p.Addr())
+		check(lastAddr(p))
+		check(p.Addr().Prev())
+		check(lastAddr(p).Next())
+	}
+
+	// Hot pages are cached
+	addr := list[len(list)/2].Addr()
+	r.Contains(addr)
+	reads := cr.reads
+	for i := 0; i < 100; i++ {
+		if ok, err := r.Contains(addr); !ok || err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cr.reads != reads {
+		t.Fatal(cr.reads - reads)
+	}
+
+}
+
+func TestIPSetReaderAtFirstPage(t *testing.T) {
+	var s IPSet
+	rs := rand.New(rand.NewSource(44))
+	for i := 0; i < 20000; i++ {
+		s.Add(netip.PrefixFrom(addrFrom4(rs.Uint32()), 32))
+	}
+	cr := &countingReaderAt{r: serialized(t, &s)}
+	r, err := NewIPSetReaderAt(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.s4.n*4 <= nodePageSlots*nodePageSize {
+		t.Fatal(r.s4.n)
+	}
+	// The pages that map to the same slot do not evict the first page.
+	for no := uint32(0); no*nodePageSize < r.s4.n*4; no += nodePageSlots {
+		if _, _, err := r.s4.read(no * nodePageSize / 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reads := cr.reads
+	if _, _, err := r.s4.read(2); err != nil || cr.reads != reads {
+		t.Fatal(err, cr.reads-reads)
+	}
+}
+
+func TestIPSetReaderAtInvalid(t *testing.T) {
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	s.Add(netip.MustParsePrefix("192.168.0.0/16"))
+	s.Add(netip.MustParsePrefix("2001:db8::/32"))
+	var buf bytes.Buffer
+	if err := s.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	if _, err := NewIPSetReaderAt(bytes.NewReader(b[:4])); err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+	r, err := NewIPSetReaderAt(bytes.NewReader(b[:len(b)-4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.Contains(netip.MustParseAddr("10.0.0.1")); !ok || err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Contains(netip.MustParseAddr("2001:db8::1")); err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+
+	b1 := append([]byte(nil), b...)
+	b1[4] = 0xFE
+	r, err = NewIPSetReaderAt(bytes.NewReader(b1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Contains(netip.MustParseAddr("10.0.0.1")); err != ErrInvalidFormat {
+		t.Fatal(err)
+	}
+	if ok, err := r.Contains(netip.MustParseAddr("2001:db8::1")); !ok || err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIPSetReaderAtConcurrent(t *testing.T) {
+	var s IPSet
+	rs := rand.New(rand.NewSource(43))
+	for i := 0; i < 20000; i++ {
+		s.Add(netip.PrefixFrom(addrFrom4(rs.Uint32()), 8+rs.Intn(25)).Masked())
+	}
+	r, err := NewIPSetReaderAt(serialized(t, &s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		go func(seed int64) {
+			defer func() { done <- struct{}{} }()
+			rs := rand.New(rand.NewSource(seed))
+			for i := 0; i < 2000; i++ {
+				addr := addrFrom4(rs.Uint32())
+				if ok, err := r.Contains(addr); err != nil || ok != s.Contains(addr) {
+					t.Error(addr, err)
+					return
+				}
+			}
+		}(int64(g))
+	}
+	for g := 0; g < 4; g++ {
+		<-done
+	}
+}
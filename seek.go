@@ -0,0 +1,198 @@
+package ipset
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// seek looks for the nearest address not lower (forward) or not higher (!forward) than addr which is within
+// a leaf of the specified type (ptrPresent or ptrAbsent). prefix holds the bits consumed so far. If tight is true,
+// the path to r matches addr, otherwise it lies entirely above (forward) or below (!forward) addr.
+func (s *ipsetBase) seek(r nodeRef, addr, prefix ipPrefix, depth, bits, want uint32,
+	forward, tight bool) (ipPrefix, bool) {
+	if r.ptr == want {
+		switch {
+		case tight:
+			return addr, true
+		case forward:
+			return prefix, true
+		default:
+			return prefix.withSuffix(pow2(bits-depth).sub(uint128{lo: 1}), bits), true
+		}
+	}
+	if r.isLeaf() {
+		return ipPrefix{}, false
+	}
+	left, right := s.children(r)
+	leftPrefix, rightPrefix := prefix, prefix.withBit(depth)
+	if tight {
+		if addr.bit(depth) == 0 {
+			if res, ok := s.seek(left, addr, leftPrefix, depth+1, bits, want, forward, true); ok || !forward {
+				return res, ok
+			}
+			return s.seek(right, addr, rightPrefix, depth+1, bits, want, true, false)
+		}
+		if res, ok := s.seek(right, addr, rightPrefix, depth+1, bits, want, forward, true); ok || forward {
+			return res, ok
+		}
+		return s.seek(left, addr, leftPrefix, depth+1, bits, want, false, false)
+	}
+	if forward {
+		if res, ok := s.seek(left, addr, leftPrefix, depth+1, bits, want, true, false); ok {
+			return res, ok
+		}
+		return s.seek(right, addr, rightPrefix, depth+1, bits, want, true, false)
+	}
+	if res, ok := s.seek(right, addr, rightPrefix, depth+1, bits, want, false, false); ok {
+		return res, ok
+	}
+	return s.seek(left, addr, leftPrefix, depth+1, bits, want, false, false)
+}
+
+func (s *ipsetBase) nextIn(addr ipPrefix, bits uint32) (ipPrefix, bool) {
+	return s.seek(s.rootRef(), addr, ipPrefix{}, 0, bits, ptrPresent, true, true)
+}
+
+func (s *ipsetBase) prevIn(addr ipPrefix, bits uint32) (ipPrefix, bool) {
+	return s.seek(s.rootRef(), addr, ipPrefix{}, 0, bits, ptrPresent, false, true)
+}
+
+func (s *ipsetBase) nextNotIn(addr ipPrefix, bits uint32) (ipPrefix, bool) {
+	return s.seek(s.rootRef(), addr, ipPrefix{}, 0, bits, ptrAbsent, true, true)
+}
+
+// iterateFrom calls the step function for each prefix that contains or follows addr. See seek for the meaning
+// of prefix and tight.
+func (s *ipsetBase) iterateFrom(step IterStepFunc, r nodeRef, addr, prefix ipPrefix, depth, bits uint32,
+	tight bool) bool {
+	if r.ptr == ptrAbsent {
+		return true
+	}
+	if r.ptr == ptrPresent {
+		return step(prefix.toNetip(depth, bits))
+	}
+	left, right := s.children(r)
+	if tight && addr.bit(depth) == 1 {
+		return s.iterateFrom(step, right, addr, prefix.withBit(depth), depth+1, bits, true)
+	}
+	return s.iterateFrom(step, left, addr, prefix, depth+1, bits, tight) &&
+		s.iterateFrom(step, right, addr, prefix.withBit(depth), depth+1, bits, false)
+}
+
+// NextIn returns the lowest address in the set that is not lower than ip. The second return value is false
+// if there is no such address.
+func (s *IPSet4) NextIn(ip uint32) (uint32, bool) {
+	p, ok := s.nextIn(ipPrefixFromIP4Addr(ip), 32)
+	return p.hi32(), ok
+}
+
+// PrevIn returns the highest address in the set that is not higher than ip. The second return value is false
+// if there is no such address.
+func (s *IPSet4) PrevIn(ip uint32) (uint32, bool) {
+	p, ok := s.prevIn(ipPrefixFromIP4Addr(ip), 32)
+	return p.hi32(), ok
+}
+
+// NextNotIn returns the lowest address that is not lower than ip and is not in the set. The second return value
+// is false if there is no such address.
+func (s *IPSet4) NextNotIn(ip uint32) (uint32, bool) {
+	p, ok := s.nextNotIn(ipPrefixFromIP4Addr(ip), 32)
+	return p.hi32(), ok
+}
+
+// IterateFrom is like Iterate, but it starts from the prefix that contains ip, or the first prefix that follows
+// it if ip is not in the set. The prefix that contains ip is passed to the step function as a whole.
+// The tree is not traversed from the root, only the nodes along the path to ip and the ones that follow are
+// visited.
+func (s *IPSet4) IterateFrom(ip uint32, step IterStepFunc) bool {
+	return s.iterateFrom(step, s.rootRef(), ipPrefixFromIP4Addr(ip), ipPrefix{}, 0, 32, true)
+}
+
+// NextIn returns the lowest address in the set that is not lower than addr.
+// See IPSet4.NextIn for more details.
+func (s *IPSet6) NextIn(addr [16]byte) ([16]byte, bool) {
+	p, ok := s.nextIn(ipPrefixFromIP6Addr(addr), 128)
+	return ip6AddrFromIPPrefix(p), ok
+}
+
+// PrevIn returns the highest address in the set that is not higher than addr.
+// See IPSet4.PrevIn for more details.
+func (s *IPSet6) PrevIn(addr [16]byte) ([16]byte, bool) {
+	p, ok := s.prevIn(ipPrefixFromIP6Addr(addr), 128)
+	return ip6AddrFromIPPrefix(p), ok
+}
+
+// NextNotIn returns the lowest address that is not lower than addr and is not in the set.
+// See IPSet4.NextNotIn for more details.
+func (s *IPSet6) NextNotIn(addr [16]byte) ([16]byte, bool) {
+	p, ok := s.nextNotIn(ipPrefixFromIP6Addr(addr), 128)
+	return ip6AddrFromIPPrefix(p), ok
+}
+
+// IterateFrom is like Iterate, but it starts from the prefix that contains addr.
+// See IPSet4.IterateFrom for more details.
+func (s *IPSet6) IterateFrom(addr [16]byte, step IterStepFunc) bool {
+	return s.iterateFrom(step, s.rootRef(), ipPrefixFromIP6Addr(addr), ipPrefix{}, 0, 128, true)
+}
+
+func addrFrom4(ip uint32) netip.Addr {
+	var a [4]byte
+	binary.BigEndian.PutUint32(a[:], ip)
+	return netip.AddrFrom4(a)
+}
+
+// NextIn returns the lowest address in the set that is not lower than addr and belongs to the same address family.
+// IPv4-mapped IPv6 addresses are treated as IPv4. The second return value is false if there is no such address.
+func (s *IPSet) NextIn(addr netip.Addr) (netip.Addr, bool) {
+	if addr.Is4() || addr.Is4In6() {
+		a := addr.As4()
+		ip, ok := s.s4.NextIn(binary.BigEndian.Uint32(a[:]))
+		return addrFrom4(ip), ok
+	} else if addr.Is6() {
+		a, ok := s.s6.NextIn(addr.As16())
+		return netip.AddrFrom16(a), ok
+	}
+	return netip.Addr{}, false
+}
+
+// PrevIn returns the highest address in the set that is not higher than addr and belongs to the same address
+// family. See NextIn for more details.
+func (s *IPSet) PrevIn(addr netip.Addr) (netip.Addr, bool) {
+	if addr.Is4() || addr.Is4In6() {
+		a := addr.As4()
+		ip, ok := s.s4.PrevIn(binary.BigEndian.Uint32(a[:]))
+		return addrFrom4(ip), ok
+	} else if addr.Is6() {
+		a, ok := s.s6.PrevIn(addr.As16())
+		return netip.AddrFrom16(a), ok
+	}
+	return netip.Addr{}, false
+}
+
+// NextNotIn returns the lowest address of the same address family that is not lower than addr and is not
+// in the set. See NextIn for more details.
+func (s *IPSet) NextNotIn(addr netip.Addr) (netip.Addr, bool) {
+	if addr.Is4() || addr.Is4In6() {
+		a := addr.As4()
+		ip, ok := s.s4.NextNotIn(binary.BigEndian.Uint32(a[:]))
+		return addrFrom4(ip), ok
+	} else if addr.Is6() {
+		a, ok := s.s6.NextNotIn(addr.As16())
+		return netip.AddrFrom16(a), ok
+	}
+	return netip.Addr{}, false
+}
+
+// IterateFrom is like Iterate, but it starts from the prefix that contains addr, or the first prefix that follows
+// it. As with Iterate, IPv4 prefixes are followed by IPv6 ones, so if addr is an IPv4 address, the iteration
+// continues with all IPv6 prefixes. IPv4-mapped IPv6 addresses are treated as IPv4.
+// See IPSet4.IterateFrom for more details.
+func (s *IPSet) IterateFrom(addr netip.Addr, step IterStepFunc) bool {
+	if addr.Is4() || addr.Is4In6() {
+		a := addr.As4()
+		return s.s4.IterateFrom(binary.BigEndian.Uint32(a[:]), step) && s.s6.Iterate(step)
+	} else if addr.Is6() {
+		return s.s6.IterateFrom(addr.As16(), step)
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+package ipset
+
+import (
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+func TestIPSet4_NextIn(t *testing.T) {
+	var s IPSet4
+	s.Add(0x0A00_0010, 28)
+	s.Add(0x0A00_0040, 32)
+
+	if ip, ok := s.NextIn(0x0A00_0000); !ok || ip != 0x0A00_0010 {
+		t.Fatal(ip, ok)
+	}
+	if ip, ok := s.NextIn(0x0A00_0015); !ok || ip != 0x0A00_0015 {
+		t.Fatal(ip, ok)
+	}
+	if ip, ok := s.NextIn(0x0A00_0020); !ok || ip != 0x0A00_0040 {
+		t.Fatal(ip, ok)
+	}
+	if _, ok := s.NextIn(0x0A00_0041); ok {
+		t.Fatal()
+	}
+	if ip, ok := s.PrevIn(0x0A00_003F); !ok || ip != 0x0A00_001F {
+		t.Fatal(ip, ok)
+	}
+	if _, ok := s.PrevIn(0x0A00_000F); ok {
+		t.Fatal()
+	}
+	if ip, ok := s.NextNotIn(0x0A00_0010); !ok || ip != 0x0A00_0020 {
+		t.Fatal(ip, ok)
+	}
+	if ip, ok := s.NextNotIn(0x0A00_0040); !ok || ip != 0x0A00_0041 {
+		t.Fatal(ip, ok)
+	}
+
+	var all IPSet4
+	all.Add(0, 0)
+	if _, ok := all.NextNotIn(0); ok {
+		t.Fatal()
+	}
+	if ip, ok := all.PrevIn(0xFFFF_FFFF); !ok || ip != 0xFFFF_FFFF {
+		t.Fatal(ip, ok)
+	}
+
+	var empty IPSet4
+	if ip, ok := empty.NextNotIn(5); !ok || ip != 5 {
+		t.Fatal(ip, ok)
+	}
+	if _, ok := empty.NextIn(5); ok {
+		t.Fatal()
+	}
+}
+
+func TestIPSet4_NextInRandom(t *testing.T) {
+	rs := rand.New(rand.NewSource(12345678901234567))
+	var s IPSet4
+	for i := 0; i < 50; i++ {
+		s.Add(0x0A00_0000|rs.Uint32()&0x3FF, uint32(24+rs.Intn(9)))
+	}
+	for ip := uint32(0x0A00_0000) - 4; ip < 0x0A00_0404; ip++ {
+		next, nextOk := uint32(0), false
+		for a := ip; a < 0x0A00_0404; a++ {
+			if s.Contains(a) {
+				next, nextOk = a, true
+				break
+			}
+		}
+		if n, ok := s.NextIn(ip); ok != nextOk || n != next {
+			t.Fatal(ip, n, next)
+		}
+		prev, prevOk := uint32(0), false
+		for a := ip; a >= 0x0A00_0000-4; a-- {
+			if s.Contains(a) {
+				prev, prevOk = a, true
+				break
+			}
+		}
+		if p, ok := s.PrevIn(ip); ok != prevOk || p != prev {
+			t.Fatal(ip, p, prev)
+		}
+		notIn := ip
+		for s.Contains(notIn) {
+			notIn++
+		}
+		if n, ok := s.NextNotIn(ip); !ok || n != notIn {
+			t.Fatal(ip, n, notIn)
+		}
+	}
+}
+
+func TestIPSet4_IterateFrom(t *testing.T) {
+	rs := rand.New(rand.NewSource(12345678901234567))
+	var s IPSet4
+	for i := 0; i < 100; i++ {
+		s.Add(rs.Uint32(), uint32(8+rs.Intn(25)))
+	}
+	var all []netip.Prefix
+	s.Iterate(func(p netip.Prefix) bool {
+		all = append(all, p)
+		return true
+	})
+	for i := 0; i < 100; i++ {
+		ip := rs.Uint32()
+		addr := addrFrom4(ip)
+		var expected []netip.Prefix
+		for _, p := range all {
+			if p.Contains(addr) || p.Addr().Compare(addr) > 0 {
+				expected = append(expected, p)
+			}
+		}
+		var actual []netip.Prefix
+		s.IterateFrom(ip, func(p netip.Prefix) bool {
+			actual = append(actual, p)
+			return true
+		})
+		if len(actual) != len(expected) {
+			t.Fatal(ip, actual, expected)
+		}
+		for j := range actual {
+			if actual[j] != expected[j] {
+				t.Fatal(ip, actual, expected)
+			}
+		}
+	}
+}
+
+func TestIPSet_NextIn(t *testing.T) {
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/24"))
+	s.Add(netip.MustParsePrefix("2001:db8::/64"))
+	s.Add(netip.MustParsePrefix("2001:db8:1::/64"))
+
+	if a, ok := s.NextIn(netip.MustParseAddr("9.0.0.1")); !ok || a != netip.MustParseAddr("10.0.0.0") {
+		t.Fatal(a, ok)
+	}
+	if _, ok := s.NextIn(netip.MustParseAddr("10.0.1.0")); ok {
+		t.Fatal()
+	}
+	if a, ok := s.NextNotIn(netip.MustParseAddr("::ffff:10.0.0.5")); !ok || a != netip.MustParseAddr("10.0.1.0") {
+		t.Fatal(a, ok)
+	}
+	if a, ok := s.NextIn(netip.MustParseAddr("2001:db8:0:1::")); !ok || a != netip.MustParseAddr("2001:db8:1::") {
+		t.Fatal(a, ok)
+	}
+	if a, ok := s.PrevIn(netip.MustParseAddr("2001:db8:0:1::")); !ok ||
+		a != netip.MustParseAddr("2001:db8::ffff:ffff:ffff:ffff") {
+		t.Fatal(a, ok)
+	}
+	if a, ok := s.NextNotIn(netip.MustParseAddr("2001:db8::1")); !ok || a != netip.MustParseAddr("2001:db8:0:1::") {
+		t.Fatal(a, ok)
+	}
+
+	var list []string
+	s.IterateFrom(netip.MustParseAddr("10.0.0.1"), func(p netip.Prefix) bool {
+		list = append(list, p.String())
+		return true
+	})
+	if len(list) != 3 || list[0] != "10.0.0.0/24" || list[2] != "2001:db8:1::/64" {
+		t.Fatal(list)
+	}
+	list = list[:0]
+	s.IterateFrom(netip.MustParseAddr("2001:db8::5"), func(p netip.Prefix) bool {
+		list = append(list, p.String())
+		return false
+	})
+	if len(list) != 1 || list[0] != "2001:db8::/64" {
+		t.Fatal(list)
+	}
+}
@@ -0,0 +1,118 @@
+package ipset
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var signedMagic = [4]byte{'I', 'P', 'S', 'S'}
+
+// ErrTooLarge is returned by DeserializeVerified if the size of the serialized set exceeds the limit.
+var ErrTooLarge = errors.New("serialized set is too large")
+
+const signedHeaderSize = 28
+
+// VerificationError is returned by DeserializeVerified if the data is well-formed but cannot be trusted.
+type VerificationError struct {
+	Reason string
+}
+
+func (e *VerificationError) Error() string {
+	return "set verification failed: " + e.Reason
+}
+
+// SignatureInfo is the metadata covered by the signature.
+type SignatureInfo struct {
+	Version uint64
+	Created time.Time
+}
+
+// SerializeSigned writes the set like Serialize does, along with the metadata and an ed25519 signature.
+//
+// The data starts with the "IPSS" magic, followed by the version, the creation time (the current time, in
+// nanoseconds since the Unix epoch) and the length of the serialized set, all 64-bit little-endian. Then come
+// the serialized set and the signature of everything before it.
+//
+// The version should be increased every time the set is published, see DeserializeVerified.
+func (s *IPSet) SerializeSigned(w io.Writer, key ed25519.PrivateKey, version uint64) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, signedHeaderSize))
+	if err := s.Serialize(&buf); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	copy(b, signedMagic[:])
+	binary.LittleEndian.PutUint64(b[4:], version)
+	binary.LittleEndian.PutUint64(b[12:], uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint64(b[20:], uint64(len(b)-signedHeaderSize))
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	_, err := w.Write(ed25519.Sign(key, b))
+	return err
+}
+
+// DeserializeVerified reads a set written by SerializeSigned, replacing the contents of the set. It returns
+// a *VerificationError if the signature does not match the key or if the version is lower than minVersion, which
+// prevents an older set from being substituted for a newer one. The set is only modified if no error is returned.
+//
+// Since the length of the serialized set can only be trusted after the signature is checked, maxSize limits the
+// amount of data read and buffered: ErrTooLarge is returned if the header specifies a larger length.
+func (s *IPSet) DeserializeVerified(r io.Reader, key ed25519.PublicKey, minVersion uint64,
+	maxSize int64) (SignatureInfo, error) {
+	var hdr [signedHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return SignatureInfo{}, err
+	}
+	if !bytes.Equal(hdr[:4], signedMagic[:]) {
+		return SignatureInfo{}, ErrInvalidFormat
+	}
+	size := binary.LittleEndian.Uint64(hdr[20:])
+	if maxSize < 0 || size > uint64(maxSize) {
+		return SignatureInfo{}, ErrTooLarge
+	}
+	var buf bytes.Buffer
+	buf.Write(hdr[:])
+	if _, err := buf.ReadFrom(io.LimitReader(r, int64(size))); err != nil {
+		return SignatureInfo{}, err
+	}
+	msg := buf.Bytes()
+	if uint64(len(msg)-signedHeaderSize) != size {
+		return SignatureInfo{}, io.ErrUnexpectedEOF
+	}
+	sig := make([]byte, ed25519.SignatureSize)
+	if _, err := io.ReadFull(r, sig); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return SignatureInfo{}, err
+	}
+	if !ed25519.Verify(key, msg, sig) {
+		return SignatureInfo{}, &VerificationError{Reason: "invalid signature"}
+	}
+	info := SignatureInfo{
+		Version: binary.LittleEndian.Uint64(hdr[4:]),
+		Created: time.Unix(0, int64(binary.LittleEndian.Uint64(hdr[12:]))),
+	}
+	if info.Version < minVersion {
+		return info, &VerificationError{Reason: fmt.Sprintf("version %d is older than %d", info.Version, minVersion)}
+	}
+	var tmp IPSet
+	br := bytes.NewReader(msg[signedHeaderSize:])
+	if err := tmp.Deserialize(br); err != nil {
+		return info, err
+	}
+	if br.Len() != 0 {
+		return info, ErrInvalidFormat
+	}
+	s.sources = sourceTrie{}
+	s.metadata = tmp.metadata
+	s.s4.ipsetBase = tmp.s4.ipsetBase
+	s.s6.ipsetBase = tmp.s6.ipsetBase
+	return info, nil
+}
@@ -0,0 +1,83 @@
+package ipset
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"math/rand"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSerializeSigned(t *testing.T) {
+	rs := rand.New(rand.NewSource(42))
+	pub, priv, err := ed25519.GenerateKey(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s IPSet
+	for i := 0; i < 300; i++ {
+		randomUpdate(rs, &s)
+	}
+	var buf bytes.Buffer
+	if err := s.SerializeSigned(&buf, priv, 5); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	var s1 IPSet
+	info, err := s1.DeserializeVerified(bytes.NewReader(b), pub, 5, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, &s, &s1)
+	if info.Version != 5 || time.Since(info.Created) > time.Minute {
+		t.Fatal(info)
+	}
+
+	check := func(b []byte, key ed25519.PublicKey, minVersion uint64) error {
+		var s2 IPSet
+		s2.Add(netip.MustParsePrefix("1.2.3.0/24"))
+		_, err := s2.DeserializeVerified(bytes.NewReader(b), key, minVersion, 1<<20)
+		if err != nil && len(prefixList(&s2)) != 1 {
+			t.Fatal("the set is modified")
+		}
+		return err
+	}
+	var verr *VerificationError
+	if err := check(b, pub, 6); !errors.As(err, &verr) {
+		t.Fatal(err)
+	}
+	otherPub, _, _ := ed25519.GenerateKey(rs)
+	if err := check(b, otherPub, 0); !errors.As(err, &verr) {
+		t.Fatal(err)
+	}
+	for _, pos := range []int{4, 12, signedHeaderSize + 5, len(b) - 1} {
+		b1 := append([]byte(nil), b...)
+		b1[pos] ^= 1
+		if err := check(b1, pub, 0); !errors.As(err, &verr) {
+			t.Fatal(pos, err)
+		}
+	}
+	if err := check(b[:len(b)-1], pub, 0); err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+	if err := check(b[:signedHeaderSize+10], pub, 0); err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+	var s3 IPSet
+	size := int64(len(b) - signedHeaderSize - ed25519.SignatureSize)
+	if _, err := s3.DeserializeVerified(bytes.NewReader(b), pub, 0, size-1); err != ErrTooLarge {
+		t.Fatal(err)
+	}
+	if _, err := s3.DeserializeVerified(bytes.NewReader(b), pub, 0, size); err != nil {
+		t.Fatal(err)
+	}
+	b1 := append([]byte(nil), b...)
+	b1[0] = 'X'
+	if err := check(b1, pub, 0); err != ErrInvalidFormat {
+		t.Fatal(err)
+	}
+}
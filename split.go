@@ -0,0 +1,104 @@
+package ipset
+
+import (
+	"encoding/binary"
+	"math/big"
+	"net/netip"
+)
+
+// splitPrefixes partitions the set into n parts of contiguous ranges of addresses with (nearly) equal address
+// counts. The address length is defined by bits (32 or 128), total is the number of addresses in the set.
+func (s *ipsetBase) splitPrefixes(n int, bits uint32, total *big.Int,
+	iterate func(IterStepFunc) bool) [][]netip.Prefix {
+	if n < 1 {
+		return nil
+	}
+	// ends contains the last address of each part, the parts that receive no addresses are left invalid
+	ends := make([]netip.Addr, n)
+	bn := big.NewInt(int64(n))
+	start := new(big.Int)
+	for i := range ends {
+		end := new(big.Int).Mul(total, big.NewInt(int64(i+1)))
+		end.Quo(end, bn)
+		if end.Cmp(start) > 0 {
+			k, _ := uint128FromBig(new(big.Int).Sub(end, big.NewInt(1)))
+			addr, _ := s.nthAddr(k, bits)
+			ends[i] = addr.toNetip(bits, bits).Addr()
+		}
+		start = end
+	}
+
+	parts := make([][]netip.Prefix, n)
+	i := 0
+	iterate(func(prefix netip.Prefix) bool {
+		first, last := prefix.Addr(), lastAddr(prefix)
+		for {
+			for !ends[i].IsValid() || ends[i].Less(first) {
+				i++
+			}
+			if last.Compare(ends[i]) <= 0 {
+				if first == prefix.Addr() {
+					parts[i] = append(parts[i], prefix)
+				} else {
+					parts[i] = append(parts[i], rangePrefixesNoUnmap(first, last)...)
+				}
+				return true
+			}
+			parts[i] = append(parts[i], rangePrefixesNoUnmap(first, ends[i])...)
+			first = ends[i].Next()
+			i++
+		}
+	})
+	return parts
+}
+
+// SplitPrefixes partitions the set into n parts with as equal address counts as possible and returns the prefixes
+// of each part. Each part covers a contiguous range of the set's addresses in ascending order, i.e. all
+// addresses of a part are lower than the addresses of the next one. Prefixes are split where necessary.
+// If the set contains fewer than n addresses, some of the parts are empty. If n is less than 1, nil is returned.
+// Like NthAddr, it caches the counts in the set, see NthAddr regarding the concurrency.
+func (s *IPSet4) SplitPrefixes(n int) [][]netip.Prefix {
+	return s.splitPrefixes(n, 32, new(big.Int).SetUint64(s.Count()), s.Iterate)
+}
+
+// Split partitions the set into n sets with as equal address counts as possible. Like NthAddr, it caches the counts
+// in the set. See SplitPrefixes for more details.
+func (s *IPSet4) Split(n int) []*IPSet4 {
+	parts := s.SplitPrefixes(n)
+	if parts == nil {
+		return nil
+	}
+	sets := make([]*IPSet4, len(parts))
+	for i, prefixes := range parts {
+		sets[i] = new(IPSet4)
+		for _, p := range prefixes {
+			a := p.Addr().As4()
+			sets[i].Add(binary.BigEndian.Uint32(a[:]), uint32(p.Bits()))
+		}
+	}
+	return sets
+}
+
+// SplitPrefixes partitions the set into n parts with as equal address counts as possible and returns the prefixes
+// of each part. It caches the counts in the set, see IPSet4.NthAddr regarding the concurrency.
+// See IPSet4.SplitPrefixes for more details.
+func (s *IPSet6) SplitPrefixes(n int) [][]netip.Prefix {
+	return s.splitPrefixes(n, 128, s.Count(), s.Iterate)
+}
+
+// Split partitions the set into n sets with as equal address counts as possible. It caches the counts in the set.
+// See IPSet4.SplitPrefixes for more details.
+func (s *IPSet6) Split(n int) []*IPSet6 {
+	parts := s.SplitPrefixes(n)
+	if parts == nil {
+		return nil
+	}
+	sets := make([]*IPSet6, len(parts))
+	for i, prefixes := range parts {
+		sets[i] = new(IPSet6)
+		for _, p := range prefixes {
+			sets[i].Add(p.Addr().As16(), uint32(p.Bits()))
+		}
+	}
+	return sets
+}
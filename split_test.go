@@ -0,0 +1,122 @@
+package ipset
+
+import (
+	"math/big"
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+func TestIPSet4_Split(t *testing.T) {
+	var s IPSet4
+	s.Add(0x0A00_0000, 24)
+	s.Add(0x0A00_0200, 30)
+
+	parts := s.SplitPrefixes(3)
+	if len(parts) != 3 {
+		t.Fatal(len(parts))
+	}
+	// 260 addresses: 86, 87, 87
+	expected := [][]string{
+		{"10.0.0.0/26", "10.0.0.64/28", "10.0.0.80/30", "10.0.0.84/31"},
+		{"10.0.0.86/31", "10.0.0.88/29", "10.0.0.96/27", "10.0.0.128/27", "10.0.0.160/29", "10.0.0.168/30",
+			"10.0.0.172/32"},
+		{"10.0.0.173/32", "10.0.0.174/31", "10.0.0.176/28", "10.0.0.192/26", "10.0.2.0/30"},
+	}
+	for i, part := range parts {
+		if len(part) != len(expected[i]) {
+			t.Fatal(i, part)
+		}
+		for j, p := range part {
+			if p.String() != expected[i][j] {
+				t.Fatal(i, part)
+			}
+		}
+	}
+
+	var empty IPSet4
+	if parts := empty.SplitPrefixes(2); len(parts) != 2 || parts[0] != nil || parts[1] != nil {
+		t.Fatal(parts)
+	}
+	if parts := s.SplitPrefixes(0); parts != nil {
+		t.Fatal(parts)
+	}
+
+	var small IPSet4
+	small.Add(0x0A00_0000, 31)
+	sets := small.Split(4)
+	if len(sets) != 4 || sets[0].Count() != 0 || sets[1].Count() != 1 || sets[2].Count() != 0 ||
+		sets[3].Count() != 1 {
+		t.Fatal(sets)
+	}
+}
+
+func TestIPSet4_SplitRandom(t *testing.T) {
+	rs := rand.New(rand.NewSource(12345678901234567))
+	var s IPSet4
+	for i := 0; i < 100; i++ {
+		s.Add(rs.Uint32(), uint32(8+rs.Intn(25)))
+	}
+	total := s.Count()
+	for _, n := range []int{1, 2, 7, 64} {
+		sets := s.Split(n)
+		var sum uint64
+		var prevLast uint32
+		for i, part := range sets {
+			c := part.Count()
+			sum += c
+			if c < total/uint64(n) || c > total/uint64(n)+1 {
+				t.Fatal(n, i, c)
+			}
+			first, _ := part.NthAddr(0)
+			last, _ := part.NthAddr(c - 1)
+			if i > 0 && first <= prevLast {
+				t.Fatal(n, i)
+			}
+			prevLast = last
+			part.Iterate(func(p netip.Prefix) bool {
+				a := ipToUint(p.Addr().As4())
+				if !s.Contains(a) || !s.Contains(a+(1<<(32-p.Bits())-1)) {
+					t.Fatal(p)
+				}
+				return true
+			})
+		}
+		if sum != total {
+			t.Fatal(n, sum, total)
+		}
+	}
+}
+
+func TestIPSet6_Split(t *testing.T) {
+	var s IPSet6
+	s.Add([16]byte{}, 0)
+	sets := s.Split(3)
+	if len(sets) != 3 {
+		t.Fatal(len(sets))
+	}
+	third := new(big.Int).Lsh(big.NewInt(1), 128)
+	third.Quo(third, big.NewInt(3))
+	if c := sets[0].Count(); c.Cmp(third) != 0 {
+		t.Fatal(c)
+	}
+	if c := sets[2].Count(); c.Cmp(third.Add(third, big.NewInt(1))) != 0 {
+		t.Fatal(c)
+	}
+	if !sets[2].Contains(netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff").As16()) {
+		t.Fatal()
+	}
+	if sets[1].Contains([16]byte{}) || !sets[0].Contains([16]byte{}) {
+		t.Fatal()
+	}
+}
+
+func TestIPSet6_Split4In6(t *testing.T) {
+	var s IPSet6
+	s.Add(netip.MustParseAddr("::ffff:10.0.0.0").As16(), 127)
+	s.Add(netip.MustParseAddr("::ffff:10.0.0.4").As16(), 128)
+	parts := s.SplitPrefixes(3)
+	if len(parts) != 3 || len(parts[1]) != 1 || parts[1][0] != netip.MustParsePrefix("::ffff:10.0.0.1/128") {
+		t.Fatal(parts)
+	}
+}
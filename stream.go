@@ -0,0 +1,603 @@
+package ipset
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+const (
+	nodePageSize  = 4096
+	nodePageSlots = 16
+)
+
+type nodePage struct {
+	mu  sync.Mutex
+	no  uint32 // page number + 1, 0 if the slot is empty
+	buf [nodePageSize]byte
+}
+
+// nodeFile is a serialized tree that is read on demand from an io.ReaderAt. The recently used pages are kept in
+// a small direct-mapped cache, each slot of which is locked separately, so that the file can be read concurrently.
+// The first page, which holds the top of the tree, has a slot of its own, so it is never evicted. The root pointer
+// is read when the file is opened. The values are decoded as little-endian regardless of the host byte order.
+type nodeFile struct {
+	r     io.ReaderAt
+	base  int64  // offset of the size header
+	n     uint32 // number of elements including the header
+	root  uint32
+	first nodePage
+	pages [nodePageSlots]nodePage
+}
+
+// openNodeFile opens the tree serialized at the offset and returns it along with the offset of the next tree.
+func openNodeFile(r io.ReaderAt, off int64) (*nodeFile, int64, error) {
+	var buf [8]byte
+	if _, err := r.ReadAt(buf[:4], off); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	size := binary.LittleEndian.Uint32(buf[:])
+	if size == 0 {
+		return &nodeFile{r: r, base: off}, off + 4, nil
+	}
+	if size&3 != 0 || size < 8 {
+		return nil, 0, ErrInvalidFormat
+	}
+	if _, err := r.ReadAt(buf[4:], off+4); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	return &nodeFile{r: r, base: off, n: size / 4, root: binary.LittleEndian.Uint32(buf[4:])}, off + int64(size), nil
+}
+
+// read returns the two elements starting at the index, which must be even and within the tree.
+func (f *nodeFile) read(idx uint32) (v1, v2 uint32, err error) {
+	no := idx * 4 / nodePageSize
+	p := &f.first
+	if no != 0 {
+		p = &f.pages[no%nodePageSlots]
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.no != no+1 {
+		start := int64(no) * nodePageSize
+		l := int64(f.n)*4 - start
+		if l > nodePageSize {
+			l = nodePageSize
+		}
+		n, err := f.r.ReadAt(p.buf[:l], f.base+start)
+		if n < int(l) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			p.no = 0
+			return 0, 0, err
+		}
+		p.no = no + 1
+	}
+	off := idx * 4 % nodePageSize
+	return binary.LittleEndian.Uint32(p.buf[off:]), binary.LittleEndian.Uint32(p.buf[off+4:]), nil
+}
+
+// nodeReader reads the nodes of a nodeFile and records the first error. Unlike nodeFile, it must not be used
+// concurrently.
+type nodeReader struct {
+	f   *nodeFile
+	err error
+}
+
+// node returns the two elements of the node. On error, it records the error and returns an empty node.
+func (r *nodeReader) node(idx uint32) (v1, v2 uint32) {
+	if r.err != nil {
+		return ptrAbsent, ptrAbsent
+	}
+	if idx < 2 || idx >= r.f.n-1 || idx&1 != 0 {
+		r.err = ErrInvalidFormat
+		return ptrAbsent, ptrAbsent
+	}
+	v1, v2, r.err = r.f.read(idx)
+	return
+}
+
+func (r *nodeReader) rootRef() nodeRef {
+	if r.f.n < 2 || r.err != nil {
+		return nodeRef{ptr: ptrAbsent}
+	}
+	return nodeRef{ptr: r.f.root}
+}
+
+// skipPrefix returns the prefix and the length of the skip node. On error, it records the error and returns
+// a zero length.
+func (r *nodeReader) skipPrefix(v uint32) (prefix, prefixLen uint32) {
+	if v < 2 {
+		r.err = ErrInvalidFormat
+		return 0, 0
+	}
+	return unpackPrefixLen(v)
+}
+
+// children works like ipsetBase.children.
+func (r *nodeReader) children(ref nodeRef) (left, right nodeRef) {
+	if ref.isLeaf() {
+		return ref, ref
+	}
+	v1, v2 := r.node(ptrToIdx(ref.ptr))
+	if !isSkipNode(ref.ptr) {
+		return nodeRef{ptr: v1}, nodeRef{ptr: v2}
+	}
+	prefix, prefixLen := r.skipPrefix(v1)
+	if prefixLen == 0 {
+		return nodeRef{ptr: ptrAbsent}, nodeRef{ptr: ptrAbsent}
+	}
+	next := nodeRef{ptr: ref.ptr, off: ref.off + 1}
+	if next.off == prefixLen {
+		next = nodeRef{ptr: v2}
+	}
+	if (prefix<<ref.off)&0x8000_0000 == 0 {
+		return next, nodeRef{ptr: ptrAbsent}
+	}
+	return nodeRef{ptr: ptrAbsent}, next
+}
+
+type setOp int
+
+const (
+	opUnion setOp = iota
+	opIntersect
+	opDiff
+)
+
+// mergeInput is a serialized set that is an input of a set operation. An io.ReaderAt is read on demand (see
+// nodeFile), any other io.Reader is read sequentially, which requires the nodes to be stored in pre-order, like
+// Serialize writes them. In the latter case, the subtrees that do not affect the result are read and discarded.
+type mergeInput struct {
+	ra   io.ReaderAt
+	nr   nodeReader
+	next int64 // offset of the IPv6 tree in ra
+
+	br  *bufio.Reader
+	pos uint32 // index of the next node in br
+	n   uint32 // number of elements in the current tree, including the header
+	err error
+}
+
+func newMergeInput(r io.Reader) (*mergeInput, error) {
+	if ra, ok := r.(io.ReaderAt); ok {
+		off, err := metadataSize(ra, 0)
+		if err != nil {
+			return nil, err
+		}
+		f, next, err := openNodeFile(ra, off)
+		if err != nil {
+			return nil, err
+		}
+		return &mergeInput{ra: ra, nr: nodeReader{f: f}, next: next}, nil
+	}
+	in := &mergeInput{br: bufio.NewReader(r)}
+	size := in.readUint32()
+	if size == metadataMagic && in.err == nil {
+		if _, err := readMetadataBody(in.br); err != nil {
+			return nil, err
+		}
+		size = in.readUint32()
+	}
+	in.openTree(size)
+	if in.err != nil {
+		return nil, in.err
+	}
+	return in, nil
+}
+
+func (in *mergeInput) readUint32() uint32 {
+	var buf [4]byte
+	if in.err != nil {
+		return 0
+	}
+	if _, err := io.ReadFull(in.br, buf[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		in.err = err
+		return 0
+	}
+	return binary.LittleEndian.Uint32(buf[:])
+}
+
+// openTree starts reading a tree from br after its size header.
+func (in *mergeInput) openTree(size uint32) {
+	in.pos, in.n = 2, 0
+	if in.err != nil || size == 0 {
+		return
+	}
+	if size&3 != 0 || size < 8 {
+		in.err = ErrInvalidFormat
+		return
+	}
+	in.n = size / 4
+}
+
+// root returns the root pointer of the current tree.
+func (in *mergeInput) root() uint32 {
+	if in.ra != nil {
+		return in.nr.rootRef().ptr
+	}
+	if in.n == 0 {
+		return ptrAbsent
+	}
+	return in.readUint32()
+}
+
+// nextTree moves to the IPv6 tree.
+func (in *mergeInput) nextTree() {
+	if in.ra != nil {
+		f, _, err := openNodeFile(in.ra, in.next)
+		if err != nil {
+			in.err = err
+			return
+		}
+		in.nr = nodeReader{f: f}
+		return
+	}
+	if in.err != nil {
+		return
+	}
+	if in.n > 0 {
+		if _, err := in.br.Discard(int(in.n-in.pos) * 4); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			in.err = err
+			return
+		}
+	}
+	in.openTree(in.readUint32())
+}
+
+func (in *mergeInput) error() error {
+	if in.err != nil {
+		return in.err
+	}
+	return in.nr.err
+}
+
+// node returns the two elements of the node. On error, it records the error and returns an empty node.
+func (in *mergeInput) node(idx uint32) (v1, v2 uint32) {
+	if in.ra != nil {
+		return in.nr.node(idx)
+	}
+	if in.err == nil && (idx != in.pos || idx >= in.n-1) {
+		in.err = ErrInvalidFormat
+	}
+	v1, v2 = in.readUint32(), in.readUint32()
+	if in.err != nil {
+		return ptrAbsent, ptrAbsent
+	}
+	in.pos += 2
+	return
+}
+
+// mergeRef is a position in an input tree: a leaf, a node that has not been read yet, or the remaining bits
+// of a skip node (prefix, top-aligned, and prefixLen) followed by child.
+type mergeRef struct {
+	in        *mergeInput
+	ptr       uint32
+	prefix    uint32
+	prefixLen uint32
+	child     uint32
+}
+
+func (r *mergeRef) isLeaf() bool {
+	return r.prefixLen == 0 && r.ptr <= ptrPresent
+}
+
+// load reads the skip node the ref points to, so that its bits could be consumed in chunks.
+func (r *mergeRef) load() {
+	if r.prefixLen != 0 || r.ptr <= ptrPresent || !isSkipNode(r.ptr) {
+		return
+	}
+	v1, v2 := r.in.node(ptrToIdx(r.ptr))
+	if v1 < 2 {
+		if r.in.err == nil && r.in.nr.err == nil {
+			r.in.err = ErrInvalidFormat
+		}
+		r.ptr = ptrAbsent
+		return
+	}
+	r.prefix, r.prefixLen = unpackPrefixLen(v1)
+	r.child = v2
+}
+
+// advance consumes the first n bits of the loaded skip node.
+func (r *mergeRef) advance(n uint32) {
+	r.prefixLen -= n
+	if r.prefixLen == 0 {
+		r.ptr = r.child
+	} else {
+		r.prefix <<= n
+	}
+}
+
+// fileMerger builds the result of a set operation over serialized trees.
+type fileMerger struct {
+	op   setOp
+	bits uint32
+	out  ipsetBase
+	err  error
+
+	// per-depth buffers for the live refs and the children
+	live        [][]mergeRef
+	left, right [][]mergeRef
+}
+
+// drop discards the subtree at the position. For sequential inputs, it reads the nodes of the subtree.
+func (m *fileMerger) drop(r mergeRef, depth uint32) {
+	if r.in.ra != nil {
+		return
+	}
+	for m.err == nil && r.in.err == nil {
+		r.load()
+		if r.isLeaf() {
+			return
+		}
+		if r.prefixLen != 0 {
+			depth += r.prefixLen
+			r.advance(r.prefixLen)
+			continue
+		}
+		if depth >= m.bits {
+			m.err = ErrInvalidFormat
+			return
+		}
+		v1, v2 := r.in.node(r.ptr)
+		m.drop(mergeRef{in: r.in, ptr: v1}, depth+1)
+		r = mergeRef{in: r.in, ptr: v2}
+		depth++
+	}
+}
+
+func (m *fileMerger) dropAll(refs []mergeRef, depth uint32) {
+	for _, r := range refs {
+		m.drop(r, depth)
+	}
+}
+
+// chain returns a node that prepends the bits of the prefix (top-aligned, no more than maxPackablePrefixLen) to
+// the child.
+func (m *fileMerger) chain(prefix, prefixLen, child uint32) uint32 {
+	if child == ptrAbsent {
+		return ptrAbsent
+	}
+	if prefixLen == 1 {
+		if prefix&0x8000_0000 == 0 {
+			return idxToPtr(m.out.allocateNode(child, ptrAbsent))
+		}
+		return idxToPtr(m.out.allocateNode(ptrAbsent, child))
+	}
+	return idxToPtr(m.out.allocateNode(packPrefixLen(prefix, prefixLen), child)) | skipNodeMask
+}
+
+func (m *fileMerger) merge(refs []mergeRef, depth uint32) uint32 {
+	for i := range refs {
+		refs[i].load()
+	}
+	live := m.live[depth][:0]
+	defer func() {
+		m.live[depth] = live[:0]
+	}()
+	switch m.op {
+	case opUnion:
+		for i, r := range refs {
+			if r.ptr == ptrPresent && r.prefixLen == 0 {
+				m.dropAll(refs[:i], depth)
+				m.dropAll(refs[i+1:], depth)
+				return ptrPresent
+			}
+			if !r.isLeaf() {
+				live = append(live, r)
+			}
+		}
+		switch len(live) {
+		case 0:
+			return ptrAbsent
+		case 1:
+			return m.copy(live[0], depth)
+		}
+	case opIntersect:
+		for i, r := range refs {
+			if r.ptr == ptrAbsent && r.prefixLen == 0 {
+				m.dropAll(refs[:i], depth)
+				m.dropAll(refs[i+1:], depth)
+				return ptrAbsent
+			}
+			if !r.isLeaf() {
+				live = append(live, r)
+			}
+		}
+		switch len(live) {
+		case 0:
+			return ptrPresent
+		case 1:
+			return m.copy(live[0], depth)
+		}
+	case opDiff:
+		if refs[0].isLeaf() && refs[0].ptr == ptrAbsent {
+			m.dropAll(refs[1:], depth)
+			return ptrAbsent
+		}
+		live = append(live, refs[0])
+		for i, r := range refs[1:] {
+			if r.ptr == ptrPresent && r.prefixLen == 0 {
+				m.dropAll(refs[:i+1], depth)
+				m.dropAll(refs[i+2:], depth)
+				return ptrAbsent
+			}
+			if !r.isLeaf() {
+				live = append(live, r)
+			}
+		}
+		if len(live) == 1 {
+			return m.copy(live[0], depth)
+		}
+	}
+	if depth >= m.bits {
+		m.err = ErrInvalidFormat
+		return ptrAbsent
+	}
+
+	// If all refs are within skip nodes, the bits they have in common are consumed at once
+	common := uint32(maxPackablePrefixLen)
+	for _, r := range live {
+		if r.prefixLen == 0 {
+			common = 0
+			break
+		}
+		if r.prefixLen < common {
+			common = r.prefixLen
+		}
+		if c := uint32(bits.LeadingZeros32(r.prefix ^ live[0].prefix)); c < common {
+			common = c
+		}
+	}
+	if common > 0 {
+		if depth+common > m.bits {
+			m.err = ErrInvalidFormat
+			return ptrAbsent
+		}
+		prefix := live[0].prefix
+		for i := range live {
+			live[i].advance(common)
+		}
+		return m.chain(prefix, common, m.merge(live, depth+common))
+	}
+
+	left, right := m.left[depth][:0], m.right[depth][:0]
+	for _, r := range live {
+		l, rt := r, r
+		switch {
+		case r.isLeaf():
+		case r.prefixLen != 0:
+			next := r
+			next.advance(1)
+			if r.prefix&0x8000_0000 == 0 {
+				l, rt = next, mergeRef{in: r.in, ptr: ptrAbsent}
+			} else {
+				l, rt = mergeRef{in: r.in, ptr: ptrAbsent}, next
+			}
+		default:
+			v1, v2 := r.in.node(r.ptr)
+			l, rt = mergeRef{in: r.in, ptr: v1}, mergeRef{in: r.in, ptr: v2}
+		}
+		left = append(left, l)
+		right = append(right, rt)
+	}
+	m.left[depth], m.right[depth] = left, right
+	l := m.merge(left, depth+1)
+	return m.out.joinNodes(l, m.merge(right, depth+1))
+}
+
+// copy copies the subtree at the position in a serialized tree, checking that it does not go deeper than the
+// address length.
+func (m *fileMerger) copy(r mergeRef, depth uint32) uint32 {
+	r.load()
+	if r.isLeaf() {
+		return r.ptr
+	}
+	if r.prefixLen != 0 {
+		if depth+r.prefixLen > m.bits {
+			m.err = ErrInvalidFormat
+			return ptrAbsent
+		}
+		prefix, prefixLen := r.prefix, r.prefixLen
+		r.advance(prefixLen)
+		return m.chain(prefix, prefixLen, m.copy(r, depth+prefixLen))
+	}
+	if depth >= m.bits {
+		m.err = ErrInvalidFormat
+		return ptrAbsent
+	}
+	v1, v2 := r.in.node(r.ptr)
+	left := m.copy(mergeRef{in: r.in, ptr: v1}, depth+1)
+	return m.out.joinNodes(left, m.copy(mergeRef{in: r.in, ptr: v2}, depth+1))
+}
+
+func (m *fileMerger) run(inputs []*mergeInput, w io.Writer) error {
+	refs := make([]mergeRef, len(inputs))
+	for i, in := range inputs {
+		refs[i] = mergeRef{in: in, ptr: in.root()}
+	}
+	m.live = make([][]mergeRef, m.bits+1)
+	m.left = make([][]mergeRef, m.bits+1)
+	m.right = make([][]mergeRef, m.bits+1)
+	m.out.nodes = make([]uint32, 2)
+	root := uint32(ptrAbsent)
+	if len(refs) > 0 {
+		root = m.merge(refs, 0)
+	}
+	for _, in := range inputs {
+		if err := in.error(); err != nil {
+			return err
+		}
+	}
+	if m.err != nil {
+		return m.err
+	}
+	if root == ptrAbsent {
+		m.out.nodes = nil
+	} else {
+		m.out.nodes[1] = root
+	}
+	return m.out.Serialize(w)
+}
+
+func serializedOp(w io.Writer, op setOp, readers []io.Reader) error {
+	inputs := make([]*mergeInput, len(readers))
+	for i, r := range readers {
+		in, err := newMergeInput(r)
+		if err != nil {
+			return err
+		}
+		inputs[i] = in
+	}
+	m := fileMerger{op: op, bits: 32}
+	if err := m.run(inputs, w); err != nil {
+		return err
+	}
+	for _, in := range inputs {
+		in.nextTree()
+		if err := in.error(); err != nil {
+			return err
+		}
+	}
+	m = fileMerger{op: op, bits: 128}
+	return m.run(inputs, w)
+}
+
+// UnionSerialized writes the union of the sets serialized by IPSet.Serialize to w, in the same format.
+// The inputs are read on demand without deserializing them, so the memory usage is proportional to the size
+// of the result rather than the size of the inputs.
+//
+// The inputs that implement io.ReaderAt (such as *os.File or *bytes.Reader) are accessed randomly and only
+// the parts that affect the result are read. The other inputs are read sequentially, which requires the nodes to
+// be stored in the order Serialize writes them, otherwise ErrInvalidFormat is returned.
+func UnionSerialized(w io.Writer, inputs ...io.Reader) error {
+	return serializedOp(w, opUnion, inputs)
+}
+
+// IntersectSerialized writes the intersection of the serialized sets to w. If there are no inputs, the result
+// is empty. See UnionSerialized for more details.
+func IntersectSerialized(w io.Writer, inputs ...io.Reader) error {
+	return serializedOp(w, opIntersect, inputs)
+}
+
+// DiffSerialized writes the set serialized in a with the addresses from the other serialized sets removed.
+// See UnionSerialized for more details.
+func DiffSerialized(w io.Writer, a io.Reader, others ...io.Reader) error {
+	return serializedOp(w, opDiff, append([]io.Reader{a}, others...))
+}
@@ -0,0 +1,197 @@
+package ipset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net/netip"
+	"os"
+	"testing"
+)
+
+func serialized(t *testing.T, s *IPSet) *bytes.Reader {
+	var buf bytes.Buffer
+	if err := s.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func deserialized(t *testing.T, b []byte) *IPSet {
+	var s IPSet
+	r := bytes.NewReader(b)
+	if err := s.Deserialize(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 0 {
+		t.Fatal(r.Len())
+	}
+	return &s
+}
+
+func diffSets(a *IPSet, others ...*IPSet) *IPSet {
+	res := a.Clone()
+	for _, o := range others {
+		for _, p := range prefixList(o) {
+			res.Remove(p)
+		}
+	}
+	return res
+}
+
+// streamReader hides the io.ReaderAt implementation of the underlying reader, so that it is read sequentially.
+type streamReader struct {
+	io.Reader
+}
+
+func TestSerializedOps(t *testing.T) {
+	rs := rand.New(rand.NewSource(42))
+	for i := 0; i < 100; i++ {
+		sets := make([]*IPSet, 1+rs.Intn(4))
+		data := make([][]byte, len(sets))
+		var union IPSet
+		for j := range sets {
+			sets[j] = &IPSet{}
+			for k := rs.Intn(100); k > 0; k-- {
+				randomUpdate(rs, sets[j])
+			}
+			for _, p := range prefixList(sets[j]) {
+				union.Add(p)
+			}
+			data[j], _ = io.ReadAll(serialized(t, sets[j]))
+		}
+		inputs := func() []io.Reader {
+			res := make([]io.Reader, len(data))
+			for j, b := range data {
+				if rs.Intn(2) == 0 {
+					res[j] = bytes.NewReader(b)
+				} else {
+					res[j] = streamReader{bytes.NewReader(b)}
+				}
+			}
+			return res
+		}
+		intersection := sets[0]
+		for _, s := range sets[1:] {
+			intersection = diffSets(intersection, diffSets(intersection, s))
+		}
+
+		var buf bytes.Buffer
+		if err := UnionSerialized(&buf, inputs()...); err != nil {
+			t.Fatal(err)
+		}
+		assertSameSet(t, deserialized(t, buf.Bytes()), &union)
+
+		buf.Reset()
+		if err := IntersectSerialized(&buf, inputs()...); err != nil {
+			t.Fatal(err)
+		}
+		assertSameSet(t, deserialized(t, buf.Bytes()), intersection)
+
+		buf.Reset()
+		in := inputs()
+		if err := DiffSerialized(&buf, in[0], in[1:]...); err != nil {
+			t.Fatal(err)
+		}
+		assertSameSet(t, deserialized(t, buf.Bytes()), diffSets(sets[0], sets[1:]...))
+	}
+}
+
+func TestSerializedOpsLarge(t *testing.T) {
+	b, err := os.ReadFile("testdata/ipset.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := UnionSerialized(&buf, bytes.NewReader(b), bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, deserialized(t, buf.Bytes()), deserialized(t, b))
+
+	buf.Reset()
+	if err := DiffSerialized(&buf, bytes.NewReader(b), bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), make([]byte, 8)) {
+		t.Fatal(buf.Bytes())
+	}
+
+	buf.Reset()
+	if err := IntersectSerialized(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), make([]byte, 8)) {
+		t.Fatal(buf.Bytes())
+	}
+}
+
+func TestSerializedOpsInvalid(t *testing.T) {
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	s.Add(netip.MustParsePrefix("192.168.0.0/16"))
+	b, _ := io.ReadAll(serialized(t, &s))
+
+	var buf bytes.Buffer
+	if err := UnionSerialized(&buf, bytes.NewReader(b[:len(b)-4])); err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+	b1 := append([]byte(nil), b...)
+	b1[4] = 0xFE // root pointer out of range
+	if err := UnionSerialized(&buf, bytes.NewReader(b1)); err != ErrInvalidFormat {
+		t.Fatal(err)
+	}
+	b1[0] = 3
+	if err := UnionSerialized(&buf, bytes.NewReader(b1)); err != ErrInvalidFormat {
+		t.Fatal(err)
+	}
+}
+
+func TestSerializedOpsStream(t *testing.T) {
+	b, err := os.ReadFile("testdata/ipset.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	s.Add(netip.MustParsePrefix("2001:db8::/32"))
+	s.SetMetadata(&Metadata{Name: "test"})
+	b1, _ := io.ReadAll(serialized(t, &s))
+	expected := deserialized(t, b)
+	expected.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	expected.Add(netip.MustParsePrefix("2001:db8::/32"))
+
+	var buf bytes.Buffer
+	err = UnionSerialized(&buf, streamReader{bytes.NewReader(b)}, streamReader{bytes.NewReader(b1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, deserialized(t, buf.Bytes()), expected)
+
+	buf.Reset()
+	err = DiffSerialized(&buf, streamReader{bytes.NewReader(b)}, streamReader{bytes.NewReader(b)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), make([]byte, 8)) {
+		t.Fatal(buf.Bytes())
+	}
+
+	// The streamed input must be in pre-order, the random access one may have any layout
+	nodes := []uint32{24, 4, ptrAbsent, ptrAbsent, ptrPresent, ptrAbsent, 0}
+	b2 := make([]byte, len(nodes)*4)
+	for i, v := range nodes {
+		binary.LittleEndian.PutUint32(b2[i*4:], v)
+	}
+	buf.Reset()
+	if err := UnionSerialized(&buf, bytes.NewReader(b2)); err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, deserialized(t, buf.Bytes()), deserialized(t, b2))
+	if err := UnionSerialized(&buf, streamReader{bytes.NewReader(b2)}); err != ErrInvalidFormat {
+		t.Fatal(err)
+	}
+	if err := UnionSerialized(&buf, streamReader{bytes.NewReader(b1[:len(b1)-4])}); err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,193 @@
+package ipset
+
+import "math/big"
+
+// summaryNode is a branching point of the tree, i.e. a node where both subtrees contain prefixes.
+type summaryNode struct {
+	prefix ipPrefix
+	depth  uint32
+	// left and right are the indexes of the child branching points, -1 if the child is a prefix.
+	left, right int
+	// lo is the smallest number of prefixes the subtree can be reduced to within the extra limit, split[j-lo] is
+	// the number of prefixes that go to the left subtree if the subtree is reduced to j prefixes, 0 if the node
+	// is collapsed into a single prefix.
+	lo    int
+	split []int32
+}
+
+// summarizer finds the optimal set of branching points to collapse. For each branching point, it computes the
+// smallest number of extra covered addresses needed to reduce the subtree to at most j prefixes, for every j,
+// from the same values of the child branching points.
+type summarizer struct {
+	s           *ipsetBase
+	bits        uint32
+	maxPrefixes int
+	maxExtra    uint128
+	nodes       []summaryNode
+}
+
+// build walks the subtree down to the first branching point and returns its index (-1 if the subtree is a prefix),
+// the size of the absent subtrees along the way, the size of the absent subtrees below the branching point (area)
+// and the smallest number of extra addresses needed to reduce the subtree to at most j prefixes, for j starting
+// from lo. If the subtree is empty, extra is nil.
+func (t *summarizer) build(r nodeRef, prefix ipPrefix, depth uint32) (idx int, absent, area uint128, lo int,
+	extra []uint128) {
+
+	for {
+		if r.ptr == ptrAbsent {
+			return -1, uint128{}, uint128{}, 0, nil
+		}
+		if r.ptr == ptrPresent {
+			return -1, absent, uint128{}, 1, []uint128{{}}
+		}
+		left, right := t.s.children(r)
+		if left.ptr != ptrAbsent && right.ptr != ptrAbsent {
+			break
+		}
+		depth++
+		if left.ptr == ptrAbsent && right.ptr == ptrAbsent {
+			return -1, uint128{}, uint128{}, 0, nil
+		}
+		absent = absent.add(pow2(t.bits - depth))
+		if left.ptr == ptrAbsent {
+			prefix = prefix.withBit(depth - 1)
+			r = right
+		} else {
+			r = left
+		}
+	}
+
+	idx = len(t.nodes)
+	t.nodes = append(t.nodes, summaryNode{
+		prefix: prefix,
+		depth:  depth,
+	})
+	left, right := t.s.children(r)
+	leftIdx, leftAbsent, leftArea, leftLo, leftExtra := t.build(left, prefix, depth+1)
+	rightIdx, rightAbsent, rightArea, rightLo, rightExtra := t.build(right, prefix.withBit(depth), depth+1)
+	area = leftAbsent.add(leftArea).add(rightAbsent).add(rightArea)
+
+	leftHi, rightHi := leftLo+len(leftExtra)-1, rightLo+len(rightExtra)-1
+	hi := leftHi + rightHi
+	if t.maxPrefixes > 0 && hi > t.maxPrefixes {
+		hi = t.maxPrefixes
+	}
+	lo = leftLo + rightLo
+	if area.cmp(t.maxExtra) <= 0 {
+		// In this case leftLo and rightLo are 1, because collapsing a child costs less
+		lo = 1
+	}
+	if hi < lo {
+		hi = lo - 1
+	}
+	extra = make([]uint128, hi-lo+1)
+	split := make([]int32, hi-lo+1)
+	for j := lo; j <= hi; j++ {
+		if j == 1 {
+			extra[0] = area
+			continue
+		}
+		first := true
+		from, to := j-rightHi, j-rightLo
+		if from < leftLo {
+			from = leftLo
+		}
+		if to > leftHi {
+			to = leftHi
+		}
+		for j1 := from; j1 <= to; j1++ {
+			e := leftExtra[j1-leftLo].add(rightExtra[j-j1-rightLo])
+			if first || e.cmp(extra[j-lo]) < 0 {
+				extra[j-lo], split[j-lo], first = e, int32(j1), false
+			}
+		}
+	}
+	// The values do not increase with j, so the ones above the limit are at the beginning
+	skip := 0
+	for skip < len(extra) && extra[skip].cmp(t.maxExtra) > 0 {
+		skip++
+	}
+	lo += skip
+	n := &t.nodes[idx]
+	n.left, n.right, n.lo, n.split = leftIdx, rightIdx, lo, split[skip:]
+	return idx, absent, area, lo, extra[skip:]
+}
+
+// collapse adds the prefixes of the branching points that are collapsed if the subtree is reduced to j prefixes.
+// A collapsed node has no collapsed descendants, so the order does not matter.
+func (t *summarizer) collapse(idx, j int) {
+	if idx < 0 {
+		return
+	}
+	n := &t.nodes[idx]
+	j1 := int(n.split[j-n.lo])
+	if j1 == 0 {
+		t.s.add(n.prefix, n.depth)
+		return
+	}
+	t.collapse(n.left, j1)
+	t.collapse(n.right, j-j1)
+}
+
+// summarize collapses branching points of the tree into single prefixes. If maxPrefixes is positive, the number
+// of prefixes is reduced to at most maxPrefixes with the smallest number of extra covered addresses. Otherwise,
+// the number of prefixes is reduced as much as possible while the number of extra covered addresses does not
+// exceed maxExtra. It returns the number of extra covered addresses.
+// The choice is optimal, it takes O(n*min(n, maxPrefixes)) time where n is the number of prefixes.
+// Collapsing a node can make the new prefix adjacent to a sibling one, in which case they are merged and the
+// resulting number of prefixes is smaller than the one the choice was made for.
+func (s *ipsetBase) summarize(bits uint32, maxPrefixes int, maxExtra uint128) uint128 {
+	t := summarizer{s: s, bits: bits, maxPrefixes: maxPrefixes, maxExtra: maxExtra}
+	idx, _, _, lo, extra := t.build(s.rootRef(), ipPrefix{}, 0)
+	if idx < 0 || len(extra) == 0 {
+		return uint128{}
+	}
+	j := lo
+	if maxPrefixes > 0 {
+		j = lo + len(extra) - 1
+	}
+	t.collapse(idx, j)
+	return extra[j-lo]
+}
+
+var maxUint128 = uint128{hi: ^uint64(0), lo: ^uint64(0)}
+
+// Summarize reduces the set to at most maxPrefixes prefixes by replacing groups of neighbouring prefixes with
+// covering ones, so that the number of addresses that become covered in addition to the original ones is minimal.
+// It returns the number of such addresses. If maxPrefixes is less than 1, it is treated as 1.
+func (s *IPSet4) Summarize(maxPrefixes int) (extra uint64) {
+	if maxPrefixes < 1 {
+		maxPrefixes = 1
+	}
+	return s.summarize(32, maxPrefixes, maxUint128).lo
+}
+
+// SummarizeMaxExtra reduces the number of prefixes in the set as much as possible by replacing groups of
+// neighbouring prefixes with covering ones so that at most maxExtra addresses become covered in addition to
+// the original ones. It returns the number of such addresses.
+func (s *IPSet4) SummarizeMaxExtra(maxExtra uint64) (extra uint64) {
+	return s.summarize(32, 0, uint128{lo: maxExtra}).lo
+}
+
+// Summarize reduces the set to at most maxPrefixes prefixes.
+// See IPSet4.Summarize for more details.
+func (s *IPSet6) Summarize(maxPrefixes int) (extra *big.Int) {
+	if maxPrefixes < 1 {
+		maxPrefixes = 1
+	}
+	return s.summarize(128, maxPrefixes, maxUint128).big()
+}
+
+// SummarizeMaxExtra reduces the number of prefixes in the set so that at most maxExtra addresses become covered
+// in addition to the original ones.
+// See IPSet4.SummarizeMaxExtra for more details.
+func (s *IPSet6) SummarizeMaxExtra(maxExtra *big.Int) (extra *big.Int) {
+	limit, ok := uint128FromBig(maxExtra)
+	if !ok {
+		if maxExtra.Sign() < 0 {
+			return new(big.Int)
+		}
+		limit = maxUint128
+	}
+	return s.summarize(128, 0, limit).big()
+}
@@ -0,0 +1,200 @@
+package ipset
+
+import (
+	"math/big"
+	"math/rand"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func countPrefixes(iterate func(IterStepFunc) bool) (n int) {
+	iterate(func(netip.Prefix) bool {
+		n++
+		return true
+	})
+	return
+}
+
+func countAddrs4(s *IPSet4) (n uint64) {
+	s.Iterate(func(p netip.Prefix) bool {
+		n += 1 << (32 - p.Bits())
+		return true
+	})
+	return
+}
+
+func TestIPSet4_Summarize(t *testing.T) {
+	var s IPSet4
+	s.Add(0x0A00_0000, 24)
+	s.Add(0x0A00_0100, 24)
+	s.Add(0x0A00_0300, 24)
+	s.Add(0xC0A8_0000, 24)
+
+	extra := s.Summarize(2)
+	if extra != 256 {
+		t.Fatal(extra)
+	}
+	var b strings.Builder
+	_, err := s.WriteTextTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str := b.String(); str != "10.0.0.0/22\n192.168.0.0/24\n" {
+		t.Fatal(str)
+	}
+
+	extra = s.Summarize(1)
+	if extra != 1<<32-1<<10-1<<8 {
+		t.Fatal(extra)
+	}
+	if !s.Contains(0x7F00_0001) {
+		t.Fatal()
+	}
+}
+
+func TestIPSet4_SummarizeMaxExtra(t *testing.T) {
+	var s IPSet4
+	s.Add(0x0A00_0000, 25)
+	s.Add(0x0A00_0080, 25)
+	s.Add(0x0A00_0300, 24)
+	s.Add(0x0A00_0500, 24)
+	s.Add(0xC0A8_0000, 24)
+
+	extra := s.SummarizeMaxExtra(0)
+	if extra != 0 {
+		t.Fatal(extra)
+	}
+	if n := countPrefixes(s.Iterate); n != 4 {
+		t.Fatal(n)
+	}
+
+	extra = s.SummarizeMaxExtra(1000)
+	if extra != 512 {
+		t.Fatal(extra)
+	}
+	if n := countPrefixes(s.Iterate); n != 3 {
+		t.Fatal(n)
+	}
+
+	extra = s.SummarizeMaxExtra(768)
+	if extra != 768 {
+		t.Fatal(extra)
+	}
+	var b strings.Builder
+	_, err := s.WriteTextTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str := b.String(); str != "10.0.0.0/21\n192.168.0.0/24\n" {
+		t.Fatal(str)
+	}
+}
+
+func TestIPSet4_SummarizeOptimal(t *testing.T) {
+	var s IPSet4
+	s.Add(0x0A00_0000, 32)
+	s.Add(0x0A00_0040, 32)
+	s.Add(0x0A00_0080, 25)
+	s.Add(0x0A01_0000, 26)
+	s.Add(0x0A01_0040, 32)
+
+	// Collapsing 10.0.0.0/25 makes it adjacent to 10.0.0.128/25
+	extra := s.Summarize(3)
+	if extra != 126 {
+		t.Fatal(extra)
+	}
+	var b strings.Builder
+	_, err := s.WriteTextTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str := b.String(); str != "10.0.0.0/24\n10.1.0.0/26\n10.1.0.64/32\n" {
+		t.Fatal(str)
+	}
+}
+
+func TestIPSet4_SummarizeConsistent(t *testing.T) {
+	rs := rand.New(rand.NewSource(1))
+	var s IPSet4
+	for i := 0; i < 300; i++ {
+		p := randomPrefix4(rs)
+		s.Add(ipToUint(p.Addr().As4()), uint32(p.Bits()))
+	}
+	prev := uint64(0)
+	for k := countPrefixes(s.Iterate); k > 0; k -= 1 + rs.Intn(20) {
+		s1 := s.Clone()
+		extra := s1.Summarize(k)
+		if extra < prev {
+			t.Fatal(k, extra, prev)
+		}
+		prev = extra
+		s2 := s.Clone()
+		if e := s2.SummarizeMaxExtra(extra); e > extra || countPrefixes(s2.Iterate) > countPrefixes(s1.Iterate) {
+			t.Fatal(k, e, extra)
+		}
+		if extra > 0 {
+			s3 := s.Clone()
+			if s3.SummarizeMaxExtra(extra - 1); countPrefixes(s3.Iterate) <= k {
+				t.Fatal(k, extra)
+			}
+		}
+	}
+}
+
+func TestIPSet4_SummarizeRandom(t *testing.T) {
+	rs := rand.New(rand.NewSource(12345678901234567))
+	var s IPSet4
+	var list []netip.Prefix
+	for i := 0; i < 5000; i++ {
+		p := randomPrefix4(rs)
+		list = append(list, p)
+		a := p.Addr().As4()
+		s.Add(ipToUint(a), uint32(p.Bits()))
+	}
+	before := countAddrs4(&s)
+	extra := s.Summarize(100)
+	if n := countPrefixes(s.Iterate); n > 100 {
+		t.Fatal(n)
+	}
+	if after := countAddrs4(&s); after-before != extra {
+		t.Fatal(after-before, extra)
+	}
+	for _, p := range list {
+		if !s.Contains(ipToUint(p.Addr().As4())) {
+			t.Fatal(p)
+		}
+	}
+}
+
+func TestIPSet6_Summarize(t *testing.T) {
+	var s IPSet6
+	s.Add(netip.MustParseAddr("2001:db8::").As16(), 64)
+	s.Add(netip.MustParseAddr("2001:db8:0:2::").As16(), 64)
+	s.Add(netip.MustParseAddr("2001:db9::").As16(), 32)
+
+	extra := s.Summarize(2)
+	if extra.Cmp(new(big.Int).Lsh(big.NewInt(1), 65)) != 0 {
+		t.Fatal(extra)
+	}
+	if !s.Contains(netip.MustParseAddr("2001:db8:0:1::1").As16()) {
+		t.Fatal()
+	}
+	if n := countPrefixes(s.Iterate); n != 2 {
+		t.Fatal(n)
+	}
+
+	extra = s.SummarizeMaxExtra(big.NewInt(0))
+	if extra.Sign() != 0 {
+		t.Fatal(extra)
+	}
+
+	s.Add(netip.MustParseAddr("8000::").As16(), 1)
+	extra = s.Summarize(1)
+	if !s.Contains(netip.MustParseAddr("::1").As16()) {
+		t.Fatal()
+	}
+	if extra.BitLen() != 127 {
+		t.Fatal(extra)
+	}
+}
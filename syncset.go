@@ -0,0 +1,1029 @@
+package ipset
+
+import (
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	shardBits4 = 8
+	shardBits6 = 16
+)
+
+// A shard's counts cache (see IPSet4.NthAddr) is not used by the other read-only methods, so it is built under
+// the read lock and countsMu, which only serialises the methods that use it.
+type shard4 struct {
+	mu       sync.RWMutex
+	countsMu sync.Mutex
+	set      IPSet4
+}
+
+type shard6 struct {
+	mu       sync.RWMutex
+	countsMu sync.Mutex
+	set      IPSet6
+}
+
+func (sh *shard4) lockCounts() {
+	sh.mu.RLock()
+	sh.countsMu.Lock()
+}
+
+func (sh *shard4) unlockCounts() {
+	sh.countsMu.Unlock()
+	sh.mu.RUnlock()
+}
+
+func (sh *shard6) lockCounts() {
+	sh.mu.RLock()
+	sh.countsMu.Lock()
+}
+
+func (sh *shard6) unlockCounts() {
+	sh.countsMu.Unlock()
+	sh.mu.RUnlock()
+}
+
+// SyncIPSet is an IP set that is safe for concurrent use. The address space is split into shards (per /8 for IPv4
+// and per /16 for IPv6), each of them being a separate tree protected by its own lock, so that updates of
+// different shards do not contend. IPv4 prefixes shorter than /8 are split into the shard prefixes. IPv6 /16
+// blocks that are entirely in the set are tracked separately, so adding or removing a shorter IPv6 prefix does not
+// create the shards it covers.
+// Operations that involve multiple shards (like Iterate or Serialize) are consistent within each shard,
+// but not across shards.
+// SyncIPSet has the methods of IPSet except for the ones that rely on a single tree: Snapshot and Begin, as well
+// as AddWithSource and Explain. ToIPSet returns a copy that has them.
+// The zero value is an empty set ready to use. A SyncIPSet must not be copied after first use.
+type SyncIPSet struct {
+	s4 [1 << shardBits4]shard4
+	// s6 is allocated lazily in pages of 256 shards indexed by the first byte of the address
+	s6 [256]atomic.Pointer[[256]shard6]
+	// full6 has a bit for each IPv6 shard that is entirely in the set, in which case the shard's tree is ignored
+	full6 [1 << shardBits6 / 64]atomic.Uint64
+
+	maxPrefixLen4, maxPrefixLen6 atomic.Int32
+}
+
+func (s *SyncIPSet) shard6(idx uint32, create bool) *shard6 {
+	page := s.s6[idx>>8].Load()
+	if page == nil {
+		if !create {
+			return nil
+		}
+		newPage := new([256]shard6)
+		if s.s6[idx>>8].CompareAndSwap(nil, newPage) {
+			page = newPage
+		} else {
+			page = s.s6[idx>>8].Load()
+		}
+	}
+	return &page[idx&0xFF]
+}
+
+func (s *SyncIPSet) isFull6(idx uint32) bool {
+	return s.full6[idx/64].Load()&(1<<(idx%64)) != 0
+}
+
+func (s *SyncIPSet) setFull6(idx uint32, full bool) {
+	w := &s.full6[idx/64]
+	for {
+		old := w.Load()
+		v := old &^ (1 << (idx % 64))
+		if full {
+			v |= 1 << (idx % 64)
+		}
+		if v == old || w.CompareAndSwap(old, v) {
+			return
+		}
+	}
+}
+
+// hasFull6 returns true if any of the shards of the page is entirely in the set.
+func (s *SyncIPSet) hasFull6(page uint32) bool {
+	for i := page * 4; i < page*4+4; i++ {
+		if s.full6[i].Load() != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// fill6 adds (if full is true) or removes the range of IPv6 shards. The trees of the existing shards are released.
+func (s *SyncIPSet) fill6(first, n uint32, full bool) {
+	for i := first; i < first+n; i++ {
+		sh := s.shard6(i, false)
+		if sh == nil {
+			s.setFull6(i, full)
+			continue
+		}
+		sh.mu.Lock()
+		sh.set = IPSet6{}
+		s.setFull6(i, full)
+		sh.mu.Unlock()
+	}
+}
+
+// scan6 calls fn for the IPv6 shards starting from idx and moving up or down, until fn returns false. The shards
+// that do not exist and are not entirely in the set are skipped, for the ones that do not exist sh is nil.
+func (s *SyncIPSet) scan6(idx uint32, up bool, fn func(idx uint32, sh *shard6) bool) bool {
+	for i := int(idx); i >= 0 && i < 1<<shardBits6; {
+		page := s.s6[i>>8].Load()
+		if page == nil && !s.hasFull6(uint32(i>>8)) {
+			if up {
+				i = (i>>8 + 1) << 8
+			} else {
+				i = i>>8<<8 - 1
+			}
+			continue
+		}
+		if page != nil {
+			if !fn(uint32(i), &page[i&0xFF]) {
+				return false
+			}
+		} else if s.isFull6(uint32(i)) && !fn(uint32(i), nil) {
+			return false
+		}
+		if up {
+			i++
+		} else {
+			i--
+		}
+	}
+	return true
+}
+
+func shardAddr6(idx uint32) (a [16]byte) {
+	binary.BigEndian.PutUint16(a[:2], uint16(idx))
+	return
+}
+
+// forEachShard4 calls fn for each shard the prefix belongs to along with the part of the prefix within the shard.
+func (s *SyncIPSet) forEachShard4(prefix, bits uint32, fn func(sh *shard4, prefix, bits uint32)) {
+	if bits >= shardBits4 {
+		fn(&s.s4[prefix>>(32-shardBits4)], prefix, bits)
+		return
+	}
+	first := (prefix >> (32 - shardBits4)) &^ (1<<(shardBits4-bits) - 1)
+	for i := first; i < first+1<<(shardBits4-bits); i++ {
+		fn(&s.s4[i], i<<(32-shardBits4), shardBits4)
+	}
+}
+
+func clampPrefixLen(bits uint32, maxPrefixLen int32) uint32 {
+	if maxPrefixLen != 0 && bits > uint32(maxPrefixLen) {
+		return uint32(maxPrefixLen)
+	}
+	return bits
+}
+
+// Add adds the prefix to the set.
+// See IPSet.Add for more details.
+func (s *SyncIPSet) Add(prefix netip.Prefix) {
+	addr, bits := prefix.Addr(), uint32(prefix.Bits())
+	if addr.Is4() || addr.Is4In6() {
+		if bits > 32 {
+			bits = 32
+		}
+		a := addr.As4()
+		ip := binary.BigEndian.Uint32(a[:])
+		bits = clampPrefixLen(bits, s.maxPrefixLen4.Load())
+		s.forEachShard4(ip, bits, func(sh *shard4, prefix, bits uint32) {
+			sh.mu.Lock()
+			sh.set.Add(prefix, bits)
+			sh.mu.Unlock()
+		})
+	} else if addr.Is6() {
+		if bits > 128 {
+			bits = 128
+		}
+		s.add6(addr.As16(), clampPrefixLen(bits, s.maxPrefixLen6.Load()))
+	}
+}
+
+func (s *SyncIPSet) add6(prefix [16]byte, bits uint32) {
+	idx := uint32(binary.BigEndian.Uint16(prefix[:2]))
+	if bits < shardBits6 {
+		first := idx &^ (1<<(shardBits6-bits) - 1)
+		s.fill6(first, 1<<(shardBits6-bits), true)
+		return
+	}
+	sh := s.shard6(idx, true)
+	sh.mu.Lock()
+	if !s.isFull6(idx) {
+		sh.set.Add(prefix, bits)
+	}
+	sh.mu.Unlock()
+}
+
+// Remove removes the prefix from the set.
+// See IPSet.Remove for more details.
+func (s *SyncIPSet) Remove(prefix netip.Prefix) {
+	addr, bits := prefix.Addr(), uint32(prefix.Bits())
+	if addr.Is4() || addr.Is4In6() {
+		if bits > 32 {
+			bits = 32
+		}
+		a := addr.As4()
+		ip := binary.BigEndian.Uint32(a[:])
+		s.forEachShard4(ip, bits, func(sh *shard4, prefix, bits uint32) {
+			sh.mu.Lock()
+			if bits == shardBits4 {
+				// Release the memory of the whole shard
+				sh.set = IPSet4{}
+			} else {
+				sh.set.Remove(prefix, bits)
+			}
+			sh.mu.Unlock()
+		})
+	} else if addr.Is6() {
+		if bits > 128 {
+			bits = 128
+		}
+		s.remove6(addr.As16(), bits)
+	}
+}
+
+func (s *SyncIPSet) remove6(prefix [16]byte, bits uint32) {
+	idx := uint32(binary.BigEndian.Uint16(prefix[:2]))
+	if bits <= shardBits6 {
+		first := idx &^ (1<<(shardBits6-bits) - 1)
+		s.fill6(first, 1<<(shardBits6-bits), false)
+		return
+	}
+	sh := s.shard6(idx, s.isFull6(idx))
+	if sh == nil {
+		return
+	}
+	sh.mu.Lock()
+	if s.isFull6(idx) {
+		// The rest of the shard remains in the set
+		sh.set = IPSet6{}
+		sh.set.Add(shardAddr6(idx), shardBits6)
+		s.setFull6(idx, false)
+	}
+	sh.set.Remove(prefix, bits)
+	sh.mu.Unlock()
+}
+
+// AddRange adds all addresses from the range between from and to (inclusive).
+// See IPSet.AddRange for more details.
+func (s *SyncIPSet) AddRange(from, to netip.Addr) {
+	for _, p := range rangePrefixes(from, to) {
+		s.Add(p)
+	}
+}
+
+func (s *SyncIPSet) Contains(addr netip.Addr) bool {
+	if addr.Is4() || addr.Is4In6() {
+		a := addr.As4()
+		sh := &s.s4[a[0]]
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+		return sh.set.Contains(binary.BigEndian.Uint32(a[:]))
+	} else if addr.Is6() {
+		a := addr.As16()
+		idx := uint32(binary.BigEndian.Uint16(a[:2]))
+		if s.isFull6(idx) {
+			return true
+		}
+		sh := s.shard6(idx, false)
+		if sh == nil {
+			return false
+		}
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+		return s.isFull6(idx) || sh.set.Contains(a)
+	}
+	return false
+}
+
+// SetMaxPrefixLen sets the maximum length of the IPv4 and IPv6 prefixes added to the set.
+// See IPSet.SetMaxPrefixLen for more details.
+func (s *SyncIPSet) SetMaxPrefixLen(bits4, bits6 int) {
+	if bits4 <= 0 || bits4 >= 32 {
+		bits4 = 0
+	}
+	if bits6 <= 0 || bits6 >= 128 {
+		bits6 = 0
+	}
+	s.maxPrefixLen4.Store(int32(bits4))
+	s.maxPrefixLen6.Store(int32(bits6))
+}
+
+func (s *SyncIPSet) coarsen4(bits int) {
+	if bits >= shardBits4 {
+		for i := range s.s4 {
+			sh := &s.s4[i]
+			sh.mu.Lock()
+			sh.set.Coarsen(bits)
+			sh.mu.Unlock()
+		}
+		return
+	}
+	if bits < 0 {
+		bits = 0
+	}
+	// Each block of shards within a prefix of the specified length becomes full if any of them is not empty
+	block := 1 << (shardBits4 - bits)
+	for first := 0; first < len(s.s4); first += block {
+		nonEmpty := false
+		for i := first; i < first+block && !nonEmpty; i++ {
+			sh := &s.s4[i]
+			sh.mu.RLock()
+			nonEmpty = !sh.set.isEmpty()
+			sh.mu.RUnlock()
+		}
+		if nonEmpty {
+			for i := first; i < first+block; i++ {
+				sh := &s.s4[i]
+				sh.mu.Lock()
+				sh.set.Add(uint32(i)<<(32-shardBits4), shardBits4)
+				sh.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (s *SyncIPSet) coarsen6(bits int) {
+	if bits >= shardBits6 {
+		for i := range s.s6 {
+			page := s.s6[i].Load()
+			if page == nil {
+				continue
+			}
+			for j := range page {
+				sh := &page[j]
+				sh.mu.Lock()
+				sh.set.Coarsen(bits)
+				sh.mu.Unlock()
+			}
+		}
+		return
+	}
+	if bits < 0 {
+		bits = 0
+	}
+	block := uint32(1) << (shardBits6 - bits)
+	for first := uint32(0); first < 1<<shardBits6; first += block {
+		nonEmpty := false
+		for i := first; i < first+block && !nonEmpty; i++ {
+			if s.isFull6(i) {
+				nonEmpty = true
+			} else if sh := s.shard6(i, false); sh != nil {
+				sh.mu.RLock()
+				nonEmpty = !sh.set.isEmpty()
+				sh.mu.RUnlock()
+			}
+		}
+		if nonEmpty {
+			s.fill6(first, block, true)
+		}
+	}
+}
+
+// Coarsen widens all IPv4 prefixes longer than bits4 and all IPv6 prefixes longer than bits6 to these lengths.
+// See IPSet.Coarsen for more details.
+func (s *SyncIPSet) Coarsen(bits4, bits6 int) {
+	if bits4 < 32 {
+		s.coarsen4(bits4)
+	}
+	if bits6 < 128 {
+		s.coarsen6(bits6)
+	}
+}
+
+// Compact compacts each shard.
+// See IPSet.Compact for more details.
+func (s *SyncIPSet) Compact() {
+	for i := range s.s4 {
+		sh := &s.s4[i]
+		sh.mu.Lock()
+		sh.set.Compact()
+		sh.mu.Unlock()
+	}
+	for i := range s.s6 {
+		page := s.s6[i].Load()
+		if page == nil {
+			continue
+		}
+		for j := range page {
+			sh := &page[j]
+			sh.mu.Lock()
+			sh.set.Compact()
+			sh.mu.Unlock()
+		}
+	}
+}
+
+func collectPrefixes(iterate func(IterStepFunc) bool) (prefixes []netip.Prefix) {
+	iterate(func(p netip.Prefix) bool {
+		prefixes = append(prefixes, p)
+		return true
+	})
+	return
+}
+
+// Iterate calls the step function for each prefix within the set in ascending order. The prefixes of each shard
+// are collected under the shard's lock, the step function is called after the lock is released, so it may
+// modify the set. The adjacent shards that are entirely in the set are passed as the prefixes that cover them,
+// so like with IPSet, the prefixes do not depend on the sharding.
+// See IPSet.Iterate for more details.
+func (s *SyncIPSet) Iterate(step IterStepFunc) bool {
+	return s.iterate4(0, step) && s.iterate6([16]byte{}, step)
+}
+
+func callStep(prefixes []netip.Prefix, step IterStepFunc) bool {
+	for _, p := range prefixes {
+		if !step(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// iterate4 calls the step function for the IPv4 prefixes starting from the one that contains ip. Like in iterate6,
+// the consecutive shards that are entirely in the set are passed as the prefixes that cover them.
+func (s *SyncIPSet) iterate4(ip uint32, step IterStepFunc) bool {
+	runStart := -1
+	// flushRun passes the shards from runStart up to end (exclusive) to the step function
+	flushRun := func(end int) bool {
+		if runStart < 0 {
+			return true
+		}
+		first, last := addrFrom4(uint32(runStart)<<(32-shardBits4)), addrFrom4(uint32(end)<<(32-shardBits4)-1)
+		runStart = -1
+		for _, p := range rangePrefixesNoUnmap(first, last) {
+			if lastAddr(p).Compare(addrFrom4(ip)) >= 0 && !step(p) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := ip >> (32 - shardBits4); i < 1<<shardBits4; i++ {
+		from := i << (32 - shardBits4)
+		if from < ip {
+			from = ip
+		}
+		sh := &s.s4[i]
+		sh.mu.RLock()
+		prefixes := collectPrefixes(func(step IterStepFunc) bool {
+			return sh.set.IterateFrom(from, step)
+		})
+		sh.mu.RUnlock()
+		if len(prefixes) == 1 && prefixes[0].Bits() == shardBits4 {
+			if runStart < 0 {
+				runStart = int(i)
+			}
+			continue
+		}
+		if !flushRun(int(i)) || !callStep(prefixes, step) {
+			return false
+		}
+	}
+	return flushRun(1 << shardBits4)
+}
+
+// iterate6 calls the step function for the IPv6 prefixes starting from the one that contains addr.
+func (s *SyncIPSet) iterate6(addr [16]byte, step IterStepFunc) bool {
+	first := uint32(binary.BigEndian.Uint16(addr[:2]))
+	for next := first; next < 1<<shardBits6; {
+		var prefixes []netip.Prefix
+		// The range of the consecutive shards that are entirely in the set
+		runStart, runEnd := -1, -1
+		found := false
+		s.scan6(next, true, func(idx uint32, sh *shard6) bool {
+			if sh != nil {
+				sh.mu.RLock()
+				defer sh.mu.RUnlock()
+			}
+			full := s.isFull6(idx)
+			if sh == nil && !full {
+				return true
+			}
+			if full {
+				if runStart >= 0 && int(idx) != runEnd+1 {
+					return false
+				}
+				if runStart < 0 {
+					runStart = int(idx)
+				}
+				runEnd, next, found = int(idx), idx+1, true
+				return true
+			}
+			if runStart >= 0 {
+				return false
+			}
+			from := shardAddr6(idx)
+			if idx == first {
+				from = addr
+			}
+			prefixes = collectPrefixes(func(step IterStepFunc) bool {
+				return sh.set.IterateFrom(from, step)
+			})
+			next, found = idx+1, true
+			return len(prefixes) == 0
+		})
+		if !found {
+			break
+		}
+		if runStart >= 0 {
+			last := lastAddr(netip.PrefixFrom(netip.AddrFrom16(shardAddr6(uint32(runEnd))), shardBits6))
+			for _, p := range rangePrefixesNoUnmap(netip.AddrFrom16(shardAddr6(uint32(runStart))), last) {
+				if lastAddr(p).Compare(netip.AddrFrom16(addr)) >= 0 {
+					prefixes = append(prefixes, p)
+				}
+			}
+		}
+		if !callStep(prefixes, step) {
+			return false
+		}
+	}
+	return true
+}
+
+// IterateFrom is like Iterate, but it starts from the prefix that contains addr, or the first prefix that follows
+// it. See IPSet.IterateFrom for more details.
+func (s *SyncIPSet) IterateFrom(addr netip.Addr, step IterStepFunc) bool {
+	if addr.Is4() || addr.Is4In6() {
+		a := addr.As4()
+		return s.iterate4(binary.BigEndian.Uint32(a[:]), step) && s.iterate6([16]byte{}, step)
+	} else if addr.Is6() {
+		return s.iterate6(addr.As16(), step)
+	}
+	return true
+}
+
+// NextIn returns the lowest address in the set that is not lower than addr and belongs to the same address family.
+// See IPSet.NextIn for more details.
+func (s *SyncIPSet) NextIn(addr netip.Addr) (res netip.Addr, found bool) {
+	if addr.Is4() || addr.Is4In6() {
+		a := addr.As4()
+		ip := binary.BigEndian.Uint32(a[:])
+		for i := ip >> (32 - shardBits4); i < 1<<shardBits4 && !found; i++ {
+			from := i << (32 - shardBits4)
+			if from < ip {
+				from = ip
+			}
+			sh := &s.s4[i]
+			sh.mu.RLock()
+			next, ok := sh.set.NextIn(from)
+			sh.mu.RUnlock()
+			if ok {
+				res, found = addrFrom4(next), true
+			}
+		}
+	} else if addr.Is6() {
+		a := addr.As16()
+		first := uint32(binary.BigEndian.Uint16(a[:2]))
+		s.scan6(first, true, func(idx uint32, sh *shard6) bool {
+			from := shardAddr6(idx)
+			if idx == first {
+				from = a
+			}
+			if sh != nil {
+				sh.mu.RLock()
+				defer sh.mu.RUnlock()
+			}
+			full := s.isFull6(idx)
+			if sh == nil && !full {
+				return true
+			}
+			if full {
+				res, found = netip.AddrFrom16(from), true
+			} else if next, ok := sh.set.NextIn(from); ok {
+				res, found = netip.AddrFrom16(next), true
+			}
+			return !found
+		})
+	}
+	return
+}
+
+// PrevIn returns the highest address in the set that is not higher than addr and belongs to the same address
+// family. See IPSet.NextIn for more details.
+func (s *SyncIPSet) PrevIn(addr netip.Addr) (res netip.Addr, found bool) {
+	if addr.Is4() || addr.Is4In6() {
+		a := addr.As4()
+		ip := binary.BigEndian.Uint32(a[:])
+		for i := int(ip >> (32 - shardBits4)); i >= 0 && !found; i-- {
+			from := uint32(i)<<(32-shardBits4) | (1<<(32-shardBits4) - 1)
+			if from > ip {
+				from = ip
+			}
+			sh := &s.s4[i]
+			sh.mu.RLock()
+			prev, ok := sh.set.PrevIn(from)
+			sh.mu.RUnlock()
+			if ok {
+				res, found = addrFrom4(prev), true
+			}
+		}
+	} else if addr.Is6() {
+		a := addr.As16()
+		first := uint32(binary.BigEndian.Uint16(a[:2]))
+		s.scan6(first, false, func(idx uint32, sh *shard6) bool {
+			from := lastAddr(netip.PrefixFrom(netip.AddrFrom16(shardAddr6(idx)), shardBits6)).As16()
+			if idx == first {
+				from = a
+			}
+			if sh != nil {
+				sh.mu.RLock()
+				defer sh.mu.RUnlock()
+			}
+			full := s.isFull6(idx)
+			if sh == nil && !full {
+				return true
+			}
+			if full {
+				res, found = netip.AddrFrom16(from), true
+			} else if prev, ok := sh.set.PrevIn(from); ok {
+				res, found = netip.AddrFrom16(prev), true
+			}
+			return !found
+		})
+	}
+	return
+}
+
+// NextNotIn returns the lowest address of the same address family that is not lower than addr and is not
+// in the set. See IPSet.NextIn for more details.
+func (s *SyncIPSet) NextNotIn(addr netip.Addr) (res netip.Addr, found bool) {
+	if addr.Is4() || addr.Is4In6() {
+		a := addr.As4()
+		ip := binary.BigEndian.Uint32(a[:])
+		for i := ip >> (32 - shardBits4); i < 1<<shardBits4 && !found; i++ {
+			from := i << (32 - shardBits4)
+			if from < ip {
+				from = ip
+			}
+			sh := &s.s4[i]
+			sh.mu.RLock()
+			next, ok := sh.set.NextNotIn(from)
+			sh.mu.RUnlock()
+			// Otherwise the rest of the shard is in the set
+			if ok && next>>(32-shardBits4) == i {
+				res, found = addrFrom4(next), true
+			}
+		}
+		return
+	} else if !addr.Is6() {
+		return
+	}
+	a := addr.As16()
+	first := uint32(binary.BigEndian.Uint16(a[:2]))
+	// The shards before expected are entirely in the set starting from addr
+	expected := first
+	s.scan6(first, true, func(idx uint32, sh *shard6) bool {
+		if idx != expected {
+			return false
+		}
+		from := shardAddr6(idx)
+		if idx == first {
+			from = a
+		}
+		if sh != nil {
+			sh.mu.RLock()
+			defer sh.mu.RUnlock()
+		}
+		full := s.isFull6(idx)
+		if sh == nil && !full {
+			// The shard has been emptied concurrently
+			res, found = netip.AddrFrom16(from), true
+			return false
+		}
+		if !full {
+			if next, ok := sh.set.NextNotIn(from); ok && binary.BigEndian.Uint16(next[:2]) == uint16(idx) {
+				res, found = netip.AddrFrom16(next), true
+				return false
+			}
+		}
+		expected++
+		return true
+	})
+	if !found && expected < 1<<shardBits6 {
+		if expected == first {
+			res = addr
+		} else {
+			res = netip.AddrFrom16(shardAddr6(expected))
+		}
+		found = true
+	}
+	return
+}
+
+// count returns the number of addresses in the shard. It caches the counts in the shard's tree, so that
+// the subsequent calls of NthAddr and Rank are fast.
+func (sh *shard4) count() uint64 {
+	sh.lockCounts()
+	defer sh.unlockCounts()
+	sh.set.buildCounts(32)
+	return sh.set.Count()
+}
+
+func (s *SyncIPSet) count6(idx uint32, sh *shard6) *big.Int {
+	if sh == nil {
+		return pow2(128 - shardBits6).big()
+	}
+	sh.lockCounts()
+	defer sh.unlockCounts()
+	if s.isFull6(idx) {
+		return pow2(128 - shardBits6).big()
+	}
+	sh.set.buildCounts(128)
+	return sh.set.Count()
+}
+
+// Count returns the number of addresses in the set, IPv4 and IPv6 ones together. It caches the counts in each
+// shard under the shard's read lock, so it only waits for the writers and the other methods that use the cache.
+// The result is not consistent across shards if the set is modified concurrently.
+func (s *SyncIPSet) Count() *big.Int {
+	total := new(big.Int)
+	for i := range s.s4 {
+		total.Add(total, new(big.Int).SetUint64(s.s4[i].count()))
+	}
+	s.scan6(0, true, func(idx uint32, sh *shard6) bool {
+		total.Add(total, s.count6(idx, sh))
+		return true
+	})
+	return total
+}
+
+// Rank returns the index of the address within the set in the order of Iterate, i.e. the number of addresses in
+// the set that are lower than addr, counting all IPv4 addresses as lower than the IPv6 ones. The second return value
+// is false if the address is not in the set. Like Count, it caches the counts in each shard.
+// See IPSet4.Rank for more details.
+func (s *SyncIPSet) Rank(addr netip.Addr) (*big.Int, bool) {
+	rank := new(big.Int)
+	if addr.Is4() || addr.Is4In6() {
+		a := addr.As4()
+		ip := binary.BigEndian.Uint32(a[:])
+		for i := uint32(0); i < ip>>(32-shardBits4); i++ {
+			rank.Add(rank, new(big.Int).SetUint64(s.s4[i].count()))
+		}
+		sh := &s.s4[ip>>(32-shardBits4)]
+		sh.lockCounts()
+		r, ok := sh.set.Rank(ip)
+		sh.unlockCounts()
+		if !ok {
+			return nil, false
+		}
+		return rank.Add(rank, new(big.Int).SetUint64(r)), true
+	} else if !addr.Is6() {
+		return nil, false
+	}
+	for i := range s.s4 {
+		rank.Add(rank, new(big.Int).SetUint64(s.s4[i].count()))
+	}
+	a := addr.As16()
+	idx := uint32(binary.BigEndian.Uint16(a[:2]))
+	found := false
+	s.scan6(0, true, func(i uint32, sh *shard6) bool {
+		if i < idx {
+			rank.Add(rank, s.count6(i, sh))
+			return true
+		}
+		if i == idx {
+			if sh != nil {
+				sh.lockCounts()
+				defer sh.unlockCounts()
+			}
+			full := s.isFull6(i)
+			if sh == nil && !full {
+				return false
+			}
+			if full {
+				rank.Add(rank, new(big.Int).SetBytes(a[shardBits6/8:]))
+				found = true
+			} else if r, ok := sh.set.Rank(a); ok {
+				rank.Add(rank, r)
+				found = true
+			}
+		}
+		return false
+	})
+	if !found {
+		return nil, false
+	}
+	return rank, true
+}
+
+// NthAddr returns the k-th (starting from 0) address of the set in the order of Iterate. The second return value is
+// false if k is not less than the number of addresses in the set. Like Count, it caches the counts in each shard.
+// See IPSet4.NthAddr for more details.
+func (s *SyncIPSet) NthAddr(k *big.Int) (res netip.Addr, found bool) {
+	if k.Sign() < 0 {
+		return
+	}
+	k = new(big.Int).Set(k)
+	for i := range s.s4 {
+		sh := &s.s4[i]
+		sh.lockCounts()
+		sh.set.buildCounts(32)
+		c := new(big.Int).SetUint64(sh.set.Count())
+		if k.Cmp(c) < 0 {
+			addr, _ := sh.set.NthAddr(k.Uint64())
+			sh.unlockCounts()
+			return addrFrom4(addr), true
+		}
+		sh.unlockCounts()
+		k.Sub(k, c)
+	}
+	s.scan6(0, true, func(idx uint32, sh *shard6) bool {
+		if sh != nil {
+			sh.lockCounts()
+			defer sh.unlockCounts()
+		}
+		full := s.isFull6(idx)
+		if sh == nil && !full {
+			return true
+		}
+		if full {
+			if k.BitLen() <= 128-shardBits6 {
+				a := shardAddr6(idx)
+				k.FillBytes(a[shardBits6/8:])
+				res, found = netip.AddrFrom16(a), true
+				return false
+			}
+			k.Sub(k, pow2(128-shardBits6).big())
+			return true
+		}
+		sh.set.buildCounts(128)
+		c := sh.set.Count()
+		if k.Cmp(c) < 0 {
+			addr, _ := sh.set.NthAddr(k)
+			res, found = netip.AddrFrom16(addr), true
+			return false
+		}
+		k.Sub(k, c)
+		return true
+	})
+	return
+}
+
+// Split partitions the set into n sets, splitting the IPv4 and the IPv6 addresses separately, so that each part
+// gets as equal number of addresses of each family as possible. The parts are taken from a copy made with ToIPSet.
+// See IPSet4.SplitPrefixes for more details.
+func (s *SyncIPSet) Split(n int) []*IPSet {
+	set := s.ToIPSet()
+	parts4, parts6 := set.s4.Split(n), set.s6.Split(n)
+	if parts4 == nil {
+		return nil
+	}
+	sets := make([]*IPSet, n)
+	for i := range sets {
+		sets[i] = &IPSet{s4: *parts4[i], s6: *parts6[i]}
+	}
+	return sets
+}
+
+// Diff returns the prefixes that need to be added to and removed from the old set in order to get the contents
+// of this set. It is computed from a copy made with ToIPSet.
+// See Diff for more details.
+func (s *SyncIPSet) Diff(old *IPSet) (added, removed *IPSet) {
+	return Diff(old, s.ToIPSet())
+}
+
+// WriteTextTo writes a textual representation of the IP set to the provided Writer.
+// See IPSet.WriteTextTo for more details.
+func (s *SyncIPSet) WriteTextTo(w io.Writer) (n int64, err error) {
+	var buf [44]byte
+
+	s.Iterate(func(prefix netip.Prefix) bool {
+		buf1 := prefix.AppendTo(buf[:0])
+		buf1 = append(buf1, '\n')
+		n1, err1 := w.Write(buf1)
+		n += int64(n1)
+		if err1 != nil {
+			err = err1
+			return false
+		}
+		return true
+	})
+
+	return
+}
+
+// ToIPSet returns a copy of the set as an IPSet.
+func (s *SyncIPSet) ToIPSet() *IPSet {
+	var res IPSet
+	s.Iterate(func(p netip.Prefix) bool {
+		res.Add(p)
+		return true
+	})
+	return &res
+}
+
+// Serialize writes the set in the same format as IPSet.Serialize.
+func (s *SyncIPSet) Serialize(w io.Writer) error {
+	return s.ToIPSet().Serialize(w)
+}
+
+// Deserialize replaces the contents of the set with the serialized IPSet. The set is cleared before
+// the new contents are added, so concurrent readers may observe a partially loaded set.
+func (s *SyncIPSet) Deserialize(r io.Reader) error {
+	var set IPSet
+	if err := set.Deserialize(r); err != nil {
+		return err
+	}
+	s.replace(&set)
+	return nil
+}
+
+func (s *SyncIPSet) replace(set *IPSet) {
+	s.Remove(netip.PrefixFrom(netip.IPv4Unspecified(), 0))
+	s.Remove(netip.PrefixFrom(netip.IPv6Unspecified(), 0))
+	s.addAll(set)
+}
+
+func (s *SyncIPSet) addAll(set *IPSet) {
+	set.Iterate(func(p netip.Prefix) bool {
+		s.Add(p)
+		return true
+	})
+}
+
+// SerializeTo writes the set like Serialize does, compressing it with the specified method.
+// See IPSet.SerializeTo for more details.
+func (s *SyncIPSet) SerializeTo(w io.Writer, c Compression) error {
+	return s.ToIPSet().SerializeTo(w, c)
+}
+
+// SerializeCompressed writes the set in the same format as IPSet.SerializeCompressed.
+func (s *SyncIPSet) SerializeCompressed(w io.Writer) error {
+	return s.ToIPSet().SerializeCompressed(w)
+}
+
+// DeserializeCompressed replaces the contents of the set with the set written by IPSet.SerializeCompressed.
+// Like with Deserialize, concurrent readers may observe a partially loaded set.
+func (s *SyncIPSet) DeserializeCompressed(r io.Reader) error {
+	var set IPSet
+	if err := set.DeserializeCompressed(r); err != nil {
+		return err
+	}
+	s.replace(&set)
+	return nil
+}
+
+// ReadTextFrom adds the prefixes from the text in the format written by WriteTextTo. The text is parsed completely
+// before the prefixes are added, but like with IPSet.ReadTextFrom, the ones that precede an error are added.
+// See IPSet.ReadTextFrom for more details.
+func (s *SyncIPSet) ReadTextFrom(r io.Reader) (n int64, err error) {
+	var set IPSet
+	n, err = set.ReadTextFrom(r)
+	s.addAll(&set)
+	return
+}
+
+// ApplyPatch reads a patch written by WritePatch and applies it to the set. Each prefix is removed or added
+// atomically, but concurrent readers may observe a partially applied patch.
+// See IPSet.ApplyPatch for more details.
+func (s *SyncIPSet) ApplyPatch(r io.Reader) error {
+	added, removed, err := ReadPatch(r)
+	if err != nil {
+		return err
+	}
+	removed.Iterate(func(prefix netip.Prefix) bool {
+		s.Remove(prefix)
+		return true
+	})
+	s.addAll(added)
+	return nil
+}
+
+// Clone returns a copy of the set, including the maximum prefix lengths.
+func (s *SyncIPSet) Clone() *SyncIPSet {
+	res := new(SyncIPSet)
+	res.maxPrefixLen4.Store(s.maxPrefixLen4.Load())
+	res.maxPrefixLen6.Store(s.maxPrefixLen6.Load())
+	s.Iterate(func(p netip.Prefix) bool {
+		res.Add(p)
+		return true
+	})
+	return res
+}
+
+// Equal returns true if the set contains the same addresses as other.
+func (s *SyncIPSet) Equal(other *IPSet) bool {
+	return s.ToIPSet().Equal(other)
+}
+
+// Fingerprint returns the same value as IPSet.Fingerprint would for a set with the same addresses.
+func (s *SyncIPSet) Fingerprint() [32]byte {
+	return s.ToIPSet().Fingerprint()
+}
+
+// WriteLPMTrieTo writes the prefixes as BPF LPM trie map entries.
+// See IPSet.WriteLPMTrieTo for more details.
+func (s *SyncIPSet) WriteLPMTrieTo(w4, w6 io.Writer, value []byte) (n int64, err error) {
+	return s.ToIPSet().WriteLPMTrieTo(w4, w6, value)
+}
+
+// WriteBpftoolBatchTo writes a 'bpftool batch' file that updates the maps with the prefixes.
+// See IPSet.WriteBpftoolBatchTo for more details.
+func (s *SyncIPSet) WriteBpftoolBatchTo(w io.Writer, map4, map6 string, value []byte) (n int64, err error) {
+	return s.ToIPSet().WriteBpftoolBatchTo(w, map4, map6, value)
+}
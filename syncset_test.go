@@ -0,0 +1,380 @@
+package ipset
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSyncIPSet(t *testing.T) {
+	var s SyncIPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/24"))
+	s.Add(netip.MustParsePrefix("8.0.0.0/6"))
+	s.Add(netip.MustParsePrefix("2001:db8::/32"))
+	s.Add(netip.MustParsePrefix("2400::/14"))
+	s.AddRange(netip.MustParseAddr("192.168.0.1"), netip.MustParseAddr("192.168.0.2"))
+
+	for _, addr := range []string{"10.0.0.1", "11.255.255.255", "8.0.0.0", "2001:db8::1", "2403:ffff::1",
+		"192.168.0.2", "::ffff:192.168.0.1"} {
+		if !s.Contains(netip.MustParseAddr(addr)) {
+			t.Fatal(addr)
+		}
+	}
+	for _, addr := range []string{"12.0.0.0", "2001:db9::1", "2404::", "192.168.0.3"} {
+		if s.Contains(netip.MustParseAddr(addr)) {
+			t.Fatal(addr)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := s.WriteTextTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "8.0.0.0/6\n192.168.0.1/32\n192.168.0.2/32\n2001:db8::/32\n2400::/14\n"
+	if buf.String() != expected {
+		t.Fatal(buf.String())
+	}
+
+	s.Remove(netip.MustParsePrefix("8.0.0.0/7"))
+	s.Remove(netip.MustParsePrefix("2402::/15"))
+	s.Remove(netip.MustParsePrefix("2401:8000::/17"))
+	if s.Contains(netip.MustParseAddr("9.1.1.1")) || !s.Contains(netip.MustParseAddr("10.0.0.1")) ||
+		s.Contains(netip.MustParseAddr("2401:8000::1")) || !s.Contains(netip.MustParseAddr("2401::1")) {
+		t.Fatal()
+	}
+
+	buf.Reset()
+	if err := s.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var s1 SyncIPSet
+	s1.Add(netip.MustParsePrefix("1.0.0.0/8"))
+	if err := s1.Deserialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	assertSameSet(t, s.ToIPSet(), s1.ToIPSet())
+
+	s.Coarsen(4, 8)
+	if !s.Contains(netip.MustParseAddr("15.255.0.0")) || s.Contains(netip.MustParseAddr("16.0.0.0")) ||
+		!s.Contains(netip.MustParseAddr("20ff::")) || s.Contains(netip.MustParseAddr("2100::")) {
+		t.Fatal()
+	}
+
+	s.SetMaxPrefixLen(24, 64)
+	s.Add(netip.MustParsePrefix("172.16.0.1/32"))
+	if !s.Contains(netip.MustParseAddr("172.16.0.200")) {
+		t.Fatal()
+	}
+	s.Add(netip.MustParsePrefix("2001:db8::1/128"))
+	s.Remove(netip.MustParsePrefix("172.16.0.1/32"))
+	s.Remove(netip.MustParsePrefix("2001:db8::1/128"))
+	if s.Contains(netip.MustParseAddr("172.16.0.1")) || !s.Contains(netip.MustParseAddr("172.16.0.200")) ||
+		s.Contains(netip.MustParseAddr("2001:db8::1")) || !s.Contains(netip.MustParseAddr("2001:db8::2")) {
+		t.Fatal()
+	}
+}
+
+func TestSyncIPSetConcurrent(t *testing.T) {
+	var s SyncIPSet
+	const writers = 8
+	prefixes := make([][]netip.Prefix, writers)
+	for i := range prefixes {
+		rs := rand.New(rand.NewSource(int64(i)))
+		for j := 0; j < 500; j++ {
+			prefixes[i] = append(prefixes[i], randomPrefix(rs))
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(list []netip.Prefix) {
+			defer wg.Done()
+			for _, p := range list {
+				s.Add(p)
+			}
+		}(prefixes[i])
+	}
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func(seed int64) {
+			defer readers.Done()
+			rs := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				addr := randomPrefix(rs).Addr()
+				s.Contains(addr)
+				s.NextIn(addr)
+				s.NextNotIn(addr)
+				if rs.Intn(20) == 0 {
+					s.Rank(addr)
+					s.Count()
+				}
+				if rs.Intn(100) == 0 {
+					s.Iterate(func(netip.Prefix) bool {
+						return true
+					})
+				}
+			}
+		}(int64(100 + i))
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	var ref IPSet
+	for _, list := range prefixes {
+		for _, p := range list {
+			ref.Add(p)
+		}
+	}
+	for _, list := range prefixes {
+		for _, p := range list {
+			if !s.Contains(p.Addr()) || !s.Contains(lastAddr(p)) {
+				t.Fatal(p)
+			}
+		}
+	}
+	var res IPSet
+	s.Iterate(func(p netip.Prefix) bool {
+		if !ref.Contains(p.Addr()) || !ref.Contains(lastAddr(p)) {
+			t.Fatal(p)
+		}
+		res.Add(p)
+		return true
+	})
+	assertSameSet(t, &res, &ref)
+}
+
+func TestSyncIPSetWide6(t *testing.T) {
+	var s SyncIPSet
+	s.Add(netip.MustParsePrefix("::/0"))
+	s.Remove(netip.MustParsePrefix("2001:db8::1/128"))
+	s.Remove(netip.MustParsePrefix("3000::/4"))
+	pages := 0
+	for i := range s.s6 {
+		if s.s6[i].Load() != nil {
+			pages++
+		}
+	}
+	if pages != 1 {
+		t.Fatal(pages)
+	}
+
+	var ref IPSet
+	ref.Add(netip.MustParsePrefix("::/0"))
+	ref.Remove(netip.MustParsePrefix("2001:db8::1/128"))
+	ref.Remove(netip.MustParsePrefix("3000::/4"))
+	assertSameSet(t, s.ToIPSet(), &ref)
+	if n := len(prefixList(s.ToIPSet())); n != len(prefixList(&ref)) {
+		t.Fatal(n)
+	}
+	if !s.Contains(netip.MustParseAddr("2001:db8::2")) || s.Contains(netip.MustParseAddr("2001:db8::1")) ||
+		s.Contains(netip.MustParseAddr("3fff::")) {
+		t.Fatal()
+	}
+
+	s.Remove(netip.MustParsePrefix("::/1"))
+	s.Add(netip.MustParsePrefix("2001:db8::/32"))
+	ref.Remove(netip.MustParsePrefix("::/1"))
+	ref.Add(netip.MustParsePrefix("2001:db8::/32"))
+	assertSameSet(t, s.ToIPSet(), &ref)
+}
+
+func TestSyncIPSetQueries(t *testing.T) {
+	rs := rand.New(rand.NewSource(3))
+	var s SyncIPSet
+	var ref IPSet
+	for i := 0; i < 300; i++ {
+		p := randomPrefix(rs)
+		if rs.Intn(3) == 0 {
+			s.Remove(p)
+			ref.Remove(p)
+		} else {
+			s.Add(p)
+			ref.Add(p)
+		}
+	}
+	for _, p := range []string{"2400::/12", "10.0.0.0/8", "2410::/16"} {
+		s.Add(netip.MustParsePrefix(p))
+		ref.Add(netip.MustParsePrefix(p))
+	}
+	s.Remove(netip.MustParsePrefix("2404:1::/32"))
+	ref.Remove(netip.MustParsePrefix("2404:1::/32"))
+	for _, p := range []string{"64.0.0.0/2", "0.0.0.0/7"} {
+		s.Add(netip.MustParsePrefix(p))
+		ref.Add(netip.MustParsePrefix(p))
+	}
+	if list, list1 := collectPrefixes(s.Iterate), prefixList(&ref); !reflect.DeepEqual(list, list1) {
+		t.Fatal(list, list1)
+	}
+
+	count4, count6 := ref.s4.Count(), ref.s6.Count()
+	total := new(big.Int).Add(new(big.Int).SetUint64(count4), count6)
+	if c := s.Count(); c.Cmp(total) != 0 {
+		t.Fatal(c, total)
+	}
+
+	check := func(addr netip.Addr) {
+		next, ok := s.NextIn(addr)
+		next1, ok1 := ref.NextIn(addr)
+		if ok != ok1 || ok && next != next1 {
+			t.Fatal("NextIn", addr, next, next1)
+		}
+		prev, ok := s.PrevIn(addr)
+		prev1, ok1 := ref.PrevIn(addr)
+		if ok != ok1 || ok && prev != prev1 {
+			t.Fatal("PrevIn", addr, prev, prev1)
+		}
+		notIn, ok := s.NextNotIn(addr)
+		notIn1, ok1 := ref.NextNotIn(addr)
+		if ok != ok1 || ok && notIn != notIn1 {
+			t.Fatal("NextNotIn", addr, notIn, notIn1)
+		}
+
+		var r1 *big.Int
+		ok1 = ref.Contains(addr)
+		if addr.Is4() {
+			r, _ := ref.s4.Rank(ipToUint(addr.As4()))
+			r1 = new(big.Int).SetUint64(r)
+		} else {
+			r1, _ = ref.s6.Rank(addr.As16())
+			if r1 != nil {
+				r1.Add(r1, new(big.Int).SetUint64(count4))
+			}
+		}
+		r, ok := s.Rank(addr)
+		if ok != ok1 || ok && r.Cmp(r1) != 0 {
+			t.Fatal("Rank", addr, r, r1)
+		}
+		if ok {
+			if a, ok := s.NthAddr(r); !ok || a != addr {
+				t.Fatal("NthAddr", r, a, addr)
+			}
+		}
+
+		var list, list1 []netip.Prefix
+		s.IterateFrom(addr, func(p netip.Prefix) bool {
+			list = append(list, p)
+			return len(list) < 10
+		})
+		ref.IterateFrom(addr, func(p netip.Prefix) bool {
+			list1 = append(list1, p)
+			return len(list1) < 10
+		})
+		if len(list) == 0 || len(list1) == 0 {
+			if len(list) != len(list1) {
+				t.Fatal("IterateFrom", addr, list, list1)
+			}
+		} else if !list[0].Contains(list1[0].Addr()) && !list1[0].Contains(list[0].Addr()) {
+			t.Fatal("IterateFrom", addr, list, list1)
+		}
+	}
+	list := prefixList(&ref)
+	for i := 0; i < 2000; i++ {
+		p := list[rs.Intn(len(list))]
+		check(p.Addr())
+		check(lastAddr(p))
+		check(p.Addr().Prev())
+		check(lastAddr(p).Next())
+		check(randomPrefix(rs).Addr())
+	}
+	check(netip.MustParseAddr("2404:1::"))
+	check(netip.MustParseAddr("2404:0:ffff::"))
+	if _, ok := s.NthAddr(total); ok {
+		t.Fatal()
+	}
+
+	parts := s.Split(3)
+	if len(parts) != 3 {
+		t.Fatal(len(parts))
+	}
+	var union IPSet
+	for _, part := range parts {
+		for _, p := range prefixList(part) {
+			union.Add(p)
+		}
+	}
+	assertSameSet(t, &union, &ref)
+
+	var old IPSet
+	old.Add(netip.MustParsePrefix("10.0.0.0/7"))
+	added, removed := s.Diff(&old)
+	for _, p := range prefixList(removed) {
+		old.Remove(p)
+	}
+	for _, p := range prefixList(added) {
+		old.Add(p)
+	}
+	assertSameSet(t, &old, &ref)
+}
+
+func TestSyncIPSetMethods(t *testing.T) {
+	rs := rand.New(rand.NewSource(4))
+	var s SyncIPSet
+	ref := randomSet(rs, 200)
+	s.addAll(ref)
+	if !s.Equal(ref) || s.Fingerprint() != ref.Fingerprint() {
+		t.Fatal()
+	}
+	c := s.Clone()
+	c.Add(netip.MustParsePrefix("0.0.0.0/0"))
+	if c.Equal(ref) || !s.Equal(ref) {
+		t.Fatal()
+	}
+
+	var buf, buf1 bytes.Buffer
+	if err := s.SerializeTo(&buf, Gzip); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Deserialize(&buf); err != nil || !c.Equal(ref) {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := s.SerializeCompressed(&buf); err != nil {
+		t.Fatal(err)
+	}
+	c.Add(netip.MustParsePrefix("::/0"))
+	if err := c.DeserializeCompressed(&buf); err != nil || !c.Equal(ref) {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if _, err := ref.WriteTextTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var s1 SyncIPSet
+	if _, err := s1.ReadTextFrom(&buf); err != nil || !s1.Equal(ref) {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	if _, err := s.WriteLPMTrieTo(&buf, &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ref.WriteLPMTrieTo(&buf1, &buf1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), buf1.Bytes()) {
+		t.Fatal()
+	}
+
+	other := randomSet(rs, 200)
+	added, removed := Diff(ref, other)
+	buf.Reset()
+	if err := WritePatch(&buf, added, removed); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ApplyPatch(&buf); err != nil || !s.Equal(other) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,260 @@
+package ipset
+
+import (
+	"math/bits"
+	"net/netip"
+)
+
+// IPTagSet maps addresses to bitmasks of up to 64 lists, so that membership in all lists can be checked with
+// a single lookup. The zero value is an empty set ready to use.
+//
+// The tree has the same structure as the one of IPSet, except that ptrPresent is not used. Instead, the leaves
+// are value nodes that hold the mask of the lists the corresponding prefix belongs to. The leaves are disjoint
+// and each of them holds the combined mask of all the lists, so the lookup stops at the first leaf.
+type IPTagSet struct {
+	s4, s6 ipsetBase
+}
+
+// valueNodeFlag marks a pointer to a value node. The node holds the low and the high 32 bits of the mask.
+const valueNodeFlag = 0x8000_0000
+
+func isValueNode(ptr uint32) bool {
+	return ptr&valueNodeFlag != 0
+}
+
+func (s *ipsetBase) tagMask(ptr uint32) uint64 {
+	if !isValueNode(ptr) {
+		return 0
+	}
+	idx := ptr &^ valueNodeFlag
+	return uint64(s.nodes[idx+1])<<32 | uint64(s.nodes[idx])
+}
+
+func (s *ipsetBase) isTagLeaf(ptr uint32) bool {
+	return ptr == ptrAbsent || isValueNode(ptr)
+}
+
+// setTagMask returns a leaf with the specified mask, reusing the value node if ptr is one.
+func (s *ipsetBase) setTagMask(ptr uint32, mask uint64) uint32 {
+	if mask == 0 {
+		s.freeTagNode(ptr)
+		return ptrAbsent
+	}
+	if isValueNode(ptr) {
+		idx := ptr &^ valueNodeFlag
+		s.nodes[idx], s.nodes[idx+1] = uint32(mask), uint32(mask>>32)
+		return ptr
+	}
+	return s.allocateNode(uint32(mask), uint32(mask>>32)) | valueNodeFlag
+}
+
+func (s *ipsetBase) freeTagNode(ptr uint32) {
+	switch {
+	case ptr == ptrAbsent:
+	case isValueNode(ptr):
+		s.release(ptr &^ valueNodeFlag)
+	case isSkipNode(ptr):
+		idx := ptrToIdx(ptr)
+		s.release(idx)
+		s.freeTagNode(s.nodes[idx+1])
+	default:
+		s.release(ptr)
+		s.freeTagNode(s.nodes[ptr])
+		s.freeTagNode(s.nodes[ptr+1])
+	}
+}
+
+// expandSkip converts a skip node into a regular node, moving the rest of the prefix into a new node.
+func (s *ipsetBase) expandSkip(ptr uint32) uint32 {
+	idx := ptrToIdx(ptr)
+	prefix, prefixLen := unpackPrefixLen(s.nodes[idx])
+	bit := prefix >> 31
+	var rest uint32
+	if prefixLen > 2 {
+		rest = s.allocateNode(packPrefixLen(prefix<<1, prefixLen-1), s.nodes[idx+1]) | skipNodeMask
+	} else {
+		var v [2]uint32
+		v[(prefix>>30)&1] = s.nodes[idx+1]
+		rest = idxToPtr(s.allocateNode(v[0], v[1]))
+	}
+	s.nodes[idx+bit], s.nodes[idx+(bit^1)] = rest, ptrAbsent
+	return idxToPtr(idx)
+}
+
+func applyTag(mask, bit uint64, set bool) uint64 {
+	if set {
+		return mask | bit
+	}
+	return mask &^ bit
+}
+
+// updateTag sets or clears the bit in the masks of all addresses within the prefix and returns the new pointer
+// to the subtree.
+func (s *ipsetBase) updateTag(ptr uint32, p ipPrefix, prefixLen uint32, bit uint64, set bool) uint32 {
+	prefix := p.hi32()
+	if s.isTagLeaf(ptr) {
+		mask := s.tagMask(ptr)
+		newMask := applyTag(mask, bit, set)
+		if prefixLen == 0 {
+			return s.setTagMask(ptr, newMask)
+		}
+		if newMask == mask {
+			return ptr
+		}
+		if ptr == ptrAbsent && prefixLen > 1 {
+			l := prefixLen
+			if l > maxPackablePrefixLen {
+				l = maxPackablePrefixLen
+			}
+			p.shl(l)
+			child := s.updateTag(ptrAbsent, p, prefixLen-l, bit, set)
+			return s.allocateNode(packPrefixLen(prefix, l), child) | skipNodeMask
+		}
+		// Split the leaf in two halves, the one that does not overlap with the prefix keeps the mask
+		other := uint32(ptrAbsent)
+		if ptr != ptrAbsent {
+			other = s.allocateNode(uint32(mask), uint32(mask>>32)) | valueNodeFlag
+		}
+		p.shl(1)
+		child := s.updateTag(ptr, p, prefixLen-1, bit, set)
+		var v [2]uint32
+		v[prefix>>31], v[(prefix>>31)^1] = child, other
+		return idxToPtr(s.allocateNode(v[0], v[1]))
+	}
+
+	if isSkipNode(ptr) {
+		idx := ptrToIdx(ptr)
+		curPrefix, curPrefixLen := unpackPrefixLen(s.nodes[idx])
+		commonLen := uint32(bits.LeadingZeros32(prefix ^ curPrefix))
+		if commonLen > curPrefixLen {
+			commonLen = curPrefixLen
+		}
+		if commonLen > prefixLen {
+			commonLen = prefixLen
+		}
+		if commonLen == curPrefixLen {
+			p.shl(curPrefixLen)
+			child := s.updateTag(s.nodes[idx+1], p, prefixLen-curPrefixLen, bit, set)
+			if child == ptrAbsent {
+				s.release(idx)
+				return ptrAbsent
+			}
+			s.nodes[idx+1] = child
+			return ptr
+		}
+		if !set {
+			// Clearing the bit does not affect the absent space around the skip node
+			if commonLen < prefixLen {
+				return ptr
+			}
+			child := s.updateTag(s.nodes[idx+1], p, 0, bit, set)
+			if child == ptrAbsent {
+				s.release(idx)
+				return ptrAbsent
+			}
+			s.nodes[idx+1] = child
+			return ptr
+		}
+		ptr = s.expandSkip(ptr)
+	}
+
+	// Regular node
+	if prefixLen == 0 {
+		left := s.updateTag(s.nodes[ptr], p, 0, bit, set)
+		s.nodes[ptr] = left
+		right := s.updateTag(s.nodes[ptr+1], p, 0, bit, set)
+		s.nodes[ptr+1] = right
+	} else {
+		b := prefix >> 31
+		p.shl(1)
+		child := s.updateTag(s.nodes[ptr+b], p, prefixLen-1, bit, set)
+		s.nodes[ptr+b] = child
+	}
+	// Merge the children if they are equal leaves
+	left, right := s.nodes[ptr], s.nodes[ptr+1]
+	if s.isTagLeaf(left) && s.isTagLeaf(right) && s.tagMask(left) == s.tagMask(right) {
+		s.freeTagNode(right)
+		s.release(ptr)
+		return left
+	}
+	return ptr
+}
+
+func (s *ipsetBase) setTag(p ipPrefix, prefixLen uint32, bit uint64, set bool) {
+	if len(s.nodes) < 2 {
+		if !set {
+			return
+		}
+		s.nodes = make([]uint32, 2, 8)
+	}
+	root := s.updateTag(s.nodes[s.rootSlot()], p, prefixLen, bit, set)
+	s.nodes[s.rootSlot()] = root
+}
+
+func (s *ipsetBase) matchTag(p ipPrefix) uint64 {
+	if len(s.nodes) < 2 {
+		return 0
+	}
+	ptr := s.nodes[s.rootSlot()]
+	for {
+		switch {
+		case ptr == ptrAbsent:
+			return 0
+		case isValueNode(ptr):
+			return s.tagMask(ptr)
+		case isSkipNode(ptr):
+			idx := ptrToIdx(ptr)
+			prefix, prefixLen := unpackPrefixLen(s.nodes[idx])
+			mask := ^uint32(0) << (32 - prefixLen)
+			if prefix != p.hi32()&mask {
+				return 0
+			}
+			p.shl(prefixLen)
+			ptr = s.nodes[idx+1]
+		default:
+			b := p.hi32() >> 31
+			p.shl(1)
+			ptr = s.nodes[ptr+b]
+		}
+	}
+}
+
+func (s *IPTagSet) set(prefix netip.Prefix, listID uint, set bool) {
+	if listID >= 64 {
+		panic("listID must be less than 64")
+	}
+	if !prefix.IsValid() {
+		return
+	}
+	prefix = unmapPrefix(prefix)
+	p, bits := ipPrefixFromAddr(prefix.Addr())
+	bit := uint64(1) << listID
+	if bits == 32 {
+		s.s4.setTag(p, uint32(prefix.Bits()), bit, set)
+	} else {
+		s.s6.setTag(p, uint32(prefix.Bits()), bit, set)
+	}
+}
+
+// Add adds the prefix to the list with the specified ID, which must be less than 64.
+// IPv4-mapped IPv6 prefixes are treated as IPv4.
+func (s *IPTagSet) Add(prefix netip.Prefix, listID uint) {
+	s.set(prefix, listID, true)
+}
+
+// Remove removes the prefix from the list with the specified ID, which must be less than 64. As with
+// IPSet.Remove, if the prefix is a part of a larger prefix, the remainder of the larger prefix stays in the list.
+func (s *IPTagSet) Remove(prefix netip.Prefix, listID uint) {
+	s.set(prefix, listID, false)
+}
+
+// Match returns the mask of the lists that contain the address (bit N is set if the address is in the list N).
+func (s *IPTagSet) Match(addr netip.Addr) uint64 {
+	if addr.Is4() || addr.Is4In6() {
+		p, _ := ipPrefixFromAddr(addr)
+		return s.s4.matchTag(p)
+	} else if addr.Is6() {
+		return s.s6.matchTag(ipPrefixFromIP6Addr(addr.As16()))
+	}
+	return 0
+}
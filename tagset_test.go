@@ -0,0 +1,101 @@
+package ipset
+
+import (
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+func TestIPTagSet(t *testing.T) {
+	var s IPTagSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"), 0)
+	s.Add(netip.MustParsePrefix("10.1.0.0/16"), 1)
+	s.Add(netip.MustParsePrefix("10.1.2.0/24"), 63)
+	s.Add(netip.MustParsePrefix("2001:db8::/32"), 2)
+	s.Add(netip.MustParsePrefix("::ffff:192.168.0.0/112"), 3)
+
+	if m := s.Match(netip.MustParseAddr("10.1.2.3")); m != 1|2|1<<63 {
+		t.Fatal(m)
+	}
+	if m := s.Match(netip.MustParseAddr("10.1.3.3")); m != 1|2 {
+		t.Fatal(m)
+	}
+	if m := s.Match(netip.MustParseAddr("10.2.3.3")); m != 1 {
+		t.Fatal(m)
+	}
+	if m := s.Match(netip.MustParseAddr("11.0.0.0")); m != 0 {
+		t.Fatal(m)
+	}
+	if m := s.Match(netip.MustParseAddr("2001:db8::1")); m != 4 {
+		t.Fatal(m)
+	}
+	if m := s.Match(netip.MustParseAddr("192.168.1.1")); m != 8 {
+		t.Fatal(m)
+	}
+
+	s.Remove(netip.MustParsePrefix("10.1.0.0/16"), 0)
+	if m := s.Match(netip.MustParseAddr("10.1.2.3")); m != 2|1<<63 {
+		t.Fatal(m)
+	}
+	if m := s.Match(netip.MustParseAddr("10.0.0.1")); m != 1 {
+		t.Fatal(m)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"), 64)
+}
+
+func TestIPTagSetRandom(t *testing.T) {
+	rs := rand.New(rand.NewSource(12345678901234567))
+	const lists = 5
+	var s IPTagSet
+	var sets [lists]IPSet4
+	var prefixes []netip.Prefix
+	for i := 0; i < 2000; i++ {
+		ip := 0x0A00_0000 | rs.Uint32()&0xFFFF
+		prefixLen := uint32(16 + rs.Intn(17))
+		listID := uint(rs.Intn(lists))
+		p := netip.PrefixFrom(addrFrom4(ip), int(prefixLen)).Masked()
+		if rs.Intn(3) == 0 {
+			s.Remove(p, listID)
+			sets[listID].Remove(ip, prefixLen)
+		} else {
+			s.Add(p, listID)
+			sets[listID].Add(ip, prefixLen)
+			prefixes = append(prefixes, p)
+		}
+	}
+	check := func(ip uint32) {
+		var expected uint64
+		for i := range sets {
+			if sets[i].Contains(ip) {
+				expected |= 1 << i
+			}
+		}
+		if m := s.Match(addrFrom4(ip)); m != expected {
+			t.Fatal(addrFrom4(ip), m, expected)
+		}
+	}
+	for _, p := range prefixes {
+		ip := ipToUint(p.Addr().As4())
+		check(ip - 1)
+		check(ip)
+		check(ip + (1<<(32-p.Bits()) - 1))
+		check(ip + 1<<(32-p.Bits()))
+	}
+	for i := 0; i < 10000; i++ {
+		check(0x0A00_0000 | rs.Uint32()&0xFFFF)
+	}
+
+	// Removing everything must free all nodes
+	for listID := uint(0); listID < lists; listID++ {
+		s.Remove(netip.MustParsePrefix("10.0.0.0/16"), listID)
+	}
+	if s.s4.nodes[1] != ptrAbsent || len(s.s4.freeList) != (len(s.s4.nodes)-2)/2 {
+		t.Fatal(s.s4.nodes[1], len(s.s4.freeList), len(s.s4.nodes))
+	}
+}
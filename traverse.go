@@ -0,0 +1,168 @@
+package ipset
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// nodeRef is a position in the tree viewed as a plain binary trie with one bit per level. Skip nodes are traversed
+// one bit at a time, off is the number of bits of the skip node's prefix that have already been consumed.
+// Leaves (ptrAbsent and ptrPresent) are their own children.
+type nodeRef struct {
+	ptr uint32
+	off uint32
+}
+
+func (r nodeRef) isLeaf() bool {
+	return r.ptr <= ptrPresent
+}
+
+func (s *ipsetBase) rootRef() nodeRef {
+	if len(s.nodes) < 2 {
+		return nodeRef{ptr: ptrAbsent}
+	}
+	return nodeRef{ptr: s.nodes[s.rootSlot()]}
+}
+
+func (s *ipsetBase) children(r nodeRef) (left, right nodeRef) {
+	if r.isLeaf() {
+		return r, r
+	}
+	idx := ptrToIdx(r.ptr)
+	if !isSkipNode(r.ptr) {
+		return nodeRef{ptr: s.nodes[idx]}, nodeRef{ptr: s.nodes[idx+1]}
+	}
+	prefix, prefixLen := unpackPrefixLen(s.nodes[idx])
+	next := nodeRef{ptr: r.ptr, off: r.off + 1}
+	if next.off == prefixLen {
+		next = nodeRef{ptr: s.nodes[idx+1]}
+	}
+	if (prefix<<r.off)&0x8000_0000 == 0 {
+		return next, nodeRef{ptr: ptrAbsent}
+	}
+	return nodeRef{ptr: ptrAbsent}, next
+}
+
+// withBit returns a copy of the prefix with the bit at the specified position (0 being the most significant) set.
+func (p ipPrefix) withBit(pos uint32) ipPrefix {
+	if pos < 64 {
+		p.hi |= 1 << (63 - pos)
+	} else {
+		p.lo |= 1 << (127 - pos)
+	}
+	return p
+}
+
+// withChunk returns a copy of the prefix with the bits of the chunk (aligned to the most significant bit) placed
+// starting at the specified position.
+func (p ipPrefix) withChunk(chunk uint32, pos uint32) ipPrefix {
+	c := uint64(chunk) << 32
+	if pos >= 64 {
+		p.lo |= c >> (pos - 64)
+	} else {
+		p.hi |= c >> pos
+		p.lo |= c << (64 - pos)
+	}
+	return p
+}
+
+// chunk returns 32 bits of the prefix starting at the specified position, aligned to the most significant bit.
+func (p ipPrefix) chunk(pos uint32) uint32 {
+	if pos >= 64 {
+		return uint32((p.lo << (pos - 64)) >> 32)
+	}
+	return uint32((p.hi<<pos | p.lo>>(64-pos)) >> 32)
+}
+
+// suffix returns the bits of the address that follow the first prefixLen bits as a number. The address length
+// is defined by bits (32 or 128).
+func (p ipPrefix) suffix(prefixLen, bits uint32) uint128 {
+	if bits == 32 {
+		return uint128{lo: uint64(p.hi32()) & (1<<(32-prefixLen) - 1)}
+	}
+	if prefixLen >= 64 {
+		return uint128{lo: p.lo & (1<<(128-prefixLen) - 1)}
+	}
+	return uint128{hi: p.hi & (1<<(64-prefixLen) - 1), lo: p.lo}
+}
+
+// withSuffix returns a copy of the prefix with the number placed into the bits that follow the prefix. The number
+// must fit into these bits.
+func (p ipPrefix) withSuffix(v uint128, bits uint32) ipPrefix {
+	if bits == 32 {
+		p.hi |= v.lo << 32
+	} else {
+		p.hi |= v.hi
+		p.lo |= v.lo
+	}
+	return p
+}
+
+// ipPrefixFromAddr converts the address to ipPrefix and returns it along with the address length in bits.
+// IPv4-mapped IPv6 addresses are treated as IPv4.
+func ipPrefixFromAddr(addr netip.Addr) (p ipPrefix, bits uint32) {
+	if addr.Is4() || addr.Is4In6() {
+		a := addr.As4()
+		return ipPrefixFromIP4Addr(binary.BigEndian.Uint32(a[:])), 32
+	}
+	return ipPrefixFromIP6Addr(addr.As16()), 128
+}
+
+// toNetip converts the first prefixLen bits of the prefix to netip.Prefix of the family defined by bits
+// (32 or 128).
+func (p ipPrefix) toNetip(prefixLen, bits uint32) netip.Prefix {
+	if bits == 32 {
+		var a [4]byte
+		binary.BigEndian.PutUint32(a[:], p.hi32())
+		return netip.PrefixFrom(netip.AddrFrom4(a), int(prefixLen))
+	}
+	var a [16]byte
+	binary.BigEndian.PutUint64(a[:8], p.hi)
+	binary.BigEndian.PutUint64(a[8:], p.lo)
+	return netip.PrefixFrom(netip.AddrFrom16(a), int(prefixLen))
+}
+
+// bit returns the bit at the specified position (0 being the most significant).
+func (p ipPrefix) bit(pos uint32) uint32 {
+	if pos < 64 {
+		return uint32(p.hi>>(63-pos)) & 1
+	}
+	return uint32(p.lo>>(127-pos)) & 1
+}
+
+// child returns the child of r which the bit of the prefix at the specified depth leads to.
+func (s *ipsetBase) child(r nodeRef, p ipPrefix, depth uint32) nodeRef {
+	left, right := s.children(r)
+	if p.bit(depth) == 0 {
+		return left
+	}
+	return right
+}
+
+// overlaps returns true if the set contains any address within the prefix.
+func (s *ipsetBase) overlaps(p ipPrefix, prefixLen uint32) bool {
+	r := s.rootRef()
+	for depth := uint32(0); ; depth++ {
+		if r.isLeaf() {
+			return r.ptr == ptrPresent
+		}
+		if depth == prefixLen {
+			return true
+		}
+		r = s.child(r, p, depth)
+	}
+}
+
+// covers returns true if the set contains all addresses within the prefix.
+func (s *ipsetBase) covers(p ipPrefix, prefixLen uint32) bool {
+	r := s.rootRef()
+	for depth := uint32(0); ; depth++ {
+		if r.isLeaf() {
+			return r.ptr == ptrPresent
+		}
+		if depth == prefixLen {
+			return false
+		}
+		r = s.child(r, p, depth)
+	}
+}
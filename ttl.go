@@ -0,0 +1,126 @@
+package ipset
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// TTLSet is a set of prefixes each of which expires after a specified time. Expired prefixes are not matched
+// by Contains, they are removed from the underlying tree by Sweep. It is safe for concurrent use.
+// The zero value is an empty set ready to use.
+type TTLSet struct {
+	// Clock returns the current time. If nil, time.Now is used.
+	Clock func() time.Time
+
+	mu     sync.RWMutex
+	set    IPSet
+	expiry map[netip.Prefix]time.Time
+}
+
+func (s *TTLSet) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock()
+	}
+	return time.Now()
+}
+
+// AddWithTTL adds the prefix to the set for the duration d. If the prefix is already in the set, its expiry time
+// is extended if necessary, but never shortened.
+func (s *TTLSet) AddWithTTL(prefix netip.Prefix, d time.Duration) {
+	expires := s.now().Add(d)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.set.storedPrefix(prefix, true)
+	if !ok {
+		return
+	}
+	if s.expiry == nil {
+		s.expiry = make(map[netip.Prefix]time.Time)
+	}
+	if existing, exists := s.expiry[key]; exists && !existing.Before(expires) {
+		return
+	}
+	s.expiry[key] = expires
+	s.set.Add(key)
+}
+
+// Contains returns true if the address is within a prefix that has not expired yet.
+func (s *TTLSet) Contains(addr netip.Addr) bool {
+	now := s.now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.set.Contains(addr) {
+		return false
+	}
+	addr = addr.Unmap()
+	for l := 0; l <= addr.BitLen(); l++ {
+		p, _ := addr.Prefix(l)
+		if expires, exists := s.expiry[p]; exists && now.Before(expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of prefixes in the set, including the expired ones that have not been swept yet.
+func (s *TTLSet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.expiry)
+}
+
+// overlapsPrefix returns true if the set contains any address within the prefix, which must be in the form
+// returned by storedPrefix.
+func (s *IPSet) overlapsPrefix(prefix netip.Prefix) bool {
+	p, bits := ipPrefixFromAddr(prefix.Addr())
+	if bits == 32 {
+		return s.s4.overlaps(p, uint32(prefix.Bits()))
+	}
+	return s.s6.overlaps(p, uint32(prefix.Bits()))
+}
+
+// Sweep removes the prefixes that have expired by the specified time from the tree, so that their nodes can be
+// reused. It returns the number of removed prefixes.
+func (s *TTLSet) Sweep(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired IPSet
+	n := 0
+	for p, expires := range s.expiry {
+		if !now.Before(expires) {
+			delete(s.expiry, p)
+			expired.Add(p)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	expired.Iterate(func(p netip.Prefix) bool {
+		s.set.Remove(p)
+		return true
+	})
+	// The remaining prefixes that overlap with the expired ones could have been partially removed
+	for p := range s.expiry {
+		if expired.overlapsPrefix(p) {
+			s.set.Add(p)
+		}
+	}
+	return n
+}
+
+// Run calls Sweep with the current time every interval until the context is done. It returns the context's error.
+func (s *TTLSet) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			s.Sweep(s.now())
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestTTLSet(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := TTLSet{
+		Clock: func() time.Time {
+			return now
+		},
+	}
+	s.AddWithTTL(netip.MustParsePrefix("10.0.0.0/24"), 10*time.Minute)
+	s.AddWithTTL(netip.MustParsePrefix("::ffff:10.0.0.1/128"), 20*time.Minute)
+	s.AddWithTTL(netip.MustParsePrefix("2001:db8::/32"), 30*time.Minute)
+	s.AddWithTTL(netip.MustParsePrefix("2001:db8::/32"), time.Minute)
+
+	if !s.Contains(netip.MustParseAddr("10.0.0.2")) || !s.Contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Fatal()
+	}
+
+	now = now.Add(15 * time.Minute)
+	if s.Contains(netip.MustParseAddr("10.0.0.2")) {
+		t.Fatal()
+	}
+	if !s.Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal()
+	}
+	if n := s.Sweep(now); n != 1 {
+		t.Fatal(n)
+	}
+	if !s.Contains(netip.MustParseAddr("10.0.0.1")) || s.set.Contains(netip.MustParseAddr("10.0.0.2")) {
+		t.Fatal()
+	}
+	if s.Len() != 2 {
+		t.Fatal(s.Len())
+	}
+
+	now = now.Add(15 * time.Minute)
+	if s.Contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Fatal()
+	}
+	if n := s.Sweep(now); n != 2 {
+		t.Fatal(n)
+	}
+	if !isEmpty(&s.set) || s.Len() != 0 {
+		t.Fatal()
+	}
+}
+
+func TestTTLSet_Run(t *testing.T) {
+	var s TTLSet
+	s.AddWithTTL(netip.MustParsePrefix("10.0.0.0/24"), -time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx, time.Millisecond)
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for s.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,137 @@
+package ipset
+
+import (
+	"net/netip"
+)
+
+// Txn is a batch of changes to an IPSet that is applied all at once by Commit or discarded by Rollback.
+// The changes are made to a copy of the set that shares the node storage with it (see IPSet.Snapshot), so
+// the set itself is not affected until the transaction is committed. The set must not be modified while
+// the transaction is in progress, but it can be read.
+//
+// Commit is all-or-nothing, but it is not atomic with respect to concurrent readers: it updates the IPSet struct
+// in place, so the set must not be read concurrently with Commit or Rollback. If the readers must not wait for
+// the writer, they should access the set through an atomic.Pointer, and the writer should apply the transaction
+// to a Snapshot of the current version and store the pointer to it after Commit.
+//
+// Once the transaction is finished, calling its methods panics, except for Rollback, which does nothing, so that
+// it can be deferred.
+type Txn struct {
+	set            *IPSet
+	work           IPSet
+	saved4, saved6 ipsetBase
+	done           bool
+}
+
+// beginTxn returns a copy of the tree that can be modified without affecting the original. Unlike snapshot, it
+// gives the copy the spare capacity of the slice, so that the nodes it allocates can be reused by the original
+// after a rollback, and it does not freeze the nodes of the original. The nodes of the original that the copy
+// replaces are retired, so that they could be reused after a commit (see commitTxn).
+func (s *ipsetBase) beginTxn() (work ipsetBase) {
+	if len(s.nodes) == 0 {
+		return
+	}
+	l := len(s.nodes)
+	work = ipsetBase{
+		nodes:        s.nodes,
+		freeList:     append([]uint32(nil), s.freeList...),
+		root:         s.root,
+		frozen:       uint32(l),
+		trackRetired: true,
+	}
+	s.nodes = s.nodes[:l:l]
+	return
+}
+
+// commitTxn prepares the copy returned by beginTxn to replace the original. The retired nodes that were only
+// reachable from the original are put to the free list, unless a snapshot of the original was taken during
+// the transaction (which freezes all of its nodes).
+func (s *ipsetBase) commitTxn(orig, saved *ipsetBase) {
+	limit := uint32(len(saved.nodes))
+	if orig.frozen == saved.frozen {
+		limit = saved.frozen
+	}
+	retired := s.retired
+	s.retired = orig.retired
+	for _, idx := range retired {
+		if idx >= limit {
+			s.freeList = append(s.freeList, idx)
+		} else if orig.trackRetired {
+			s.retired = append(s.retired, idx)
+		}
+	}
+	s.trackRetired = orig.trackRetired
+	s.frozen = limit
+}
+
+// rollbackTxn restores the state saved before beginTxn. If snapshots were taken while the transaction was in
+// progress, the nodes remain frozen.
+func (s *ipsetBase) rollbackTxn(saved ipsetBase) {
+	frozen := s.frozen
+	*s = saved
+	s.frozen = frozen
+}
+
+// Begin starts a transaction.
+func (s *IPSet) Begin() *Txn {
+	t := &Txn{
+		set:    s,
+		saved4: s.s4.ipsetBase,
+		saved6: s.s6.ipsetBase,
+	}
+	t.work = IPSet{
+		s4:       IPSet4{ipsetBase: s.s4.beginTxn(), maxPrefixLen: s.s4.maxPrefixLen},
+		s6:       IPSet6{ipsetBase: s.s6.beginTxn(), maxPrefixLen: s.s6.maxPrefixLen},
+		sources:  s.sources.share(),
+		metadata: s.metadata,
+	}
+	return t
+}
+
+func (t *Txn) checkDone() {
+	if t.done {
+		panic("transaction is already committed or rolled back")
+	}
+}
+
+// Add adds the prefix to the set within the transaction.
+// See IPSet.Add for more details.
+func (t *Txn) Add(prefix netip.Prefix) {
+	t.checkDone()
+	t.work.Add(prefix)
+}
+
+// Remove removes the prefix from the set within the transaction.
+// See IPSet.Remove for more details.
+func (t *Txn) Remove(prefix netip.Prefix) {
+	t.checkDone()
+	t.work.Remove(prefix)
+}
+
+// Contains returns true if the address is in the set with the changes made within the transaction.
+func (t *Txn) Contains(addr netip.Addr) bool {
+	t.checkDone()
+	return t.work.Contains(addr)
+}
+
+// Commit replaces the contents of the set with the result of the transaction.
+func (t *Txn) Commit() {
+	t.checkDone()
+	t.done = true
+	t.work.s4.commitTxn(&t.set.s4.ipsetBase, &t.saved4)
+	t.work.s6.commitTxn(&t.set.s6.ipsetBase, &t.saved6)
+	*t.set = t.work
+	t.work = IPSet{}
+}
+
+// Rollback discards the changes made within the transaction. The nodes allocated by the transaction are reused
+// by the set. Calling Rollback after the transaction is finished has no effect.
+func (t *Txn) Rollback() {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.set.s4.rollbackTxn(t.saved4)
+	t.set.s6.rollbackTxn(t.saved6)
+	t.work = IPSet{}
+}
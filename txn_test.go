@@ -0,0 +1,173 @@
+package ipset
+
+import (
+	"math/rand"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTxn(t *testing.T) {
+	var s IPSet
+	s.Add(netip.MustParsePrefix("10.0.0.0/24"))
+
+	txn := s.Begin()
+	txn.Add(netip.MustParsePrefix("192.168.0.0/16"))
+	txn.Remove(netip.MustParsePrefix("10.0.0.0/25"))
+	if !txn.Contains(netip.MustParseAddr("192.168.1.1")) || txn.Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal()
+	}
+	if s.Contains(netip.MustParseAddr("192.168.1.1")) || !s.Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal()
+	}
+	txn.Commit()
+	if !s.Contains(netip.MustParseAddr("192.168.1.1")) || s.Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal()
+	}
+	txn.Rollback()
+	if !s.Contains(netip.MustParseAddr("192.168.1.1")) {
+		t.Fatal()
+	}
+
+	nodes := s.s4.nodes
+	txn = s.Begin()
+	txn.Add(netip.MustParsePrefix("172.16.0.0/12"))
+	txn.Remove(netip.MustParsePrefix("192.168.0.0/16"))
+	txn.Rollback()
+	if s.Contains(netip.MustParseAddr("172.16.0.1")) || !s.Contains(netip.MustParseAddr("192.168.1.1")) {
+		t.Fatal()
+	}
+	if len(s.s4.nodes) != len(nodes) || cap(s.s4.nodes) != cap(nodes) {
+		t.Fatal(len(s.s4.nodes), cap(s.s4.nodes))
+	}
+
+	for _, fn := range []func(){
+		func() { txn.Add(netip.MustParsePrefix("172.16.0.0/12")) },
+		func() { txn.Remove(netip.MustParsePrefix("172.16.0.0/12")) },
+		func() { txn.Contains(netip.MustParseAddr("172.16.0.1")) },
+		txn.Commit,
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected panic")
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+func TestTxnPublish(t *testing.T) {
+	var cur atomic.Pointer[IPSet]
+	cur.Store(&IPSet{})
+	next := cur.Load().Snapshot()
+	txn := next.Begin()
+	txn.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	txn.Commit()
+	if cur.Load().Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal()
+	}
+	cur.Store(next)
+	if !cur.Load().Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal()
+	}
+}
+
+func TestTxnRandom(t *testing.T) {
+	rs := rand.New(rand.NewSource(12345678901234567))
+	var s IPSet
+	ref := new(IPSet)
+	for i := 0; i < 200; i++ {
+		randomUpdate(rs, &s, ref)
+	}
+	var snapshots []*IPSet
+	var snapshotRefs []*IPSet
+	for i := 0; i < 50; i++ {
+		txn := s.Begin()
+		work := ref.Clone()
+		for j := 0; j < 20; j++ {
+			randomUpdate(rs, &txn.work, work)
+		}
+		if rs.Intn(4) == 0 {
+			// Snapshots taken during the transaction must not be affected by it
+			snapshots = append(snapshots, s.Snapshot())
+			snapshotRefs = append(snapshotRefs, ref.Clone())
+		}
+		assertSameSet(t, &s, ref)
+		if rs.Intn(2) == 0 {
+			txn.Commit()
+			ref = work
+		} else {
+			txn.Rollback()
+		}
+		assertSameSet(t, &s, ref)
+		randomUpdate(rs, &s, ref)
+	}
+	for i := range snapshots {
+		assertSameSet(t, snapshots[i], snapshotRefs[i])
+	}
+}
+
+func TestTxnReusesNodes(t *testing.T) {
+	rs := rand.New(rand.NewSource(1))
+	var s IPSet
+	for i := 0; i < 1000; i++ {
+		s.Add(randomPrefix(rs))
+	}
+	p := netip.MustParsePrefix("192.0.2.0/24")
+	cycle := func() {
+		txn := s.Begin()
+		txn.Add(p)
+		txn.Commit()
+		txn = s.Begin()
+		txn.Remove(p)
+		txn.Commit()
+	}
+	for i := 0; i < 10; i++ {
+		cycle()
+	}
+	l := len(s.s4.nodes)
+	for i := 0; i < 200; i++ {
+		cycle()
+	}
+	if len(s.s4.nodes) != l {
+		t.Fatal(l, len(s.s4.nodes))
+	}
+	if s.s4.frozen != 0 || len(s.s4.retired) != 0 {
+		t.Fatal(s.s4.frozen, len(s.s4.retired))
+	}
+
+	txn := s.Begin()
+	txn.Add(p)
+	txn.Rollback()
+	if s.s4.frozen != 0 {
+		t.Fatal(s.s4.frozen)
+	}
+	for i := 0; i < 200; i++ {
+		s.Add(p)
+		s.Remove(p)
+	}
+	if len(s.s4.nodes) != l {
+		t.Fatal(l, len(s.s4.nodes))
+	}
+}
+
+func TestTxnSnapshotDuringCommit(t *testing.T) {
+	rs := rand.New(rand.NewSource(2))
+	var s IPSet
+	for i := 0; i < 100; i++ {
+		s.Add(randomPrefix(rs))
+	}
+	ref := s.Clone()
+	txn := s.Begin()
+	for i := 0; i < 50; i++ {
+		txn.Remove(randomPrefix(rs))
+	}
+	snap := s.Snapshot()
+	txn.Commit()
+	for i := 0; i < 200; i++ {
+		s.Add(randomPrefix(rs))
+	}
+	assertSameSet(t, snap, ref)
+}
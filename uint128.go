@@ -0,0 +1,69 @@
+package ipset
+
+import (
+	"math/big"
+	"math/bits"
+)
+
+// uint128 is used for address counts, which do not fit into uint64 for IPv6.
+type uint128 struct {
+	hi, lo uint64
+}
+
+// pow2 returns 2^n. 2^128 wraps around to 0.
+func pow2(n uint32) uint128 {
+	if n >= 128 {
+		return uint128{}
+	}
+	if n >= 64 {
+		return uint128{hi: 1 << (n - 64)}
+	}
+	return uint128{lo: 1 << n}
+}
+
+func (a uint128) add(b uint128) uint128 {
+	lo, carry := bits.Add64(a.lo, b.lo, 0)
+	hi, _ := bits.Add64(a.hi, b.hi, carry)
+	return uint128{hi: hi, lo: lo}
+}
+
+func (a uint128) sub(b uint128) uint128 {
+	lo, borrow := bits.Sub64(a.lo, b.lo, 0)
+	hi, _ := bits.Sub64(a.hi, b.hi, borrow)
+	return uint128{hi: hi, lo: lo}
+}
+
+func (a uint128) cmp(b uint128) int {
+	switch {
+	case a.hi < b.hi:
+		return -1
+	case a.hi > b.hi:
+		return 1
+	case a.lo < b.lo:
+		return -1
+	case a.lo > b.lo:
+		return 1
+	}
+	return 0
+}
+
+func (a uint128) isZero() bool {
+	return a.hi == 0 && a.lo == 0
+}
+
+func (a uint128) big() *big.Int {
+	b := new(big.Int).SetUint64(a.hi)
+	b.Lsh(b, 64)
+	return b.Or(b, new(big.Int).SetUint64(a.lo))
+}
+
+// uint128FromBig converts a non-negative big.Int to uint128. The second return value is false if the number is
+// negative or does not fit.
+func uint128FromBig(b *big.Int) (uint128, bool) {
+	if b.Sign() < 0 || b.BitLen() > 128 {
+		return uint128{}, false
+	}
+	lo := new(big.Int).And(b, new(big.Int).SetUint64(^uint64(0)))
+	hi := new(big.Int).Rsh(b, 64)
+	return uint128{hi: hi.Uint64(), lo: lo.Uint64()}, true
+}